@@ -0,0 +1,348 @@
+package auditcollector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/client/cloudfoundry"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/events"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/filter"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+
+	"github.com/cloudfoundry/gosteno"
+)
+
+const eventSourceTypeName = "cloudfoundry"
+
+// errStopped is returned when the collector is stopped while it sends the events
+var errStopped = errors.New("the audit collector was stopped")
+
+// defaultEventTypes are the audit events collected when no include pattern is set:
+// pushes, crashes, restarts, scaling and ssh sessions of the apps
+var defaultEventTypes = []string{
+	"audit.app.create",
+	"audit.app.delete-request",
+	"audit.app.deployment.create",
+	"audit.app.droplet.create",
+	"audit.app.process.crash",
+	"audit.app.process.scale",
+	"audit.app.restage",
+	"audit.app.restart",
+	"audit.app.ssh-authorized",
+	"audit.app.ssh-unauthorized",
+	"audit.app.start",
+	"audit.app.stop",
+	"app.crash",
+}
+
+// alertTypes are the Datadog alert types of the audit events that are not info
+var alertTypes = map[string]string{
+	"audit.app.process.crash":    "error",
+	"app.crash":                  "error",
+	"audit.app.ssh-unauthorized": "warning",
+}
+
+// cursor is where the collector resumes from: the creation time of the last events and their guids,
+// the next poll requests the events created at or after that time and skips the ones already sent
+type cursor struct {
+	Since string
+	Seen  []string
+}
+
+type AuditCollector struct {
+	cfClient        *cloudfoundry.CFClient
+	log             *gosteno.Logger
+	processedEvents chan<- events.Event
+	customTags      []string
+	queryInterval   uint32
+	cursorFile      string
+	types           []string // requested to Cloud Controller, nil when the include patterns are not all literal types
+	include         []*regexp.Regexp
+	exclude         []*regexp.Regexp
+	cursor          cursor
+	stopper         chan bool
+}
+
+func NewAuditCollector(
+	config *config.Config,
+	processedEvents chan<- events.Event,
+	log *gosteno.Logger,
+	customTags []string) (*AuditCollector, error) {
+	include, types, err := compilePatterns(config.AuditEventsInclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AuditEventsInclude: %v", err)
+	}
+	if len(include) == 0 {
+		include, types, _ = compilePatterns(defaultEventTypes)
+	}
+	exclude, _, err := compilePatterns(config.AuditEventsExclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AuditEventsExclude: %v", err)
+	}
+
+	cfClient, err := cloudfoundry.NewClient(config, log)
+	if err != nil {
+		return nil, err
+	}
+	// The audit events are only available with the v3 API
+	cfClient.ApiVersion = 3
+
+	a := &AuditCollector{
+		cfClient:        cfClient,
+		log:             log,
+		processedEvents: processedEvents,
+		customTags:      customTags,
+		queryInterval:   config.AuditEventsIntervalSeconds,
+		cursorFile:      config.AuditEventsCursorFile,
+		types:           types,
+		include:         include,
+		exclude:         exclude,
+		stopper:         make(chan bool),
+	}
+	a.loadCursor()
+	return a, nil
+}
+
+func (a *AuditCollector) Start() {
+	go a.run()
+}
+
+func (a *AuditCollector) Stop() {
+	a.stopper <- true
+}
+
+func (a *AuditCollector) run() {
+	// Query the data with random jitter so that we don't overload the cloud controller
+	ticker, jitterWait := util.GetTickerWithJitter(a.queryInterval, 0.1)
+	defer ticker.Stop()
+	if !a.pushEvents() {
+		return
+	}
+	for {
+		select {
+		case <-ticker.C:
+			jitterWait()
+			if !a.pushEvents() {
+				return
+			}
+		case <-a.stopper:
+			return
+		}
+	}
+}
+
+// pushEvents sends the audit events created since the cursor, page by page, and moves the cursor past each page.
+// It returns false when the collector was stopped while sending them.
+func (a *AuditCollector) pushEvents() bool {
+	seen := map[string]bool{}
+	for _, guid := range a.cursor.Seen {
+		seen[guid] = true
+	}
+	// The events created at the time of the cursor are returned again, they are all seen again
+	next := cursor{Since: a.cursor.Since}
+	collected := 0
+	err := a.cfClient.ForEachAuditEventsPage(a.types, a.cursor.Since, func(auditEvents []cloudfoundry.AuditEvent) error {
+		var kept []cloudfoundry.AuditEvent
+		for _, auditEvent := range auditEvents {
+			// The events are ordered by creation time
+			if auditEvent.CreatedAt != next.Since {
+				next = cursor{Since: auditEvent.CreatedAt}
+			}
+			next.Seen = append(next.Seen, auditEvent.GUID)
+			if !seen[auditEvent.GUID] && a.keep(auditEvent.Type) {
+				kept = append(kept, auditEvent)
+			}
+		}
+
+		apps := a.getApps(kept)
+		for _, auditEvent := range kept {
+			// The events of the page are sent again after a restart, the cursor is not past them yet
+			select {
+			case a.processedEvents <- a.convert(auditEvent, apps[auditEvent.Target.GUID]):
+			case <-a.stopper:
+				return errStopped
+			}
+		}
+		collected += len(kept)
+
+		if len(auditEvents) > 0 {
+			a.cursor = cursor{Since: next.Since, Seen: append([]string(nil), next.Seen...)}
+			a.saveCursor()
+		}
+		return nil
+	})
+	if err == errStopped {
+		return false
+	}
+	if err != nil {
+		a.log.Errorf("could not get the audit events: %v", err)
+	}
+	a.log.Debugf("Collected %d audit events", collected)
+	return true
+}
+
+// keep returns true when the type matches an include pattern and no exclude pattern
+func (a *AuditCollector) keep(eventType string) bool {
+	return matchAny(a.include, eventType) && !matchAny(a.exclude, eventType)
+}
+
+// getApps returns the apps targeted by the events, by guid, to tag the events with their space and org
+func (a *AuditCollector) getApps(auditEvents []cloudfoundry.AuditEvent) map[string]cloudfoundry.CFApplication {
+	var guids []string
+	for _, auditEvent := range auditEvents {
+		if auditEvent.Target.Type == "app" {
+			guids = append(guids, auditEvent.Target.GUID)
+		}
+	}
+	apps := map[string]cloudfoundry.CFApplication{}
+	if len(guids) == 0 {
+		return apps
+	}
+	cfapps, err := a.cfClient.GetApplicationsByGUID(guids)
+	if err != nil {
+		a.log.Warnf("could not get the apps of the audit events, they are sent without their space and org names: %v", err)
+		return apps
+	}
+	for _, cfapp := range cfapps {
+		apps[cfapp.GUID] = cfapp
+	}
+	return apps
+}
+
+// convert turns an audit event into a Datadog event, app is the zero value when the event does not target a known app
+func (a *AuditCollector) convert(auditEvent cloudfoundry.AuditEvent, app cloudfoundry.CFApplication) events.Event {
+	tags := []string{}
+	tags = append(tags, a.customTags...)
+	tags = appendTagIfNotEmpty(tags, "event_type", auditEvent.Type)
+	tags = appendTagIfNotEmpty(tags, "actor_type", auditEvent.Actor.Type)
+	tags = appendTagIfNotEmpty(tags, "actor_name", auditEvent.Actor.Name)
+	tags = appendTagIfNotEmpty(tags, "actor_id", auditEvent.Actor.GUID)
+	tags = appendTagIfNotEmpty(tags, "target_type", auditEvent.Target.Type)
+	tags = appendTagIfNotEmpty(tags, "target_name", auditEvent.Target.Name)
+	tags = appendTagIfNotEmpty(tags, "target_id", auditEvent.Target.GUID)
+	if auditEvent.Target.Type == "app" {
+		// Same tags as the app metrics
+		tags = appendTagIfNotEmpty(tags, "app_name", auditEvent.Target.Name)
+		tags = appendTagIfNotEmpty(tags, "guid", auditEvent.Target.GUID)
+	}
+	tags = appendTagIfNotEmpty(tags, "space_name", app.SpaceName)
+	tags = appendTagIfNotEmpty(tags, "space_id", auditEvent.Space.GUID)
+	tags = appendTagIfNotEmpty(tags, "org_name", app.OrgName)
+	tags = appendTagIfNotEmpty(tags, "org_id", auditEvent.Organization.GUID)
+	sort.Strings(tags)
+
+	text := fmt.Sprintf("%s %s triggered %s on %s %s",
+		auditEvent.Actor.Type, auditEvent.Actor.Name, auditEvent.Type, auditEvent.Target.Type, auditEvent.Target.Name)
+	if len(auditEvent.Data) > 0 {
+		if data, err := json.Marshal(auditEvent.Data); err == nil {
+			text += "\n" + string(data)
+		}
+	}
+
+	event := events.Event{
+		Title:          fmt.Sprintf("%s %s: %s", auditEvent.Target.Type, auditEvent.Target.Name, auditEvent.Type),
+		Text:           text,
+		Tags:           tags,
+		AlertType:      "info",
+		SourceTypeName: eventSourceTypeName,
+		AggregationKey: auditEvent.Target.GUID,
+	}
+	if alertType, ok := alertTypes[auditEvent.Type]; ok {
+		event.AlertType = alertType
+	}
+	if createdAt, err := time.Parse(time.RFC3339, auditEvent.CreatedAt); err == nil {
+		event.DateHappened = createdAt.Unix()
+	}
+	return event
+}
+
+// loadCursor resumes from the saved cursor, or from now when there is none so that past events are not sent
+func (a *AuditCollector) loadCursor() {
+	a.cursor = cursor{Since: time.Now().UTC().Format(time.RFC3339)}
+	if a.cursorFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(a.cursorFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		var saved cursor
+		if err = json.Unmarshal(data, &saved); err == nil && saved.Since != "" {
+			a.cursor = saved
+			a.log.Infof("resuming the audit events from %s", saved.Since)
+			return
+		}
+	}
+	a.log.Warnf("could not load the audit events cursor, collecting the events from now: %v", err)
+}
+
+// saveCursor writes the cursor to the cursor file, if any
+func (a *AuditCollector) saveCursor() {
+	if a.cursorFile == "" {
+		return
+	}
+	data, err := json.Marshal(a.cursor)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(a.cursorFile), 0700)
+	}
+	// Write to a temporary file first so that a crash never leaves a truncated cursor behind
+	tmpPath := a.cursorFile + ".tmp"
+	if err == nil {
+		err = ioutil.WriteFile(tmpPath, data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, a.cursorFile)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		a.log.Errorf("could not save the audit events cursor: %v", err)
+	}
+}
+
+// compilePatterns compiles the type patterns, types lists them when they are all literal types
+func compilePatterns(patterns []string) ([]*regexp.Regexp, []string, error) {
+	var compiled []*regexp.Regexp
+	types := []string{}
+	for _, pattern := range patterns {
+		re, err := filter.CompilePattern(pattern)
+		if err != nil {
+			return nil, nil, err
+		}
+		if re == nil {
+			continue
+		}
+		compiled = append(compiled, re)
+		if types != nil && !strings.ContainsAny(pattern, "*?/") {
+			types = append(types, pattern)
+		} else {
+			types = nil
+		}
+	}
+	return compiled, types, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendTagIfNotEmpty(tags []string, key, value string) []string {
+	if value != "" {
+		tags = append(tags, fmt.Sprintf("%s:%s", key, value))
+	}
+	return tags
+}
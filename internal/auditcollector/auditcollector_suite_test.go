@@ -0,0 +1,13 @@
+package auditcollector
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestAuditCollector(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "AuditCollector Suite")
+}
@@ -0,0 +1,194 @@
+package auditcollector
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/DataDog/datadog-firehose-nozzle/test/helper"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/gosteno"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/events"
+)
+
+var _ = Describe("AuditCollector", func() {
+	var (
+		log                    *gosteno.Logger
+		fakeCloudControllerAPI *FakeCloudControllerAPI
+		cfg                    config.Config
+		pe                     chan events.Event
+		dir                    string
+	)
+
+	BeforeEach(func() {
+		log = gosteno.NewLogger("audit collector test")
+		fakeCloudControllerAPI = NewFakeCloudControllerAPI("bearer", "123456789")
+		fakeCloudControllerAPI.Start()
+
+		var err error
+		dir, err = ioutil.TempDir("", "auditcollector")
+		Expect(err).To(BeNil())
+		cfg = config.Config{
+			CloudControllerEndpoint:    fakeCloudControllerAPI.URL(),
+			Client:                     "bearer",
+			ClientSecret:               "123456789",
+			InsecureSSLSkipVerify:      true,
+			AuditEventsIntervalSeconds: 60,
+			AuditEventsCursorFile:      filepath.Join(dir, "cursor.json"),
+		}
+		pe = make(chan events.Event, 10)
+	})
+
+	AfterEach(func() {
+		fakeCloudControllerAPI.Close()
+		os.RemoveAll(dir)
+	})
+
+	newCollector := func(since string) *AuditCollector {
+		a, err := NewAuditCollector(&cfg, pe, log, []string{"foo:bar"})
+		Expect(err).To(BeNil())
+		if since != "" {
+			a.cursor = cursor{Since: since}
+		}
+		return a
+	}
+
+	received := func() []events.Event {
+		var result []events.Event
+		for len(pe) > 0 {
+			result = append(result, <-pe)
+		}
+		return result
+	}
+
+	It("converts the audit events of the default types into events", func() {
+		a := newCollector("2019-10-04T11:00:00Z")
+		a.pushEvents()
+
+		pushed := received()
+		Expect(pushed).To(HaveLen(3))
+		Expect(pushed[0].Title).To(Equal("app p-invitations-green: audit.app.process.scale"))
+		Expect(pushed[1].Title).To(Equal("app hello-datadog-cf-ruby-dev: audit.app.delete-request"))
+
+		crash := pushed[2]
+		Expect(crash.Title).To(Equal("app p-invitations-green: audit.app.process.crash"))
+		Expect(crash.Text).To(HavePrefix("process web triggered audit.app.process.crash on app p-invitations-green\n"))
+		Expect(crash.Text).To(ContainSubstring(`"reason":"CRASHED"`))
+		Expect(crash.AlertType).To(Equal("error"))
+		Expect(crash.SourceTypeName).To(Equal("cloudfoundry"))
+		Expect(crash.AggregationKey).To(Equal("6d254438-cc3b-44a6-b2e6-343ca92deb5f"))
+		Expect(crash.DateHappened).To(BeEquivalentTo(1570187610))
+		Expect(crash.Tags).To(Equal([]string{
+			"actor_id:6d254438-cc3b-44a6-b2e6-343ca92deb5f",
+			"actor_name:web",
+			"actor_type:process",
+			"app_name:p-invitations-green",
+			"event_type:audit.app.process.crash",
+			"foo:bar",
+			"guid:6d254438-cc3b-44a6-b2e6-343ca92deb5f",
+			"org_id:671557cf-edcd-49df-9863-ee14513d13c7",
+			"org_name:system",
+			"space_id:417b893e-291e-48ec-94c7-7b2348604365",
+			"space_name:system",
+			"target_id:6d254438-cc3b-44a6-b2e6-343ca92deb5f",
+			"target_name:p-invitations-green",
+			"target_type:app",
+		}))
+
+		Expect(fakeCloudControllerAPI.GetUsedQueries()).To(ContainElement(And(
+			HavePrefix("/v3/audit_events?"),
+			ContainSubstring("types=audit.app.create%2C"),
+			ContainSubstring("created_ats%5Bgte%5D=2019-10-04T11%3A00%3A00Z"),
+		)))
+	})
+
+	It("filters the event types with the include and exclude patterns", func() {
+		cfg.AuditEventsInclude = []string{"audit.app.*", "audit.space.create"}
+		cfg.AuditEventsExclude = []string{"audit.app.process.*"}
+		a := newCollector("2019-10-04T11:00:00Z")
+		a.pushEvents()
+
+		pushed := received()
+		Expect(pushed).To(HaveLen(3))
+		Expect(pushed[0].Title).To(Equal("app p-invitations-green: audit.app.update"))
+		Expect(pushed[0].AlertType).To(Equal("info"))
+		Expect(pushed[1].Title).To(Equal("app hello-datadog-cf-ruby-dev: audit.app.delete-request"))
+		Expect(pushed[2].Title).To(Equal("space staging: audit.space.create"))
+		Expect(pushed[2].Tags).NotTo(ContainElement(HavePrefix("app_name:")))
+
+		// The patterns are not all literal types, they are filtered by the nozzle only
+		Expect(fakeCloudControllerAPI.GetUsedQueries()).To(ContainElement(HavePrefix("/v3/audit_events?")))
+		Expect(fakeCloudControllerAPI.GetUsedQueries()).NotTo(ContainElement(ContainSubstring("types=")))
+	})
+
+	It("rejects invalid patterns", func() {
+		cfg.AuditEventsExclude = []string{"/audit.app.(/"}
+		_, err := NewAuditCollector(&cfg, pe, log, nil)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("resumes from the saved cursor", func() {
+		a := newCollector("2019-10-04T11:00:00Z")
+		a.pushEvents()
+		Expect(received()).To(HaveLen(3))
+		Expect(a.cursor).To(Equal(cursor{Since: "2019-10-04T11:14:00Z", Seen: []string{"e0b3c5a1-8f3f-4c8e-9d56-5f1e0a1a7d11"}}))
+
+		restarted := newCollector("")
+		Expect(restarted.cursor).To(Equal(a.cursor))
+	})
+
+	It("moves the cursor past each page of events", func() {
+		cfg.CloudControllerAPIBatchSize = 2
+		a := newCollector("2019-10-04T11:00:00Z")
+		a.pushEvents()
+
+		Expect(received()).To(HaveLen(3))
+		Expect(fakeCloudControllerAPI.GetUsedQueries()).To(ContainElement(And(
+			HavePrefix("/v3/audit_events?"),
+			ContainSubstring("page=3"),
+		)))
+		Expect(a.cursor).To(Equal(cursor{Since: "2019-10-04T11:14:00Z", Seen: []string{"e0b3c5a1-8f3f-4c8e-9d56-5f1e0a1a7d11"}}))
+	})
+
+	It("stops while the events are sent", func() {
+		cfg.CloudControllerAPIBatchSize = 2
+		pe = make(chan events.Event, 1)
+		a := newCollector("2019-10-04T11:00:00Z")
+		a.Start()
+		// The scale event of the first page fills the channel, the second page waits for it
+		Eventually(func() int { return len(pe) }).Should(Equal(1))
+
+		stopped := make(chan bool)
+		go func() {
+			a.Stop()
+			close(stopped)
+		}()
+		Eventually(stopped).Should(BeClosed())
+
+		// Only the cursor of the first page was saved, the second page is sent again after a restart
+		restarted := newCollector("")
+		Expect(restarted.cursor).To(Equal(cursor{Since: "2019-10-04T11:12:30Z", Seen: []string{"0c8a6ae4-b0a6-4c8d-a5a5-3d4b5e43e2ea"}}))
+	})
+
+	It("skips the events already sent", func() {
+		a := newCollector("")
+		a.cursor = cursor{Since: "2019-10-04T11:13:00Z", Seen: []string{"57d7b8b9-4cbb-47e1-a2a7-8c5b8b5e1b30"}}
+		a.pushEvents()
+
+		pushed := received()
+		Expect(pushed).To(HaveLen(1))
+		Expect(pushed[0].Title).To(Equal("app p-invitations-green: audit.app.process.crash"))
+	})
+
+	It("starts from now without a saved cursor", func() {
+		a := newCollector("")
+		since, err := time.Parse(time.RFC3339, a.cursor.Since)
+		Expect(err).To(BeNil())
+		Expect(since).To(BeTemporally("~", time.Now(), 2*time.Second))
+	})
+})
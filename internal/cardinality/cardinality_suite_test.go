@@ -0,0 +1,13 @@
+package cardinality
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCardinality(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cardinality Suite")
+}
@@ -0,0 +1,225 @@
+package cardinality
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/filter"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+
+	"github.com/cloudfoundry/gosteno"
+)
+
+// Actions applied to the new series of a metric over its limit
+const (
+	ActionReject   = "reject"
+	ActionDropTags = "drop_tags"
+)
+
+type rule struct {
+	name   *regexp.Regexp
+	limit  int
+	action string
+	tags   map[string]bool
+}
+
+// tracked holds the series of a metric seen in the current window
+type tracked struct {
+	rule    *rule
+	hashes  map[util.TagsHash]struct{}
+	limited bool
+}
+
+// Limiter caps the number of distinct series (TagsHash) of each metric name within a window.
+// The metrics are tracked in shards keyed by name, each with its own lock, so that the readers rarely wait on each other.
+type Limiter struct {
+	defaultRule *rule
+	rules       []*rule
+	window      time.Duration
+	log         *gosteno.Logger
+	shards      []*limiterShard
+	now         func() time.Time
+}
+
+type limiterShard struct {
+	lock        sync.Mutex
+	ruleCache   map[string]*rule // nil when the metric is not limited, cleared with the window
+	metrics     map[string]*tracked
+	windowStart time.Time
+	limited     map[string]uint64 // series limited since the last call to Limited
+}
+
+// New creates a limiter with numShards shards, at least one. It returns nil when neither limit nor rules are set.
+func New(limit uint32, windowSeconds uint32, rules []config.CardinalityRule, numShards int, log *gosteno.Logger) (*Limiter, error) {
+	if limit == 0 && len(rules) == 0 {
+		return nil, nil
+	}
+
+	if numShards < 1 {
+		numShards = 1
+	}
+	l := &Limiter{
+		window: time.Duration(windowSeconds) * time.Second,
+		log:    log,
+		shards: make([]*limiterShard, numShards),
+		now:    time.Now,
+	}
+	if limit > 0 {
+		l.defaultRule = &rule{limit: int(limit), action: ActionReject}
+	}
+	for i, cfgRule := range rules {
+		r := &rule{limit: int(cfgRule.Limit), action: cfgRule.Action, tags: map[string]bool{}}
+		var err error
+		if r.name, err = filter.CompilePattern(cfgRule.Name); err != nil {
+			return nil, fmt.Errorf("cardinality rule %d has an invalid Name: %v", i, err)
+		}
+		if r.name == nil {
+			return nil, fmt.Errorf("cardinality rule %d has no Name", i)
+		}
+		switch r.action {
+		case "":
+			r.action = ActionReject
+		case ActionReject:
+		case ActionDropTags:
+			if len(cfgRule.Tags) == 0 {
+				return nil, fmt.Errorf("cardinality rule %d drops tags without Tags", i)
+			}
+		default:
+			return nil, fmt.Errorf("cardinality rule %d has an unknown Action %q", i, r.action)
+		}
+		for _, tag := range cfgRule.Tags {
+			r.tags[tag] = true
+		}
+		l.rules = append(l.rules, r)
+	}
+	for i := range l.shards {
+		l.shards[i] = &limiterShard{
+			ruleCache:   map[string]*rule{},
+			metrics:     map[string]*tracked{},
+			windowStart: l.now(),
+			limited:     map[string]uint64{},
+		}
+	}
+	return l, nil
+}
+
+// Admit returns the key and value the series is aggregated under, ok is false when the series is rejected
+func (l *Limiter) Admit(key metric.MetricKey, value metric.MetricValue) (metric.MetricKey, metric.MetricValue, bool) {
+	if l == nil {
+		return key, value, true
+	}
+
+	sh := l.shards[l.index(key.Name)]
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	if now := l.now(); now.Sub(sh.windowStart) >= l.window {
+		// The names of the metrics that stopped reporting are forgotten with their series
+		sh.metrics = map[string]*tracked{}
+		sh.ruleCache = map[string]*rule{}
+		sh.windowStart = now
+	}
+
+	m := l.track(sh, key.Name)
+	if m == nil {
+		return key, value, true
+	}
+	if _, ok := m.hashes[key.TagsHash]; ok {
+		return key, value, true
+	}
+	if len(m.hashes) < m.rule.limit {
+		m.hashes[key.TagsHash] = struct{}{}
+		return key, value, true
+	}
+
+	if !m.limited {
+		m.limited = true
+		l.log.Warnf("metric %s has more than %d series, applying cardinality action %s to its new series until the end of the window",
+			key.Name, m.rule.limit, m.rule.action)
+	}
+	sh.limited[key.Name]++
+
+	if m.rule.action == ActionDropTags {
+		// The series left once the tags are dropped are always kept
+		tags := make([]string, 0, len(value.Tags))
+		for _, tag := range value.Tags {
+			if !m.rule.tags[tagName(tag)] {
+				tags = append(tags, tag)
+			}
+		}
+		value.Tags = tags
+		key.TagsHash = util.HashTags(tags)
+		return key, value, true
+	}
+	return key, value, false
+}
+
+// Limited returns how many series of each metric were limited since the last call
+func (l *Limiter) Limited() map[string]uint64 {
+	if l == nil {
+		return nil
+	}
+
+	limited := map[string]uint64{}
+	for _, sh := range l.shards {
+		sh.lock.Lock()
+		// A metric name always belongs to the same shard
+		for name, count := range sh.limited {
+			limited[name] = count
+		}
+		sh.limited = map[string]uint64{}
+		sh.lock.Unlock()
+	}
+	return limited
+}
+
+// track returns the series of the metric in the current window of the shard, or nil when the metric is not limited
+func (l *Limiter) track(sh *limiterShard, name string) *tracked {
+	if m, ok := sh.metrics[name]; ok {
+		return m
+	}
+
+	r, ok := sh.ruleCache[name]
+	if !ok {
+		r = l.defaultRule
+		for _, cfgRule := range l.rules {
+			if cfgRule.name.MatchString(name) {
+				r = cfgRule
+				break
+			}
+		}
+		if r != nil && r.limit == 0 {
+			r = nil
+		}
+		sh.ruleCache[name] = r
+	}
+	if r == nil {
+		return nil
+	}
+
+	m := &tracked{rule: r, hashes: map[util.TagsHash]struct{}{}}
+	sh.metrics[name] = m
+	return m
+}
+
+// index returns the shard of the metric with a FNV-1a hash of its name
+func (l *Limiter) index(name string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(l.shards)))
+}
+
+func tagName(tag string) string {
+	if i := strings.Index(tag, ":"); i >= 0 {
+		return tag[:i]
+	}
+	return tag
+}
@@ -0,0 +1,135 @@
+package cardinality
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+
+	"github.com/cloudfoundry/gosteno"
+)
+
+func series(name string, tags ...string) (metric.MetricKey, metric.MetricValue) {
+	value := metric.MetricValue{Tags: tags}
+	return metric.MetricKey{Name: name, TagsHash: util.HashTags(tags)}, value
+}
+
+var _ = Describe("Limiter", func() {
+	var log *gosteno.Logger
+
+	BeforeEach(func() {
+		log = gosteno.NewLogger("test")
+	})
+
+	It("is disabled without limit nor rules", func() {
+		l, err := New(0, 3600, nil, 1, log)
+		Expect(err).To(BeNil())
+		Expect(l).To(BeNil())
+		_, _, ok := l.Admit(series("foo", "id:1"))
+		Expect(ok).To(BeTrue())
+		Expect(l.Limited()).To(BeEmpty())
+	})
+
+	It("rejects the new series of a metric over its limit", func() {
+		l, err := New(2, 3600, nil, 1, log)
+		Expect(err).To(BeNil())
+
+		for i := 0; i < 4; i++ {
+			_, _, ok := l.Admit(series("foo", fmt.Sprintf("id:%d", i)))
+			Expect(ok).To(Equal(i < 2))
+		}
+		// Known series and other metrics are still accepted
+		_, _, ok := l.Admit(series("foo", "id:0"))
+		Expect(ok).To(BeTrue())
+		_, _, ok = l.Admit(series("bar", "id:3"))
+		Expect(ok).To(BeTrue())
+
+		Expect(l.Limited()).To(Equal(map[string]uint64{"foo": 2}))
+		Expect(l.Limited()).To(BeEmpty())
+	})
+
+	It("limits the metrics of all the shards from concurrent readers", func() {
+		l, err := New(10, 3600, nil, 4, log)
+		Expect(err).To(BeNil())
+
+		var wg sync.WaitGroup
+		admitted := make([]int64, 20)
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 400; i++ {
+					if _, _, ok := l.Admit(series(fmt.Sprintf("metric.%d", i%20), fmt.Sprintf("id:%d:%d", w, i))); ok {
+						atomic.AddInt64(&admitted[i%20], 1)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		limited := l.Limited()
+		Expect(limited).To(HaveLen(20))
+		for i, count := range admitted {
+			Expect(count).To(BeEquivalentTo(10))
+			Expect(limited[fmt.Sprintf("metric.%d", i)]).To(BeEquivalentTo(150))
+		}
+	})
+
+	It("forgets the series at the end of the window", func() {
+		l, err := New(1, 60, nil, 1, log)
+		Expect(err).To(BeNil())
+		now := time.Now()
+		l.now = func() time.Time { return now }
+
+		_, _, ok := l.Admit(series("foo", "id:1"))
+		Expect(ok).To(BeTrue())
+		_, _, ok = l.Admit(series("foo", "id:2"))
+		Expect(ok).To(BeFalse())
+		l.Admit(series("bar", "id:1"))
+
+		now = now.Add(time.Minute)
+		_, _, ok = l.Admit(series("foo", "id:2"))
+		Expect(ok).To(BeTrue())
+		// The rules of the metrics not seen in the window are forgotten too
+		Expect(l.shards[0].ruleCache).To(HaveLen(1))
+	})
+
+	It("applies the first matching rule", func() {
+		l, err := New(1, 3600, []config.CardinalityRule{
+			{Name: "gorouter.*", Limit: 1, Action: ActionDropTags, Tags: []string{"request_id"}},
+			{Name: "/^uptime$/", Limit: 0},
+		}, 1, log)
+		Expect(err).To(BeNil())
+
+		_, _, ok := l.Admit(series("gorouter.latency", "request_id:1", "job:router"))
+		Expect(ok).To(BeTrue())
+		key, value, ok := l.Admit(series("gorouter.latency", "request_id:2", "job:router"))
+		Expect(ok).To(BeTrue())
+		Expect(value.Tags).To(Equal([]string{"job:router"}))
+		expectedKey, _ := series("gorouter.latency", "job:router")
+		Expect(key).To(Equal(expectedKey))
+
+		// A limit of 0 exempts the metric from CardinalityLimit
+		for i := 0; i < 3; i++ {
+			_, _, ok = l.Admit(series("uptime", fmt.Sprintf("id:%d", i)))
+			Expect(ok).To(BeTrue())
+		}
+		Expect(l.Limited()).To(Equal(map[string]uint64{"gorouter.latency": 1}))
+	})
+
+	It("rejects invalid rules", func() {
+		_, err := New(0, 3600, []config.CardinalityRule{{Limit: 1}}, 1, log)
+		Expect(err).To(HaveOccurred())
+		_, err = New(0, 3600, []config.CardinalityRule{{Name: "foo", Action: "unknown"}}, 1, log)
+		Expect(err).To(HaveOccurred())
+		_, err = New(0, 3600, []config.CardinalityRule{{Name: "foo", Action: ActionDropTags}}, 1, log)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,83 @@
+package cloudfoundry
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/pkg/errors"
+)
+
+// AuditEvent represents a Cloud Controller v3 audit event
+type AuditEvent struct {
+	GUID         string                 `json:"guid"`
+	CreatedAt    string                 `json:"created_at"`
+	Type         string                 `json:"type"`
+	Actor        AuditEventResource     `json:"actor"`
+	Target       AuditEventResource     `json:"target"`
+	Data         map[string]interface{} `json:"data"`
+	Space        AuditEventRelation     `json:"space"`
+	Organization AuditEventRelation     `json:"organization"`
+}
+
+// AuditEventResource is the actor or the target of an audit event
+type AuditEventResource struct {
+	GUID string `json:"guid"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// AuditEventRelation is the space or the org of an audit event
+type AuditEventRelation struct {
+	GUID string `json:"guid"`
+}
+
+type v3AuditEventResponse struct {
+	Pagination cfclient.Pagination `json:"pagination"`
+	Resources  []AuditEvent        `json:"resources"`
+}
+
+// GetAuditEvents returns the audit events of the given types created at or after since, the oldest first.
+// All types are returned when types is empty, all events when since is empty.
+func (cfc *CFClient) GetAuditEvents(types []string, since string) ([]AuditEvent, error) {
+	var events []AuditEvent
+	err := cfc.ForEachAuditEventsPage(types, since, func(page []AuditEvent) error {
+		events = append(events, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ForEachAuditEventsPage calls f with each page of the audit events of GetAuditEvents, the oldest first,
+// the next page is only requested once f returns. It stops at the first error, and returns the errors of f as is.
+func (cfc *CFClient) ForEachAuditEventsPage(types []string, since string, f func(events []AuditEvent) error) error {
+	filter := url.Values{"order_by": {"created_at"}}
+	if len(types) > 0 {
+		filter.Set("types", strings.Join(types, ","))
+	}
+	if since != "" {
+		filter.Set("created_ats[gte]", since)
+	}
+
+	for page := 1; ; page++ {
+		resBody, err := cfc.getV3Page("/v3/audit_events", filter, page)
+		if err != nil {
+			return errors.Wrapf(err, "Error requesting v3 audit events page %d", page)
+		}
+		var eventsResp v3AuditEventResponse
+		err = json.Unmarshal(resBody, &eventsResp)
+		if err != nil {
+			return errors.Wrapf(err, "Error unmarshalling v3 audit events response for page %d", page)
+		}
+		if err = f(eventsResp.Resources); err != nil {
+			return err
+		}
+		if eventsResp.Pagination.TotalPages <= page {
+			return nil
+		}
+	}
+}
@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
@@ -20,8 +20,13 @@ type CFClient struct {
 	ApiVersion   int
 	NumWorkers   int
 	client       *cfclient.Client
+	clientConfig cfclient.Config
+	clientLock   sync.RWMutex
 	logger       *gosteno.Logger
 	apiBatchSize string
+	syncLock     sync.Mutex
+	updatedSince map[string]syncCursor     // most recent updated_at of the resources of each v3 endpoint
+	etags        map[string]cachedResponse // last response of each page of the changes, by path and page
 }
 
 // CFApplication represents a Cloud Controller Application.
@@ -38,6 +43,7 @@ type CFApplication struct {
 	TotalDiskQuota int
 	Memory         int
 	TotalMemory    int
+	updatedAt      string // of the v3 app resource
 }
 
 type Data struct {
@@ -121,6 +127,8 @@ func NewClient(config *config.Config, logger *gosteno.Logger) (*CFClient, error)
 		SkipSslValidation: config.InsecureSSLSkipVerify,
 		UserAgent:         "datadog-firehose-nozzle",
 	}
+	// NewClient modifies the config it is given, keep a copy to re-authenticate later
+	clientConfig := cfg
 	cfClient, err := cfclient.NewClient(&cfg)
 	if err != nil {
 		logger.Warnf("encountered an error while setting up the cf client: %v", err)
@@ -131,6 +139,7 @@ func NewClient(config *config.Config, logger *gosteno.Logger) (*CFClient, error)
 		ApiVersion:   0,
 		NumWorkers:   config.NumWorkers,
 		client:       cfClient,
+		clientConfig: clientConfig,
 		logger:       logger,
 		apiBatchSize: fmt.Sprint(config.CloudControllerAPIBatchSize),
 	}
@@ -138,7 +147,69 @@ func NewClient(config *config.Config, logger *gosteno.Logger) (*CFClient, error)
 }
 
 func (cfc *CFClient) GetDopplerEndpoint() string {
-	return cfc.client.Endpoint.DopplerEndpoint
+	return cfc.getClient().Endpoint.DopplerEndpoint
+}
+
+func (cfc *CFClient) getClient() *cfclient.Client {
+	cfc.clientLock.RLock()
+	defer cfc.clientLock.RUnlock()
+	return cfc.client
+}
+
+// reauthenticate replaces the underlying client with a new one holding a fresh token
+func (cfc *CFClient) reauthenticate() error {
+	cfg := cfc.clientConfig
+	cfClient, err := cfclient.NewClient(&cfg)
+	if err != nil {
+		return fmt.Errorf("encountered an error while re-authenticating the cf client: %v", err)
+	}
+
+	cfc.clientLock.Lock()
+	cfc.client = cfClient
+	cfc.clientLock.Unlock()
+	return nil
+}
+
+// withReauth calls f, and calls it once more with a re-authenticated client if the cloud controller rejected the token
+func (cfc *CFClient) withReauth(f func(client *cfclient.Client) error) error {
+	err := f(cfc.getClient())
+	if err == nil || !isUnauthorized(err) {
+		return err
+	}
+
+	cfc.logger.Info("The cloud controller rejected the auth token, re-authenticating")
+	if reauthErr := cfc.reauthenticate(); reauthErr != nil {
+		cfc.logger.Error(reauthErr.Error())
+		return err
+	}
+	return f(cfc.getClient())
+}
+
+func (cfc *CFClient) doRequest(method string, path string) (*http.Response, error) {
+	var resp *http.Response
+	err := cfc.withReauth(func(client *cfclient.Client) error {
+		var err error
+		resp, err = client.DoRequest(client.NewRequest(method, path))
+		return err
+	})
+	return resp, err
+}
+
+func isUnauthorized(err error) bool {
+	cause := errors.Cause(err)
+	if httpErr, ok := cause.(cfclient.CloudFoundryHTTPError); ok {
+		return httpErr.StatusCode == http.StatusUnauthorized
+	}
+	return cfclient.IsNotAuthenticatedError(cause)
+}
+
+// IsNotFound tells whether the cloud controller answered that the requested resource does not exist
+func IsNotFound(err error) bool {
+	cause := errors.Cause(err)
+	if httpErr, ok := cause.(cfclient.CloudFoundryHTTPError); ok {
+		return httpErr.StatusCode == http.StatusNotFound
+	}
+	return cfclient.IsAppNotFoundError(cause) || cfclient.IsResourceNotFoundError(cause)
 }
 
 func (cfc *CFClient) GetApplications() ([]CFApplication, error) {
@@ -166,7 +237,12 @@ func (cfc *CFClient) GetApplications() ([]CFApplication, error) {
 }
 
 func (cfc *CFClient) GetApplication(guid string) (*CFApplication, error) {
-	app, err := cfc.client.GetAppByGuid(guid)
+	var app cfclient.App
+	err := cfc.withReauth(func(client *cfclient.Client) error {
+		var err error
+		app, err = client.GetAppByGuid(guid)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -184,7 +260,7 @@ func (cfc *CFClient) getV3Applications() ([]CFApplication, error) {
 	go func() {
 		defer wg.Done()
 		var err error
-		cfapps, err = cfc.getV3Apps()
+		cfapps, err = cfc.getV3Apps(nil)
 		if err != nil {
 			errors <- err
 		}
@@ -196,7 +272,7 @@ func (cfc *CFClient) getV3Applications() ([]CFApplication, error) {
 	go func() {
 		defer wg.Done()
 		var err error
-		processes, err = cfc.getV3Processes()
+		processes, err = cfc.getV3Processes(nil)
 		if err != nil {
 			errors <- err
 		}
@@ -208,7 +284,7 @@ func (cfc *CFClient) getV3Applications() ([]CFApplication, error) {
 	go func() {
 		defer wg.Done()
 		var err error
-		spaces, err = cfc.getV3Spaces()
+		spaces, err = cfc.getV3Spaces(nil)
 		if err != nil {
 			errors <- err
 		}
@@ -220,7 +296,7 @@ func (cfc *CFClient) getV3Applications() ([]CFApplication, error) {
 	go func() {
 		defer wg.Done()
 		var err error
-		orgs, err = cfc.getV3Orgs()
+		orgs, err = cfc.getV3Orgs(nil)
 		if err != nil {
 			errors <- err
 		}
@@ -238,11 +314,18 @@ func (cfc *CFClient) getV3Applications() ([]CFApplication, error) {
 		return nil, err
 	}
 
+	// The next incremental syncs request the changes from the most recent resources
+	cfc.setUpdatedSince(latestUpdates(cfapps, processes, spaces, orgs))
+
+	return cfc.joinV3Resources(cfapps, processes, spaces, orgs), nil
+}
+
+// joinV3Resources completes the apps with the data of their processes, space and org
+func (cfc *CFClient) joinV3Resources(cfapps []CFApplication, processes []cfclient.Process, spaces []v3SpaceResource, orgs []cfclient.Org) []CFApplication {
 	// Group all processes per app
 	processesPerApp := map[string][]cfclient.Process{}
 	for _, process := range processes {
-		parts := strings.Split(process.Links.App.Href, "/")
-		appGUID := parts[len(parts)-1]
+		appGUID := processAppGUID(process)
 		appProcesses, exists := processesPerApp[appGUID]
 		if exists {
 			appProcesses = append(appProcesses, process)
@@ -292,26 +375,37 @@ func (cfc *CFClient) getV3Applications() ([]CFApplication, error) {
 		results = append(results, updatedApp)
 	}
 
-	return results, nil
+	return results
 }
 
-func (cfc *CFClient) getV3Apps() ([]CFApplication, error) {
+// getV3Page returns the body of a page of a v3 list endpoint, filter adds parameters to the query
+func (cfc *CFClient) getV3Page(path string, filter url.Values, page int) ([]byte, error) {
+	q := url.Values{}
+	for k, v := range filter {
+		q[k] = v
+	}
+	q.Set("per_page", cfc.apiBatchSize)
+	q.Set("page", strconv.Itoa(page))
+	// The changes are requested again until there are new ones, they are only downloaded when they differ
+	if _, ok := filter[updatedSinceFilter]; ok {
+		return cfc.getConditionally(path, q, page)
+	}
+
+	resp, err := cfc.doRequest("GET", path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (cfc *CFClient) getV3Apps(filter url.Values) ([]CFApplication, error) {
 	var cfapps []CFApplication
 
 	for page := 1; ; page++ {
-		q := url.Values{}
-		q.Set("per_page", cfc.apiBatchSize)
-		q.Set("page", strconv.Itoa(page))
-		r := cfc.client.NewRequest("GET", "/v3/apps?"+q.Encode())
-		resp, err := cfc.client.DoRequest(r)
+		resBody, err := cfc.getV3Page("/v3/apps", filter, page)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Error requesting apps page %d", err)
-		}
-		// Read body response
-		defer resp.Body.Close()
-		resBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Error reading app response for page %d", page)
+			return nil, errors.Wrapf(err, "Error requesting apps page %d", page)
 		}
 		// Unmarshal body response into v3AppResponse objects
 		var appResp v3AppResponse
@@ -334,24 +428,14 @@ func (cfc *CFClient) getV3Apps() ([]CFApplication, error) {
 	return cfapps, nil
 }
 
-func (cfc *CFClient) getV3Processes() ([]cfclient.Process, error) {
+func (cfc *CFClient) getV3Processes(filter url.Values) ([]cfclient.Process, error) {
 	// Query the first page to get the total number of pages.
 	var cfprocesses []cfclient.Process
 	for page := 1; ; page++ {
-		q := url.Values{}
-		q.Set("per_page", cfc.apiBatchSize)
-		q.Set("page", strconv.Itoa(page))
-		r := cfc.client.NewRequest("GET", "/v3/processes?"+q.Encode())
-		resp, err := cfc.client.DoRequest(r)
+		resBody, err := cfc.getV3Page("/v3/processes", filter, page)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Error requesting v3 processes page %d", page)
 		}
-		// Read body response
-		defer resp.Body.Close()
-		resBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Error reading v3 processes response for page %d", page)
-		}
 		// Unmarshal body response into ProcessListResponse objects
 		var processResp cfclient.ProcessListResponse
 		err = json.Unmarshal(resBody, &processResp)
@@ -367,24 +451,14 @@ func (cfc *CFClient) getV3Processes() ([]cfclient.Process, error) {
 	return cfprocesses, nil
 }
 
-func (cfc *CFClient) getV3Spaces() ([]v3SpaceResource, error) {
+func (cfc *CFClient) getV3Spaces(filter url.Values) ([]v3SpaceResource, error) {
 	var spaces []v3SpaceResource
 
 	for page := 1; ; page++ {
-		q := url.Values{}
-		q.Set("per_page", cfc.apiBatchSize)
-		q.Set("page", strconv.Itoa(page))
-		r := cfc.client.NewRequest("GET", "/v3/spaces?"+q.Encode())
-		resp, err := cfc.client.DoRequest(r)
+		resBody, err := cfc.getV3Page("/v3/spaces", filter, page)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Error requesting v3 spaces page %d", page)
 		}
-		// Read body response
-		defer resp.Body.Close()
-		resBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Error reading v3 spaces response for page %d", page)
-		}
 		// Unmarshal body response into v3SpaceResponse object
 		var spaceResp v3SpaceResponse
 		err = json.Unmarshal(resBody, &spaceResp)
@@ -400,24 +474,14 @@ func (cfc *CFClient) getV3Spaces() ([]v3SpaceResource, error) {
 	return spaces, nil
 }
 
-func (cfc *CFClient) getV3Orgs() ([]cfclient.Org, error) {
+func (cfc *CFClient) getV3Orgs(filter url.Values) ([]cfclient.Org, error) {
 	var cforgs []cfclient.Org
 
 	for page := 1; ; page++ {
-		q := url.Values{}
-		q.Set("per_page", cfc.apiBatchSize)
-		q.Set("page", strconv.Itoa(page))
-		r := cfc.client.NewRequest("GET", "/v3/organizations?"+q.Encode())
-		resp, err := cfc.client.DoRequest(r)
+		resBody, err := cfc.getV3Page("/v3/organizations", filter, page)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Error requesting v3 orgs page %d", page)
 		}
-		// Read body response
-		defer resp.Body.Close()
-		resBody, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Error reading v3 orgs response for page %d", page)
-		}
 		// Unmarshal body response into  objects
 		var orgsResp v3OrgResponse
 		err = json.Unmarshal(resBody, &orgsResp)
@@ -483,8 +547,7 @@ func (cfc *CFClient) getV2ApplicationsByPage(page int) ([]CFApplication, int, er
 	if page > 0 {
 		q.Set("page", strconv.Itoa(page))
 	}
-	r := cfc.client.NewRequest("GET", "/v2/apps?"+q.Encode())
-	resp, err := cfc.client.DoRequest(r)
+	resp, err := cfc.doRequest("GET", "/v2/apps?"+q.Encode())
 	if err != nil {
 		return nil, -1, errors.Wrapf(err, "Error requesting v2 apps page %d", page)
 	}
@@ -519,7 +582,12 @@ func (cfc *CFClient) GetV2Orgs() ([]cfclient.Org, error) {
 	query := url.Values{}
 	query.Set("results-per-page", "100")
 
-	allOrgs, err := cfc.client.ListOrgsByQuery(query)
+	var allOrgs []cfclient.Org
+	err := cfc.withReauth(func(client *cfclient.Client) error {
+		var err error
+		allOrgs, err = client.ListOrgsByQuery(query)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -531,7 +599,12 @@ func (cfc *CFClient) GetV2OrgQuotas() ([]cfclient.OrgQuota, error) {
 	query := url.Values{}
 	query.Set("results-per-page", "100")
 
-	allQuotas, err := cfc.client.ListOrgQuotasByQuery(query)
+	var allQuotas []cfclient.OrgQuota
+	err := cfc.withReauth(func(client *cfclient.Client) error {
+		var err error
+		allQuotas, err = client.ListOrgQuotasByQuery(query)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -568,6 +641,7 @@ func (a *CFApplication) setV3AppData(data v3AppResource) {
 	a.Name = data.Name
 	a.SpaceGUID = data.Relationships.Space.Data.GUID
 	a.Buildpacks = data.LifeCycle.Data.BuildPacks
+	a.updatedAt = data.UpdatedAt
 }
 
 func (a *CFApplication) setV3ProcessData(data []cfclient.Process) {
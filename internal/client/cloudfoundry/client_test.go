@@ -1,6 +1,8 @@
 package cloudfoundry
 
 import (
+	"net/url"
+
 	. "github.com/DataDog/datadog-firehose-nozzle/test/helper"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -97,7 +99,7 @@ var _ = Describe("CloudFoundryClient", func() {
 		})
 
 		It("with v3 spaces is retrieved correctly", func() {
-			res, err := fakeCfClient.getV3Spaces()
+			res, err := fakeCfClient.getV3Spaces(nil)
 			Expect(err).To(BeNil())
 			Expect(res).NotTo(BeNil())
 			Expect(len(res)).To(Equal(6))
@@ -105,7 +107,7 @@ var _ = Describe("CloudFoundryClient", func() {
 		})
 
 		It("with v3 processes is retrieved correctly", func() {
-			res, err := fakeCfClient.getV3Processes()
+			res, err := fakeCfClient.getV3Processes(nil)
 			Expect(err).To(BeNil())
 			Expect(res).NotTo(BeNil())
 			Expect(len(res)).To(Equal(19))
@@ -113,7 +115,7 @@ var _ = Describe("CloudFoundryClient", func() {
 		})
 
 		It("with v3 orgs is retrieved correctly", func() {
-			res, err := fakeCfClient.getV3Orgs()
+			res, err := fakeCfClient.getV3Orgs(nil)
 			Expect(err).To(BeNil())
 			Expect(res).NotTo(BeNil())
 			Expect(len(res)).To(Equal(2))
@@ -121,7 +123,7 @@ var _ = Describe("CloudFoundryClient", func() {
 		})
 
 		It("with v3 apps is retrieved correctly", func() {
-			res, err := fakeCfClient.getV3Apps()
+			res, err := fakeCfClient.getV3Apps(nil)
 			Expect(err).To(BeNil())
 			Expect(res).NotTo(BeNil())
 			Expect(len(res)).To(Equal(14))
@@ -224,6 +226,166 @@ var _ = Describe("CloudFoundryClient", func() {
 		})
 	})
 
+	Context("GetUpdatedApplications method", func() {
+		findApp := func(apps []CFApplication, guid string) *CFApplication {
+			for i := range apps {
+				if apps[i].GUID == guid {
+					return &apps[i]
+				}
+			}
+			return nil
+		}
+
+		It("needs a full v3 sync first", func() {
+			_, err := fakeCfClient.GetUpdatedApplications()
+			Expect(err).To(Equal(ErrIncrementalSyncUnavailable))
+
+			fakeCfClient.ApiVersion = 3
+			_, err = fakeCfClient.GetUpdatedApplications()
+			Expect(err).To(Equal(ErrIncrementalSyncUnavailable))
+		})
+
+		It("requests the resources updated since the last sync", func() {
+			_, err := fakeCfClient.GetApplications()
+			Expect(err).To(BeNil())
+			// The fake cloud controller doesn't filter, none of its resources were seen at an earlier time
+			for path := range fakeCfClient.updatedSince {
+				fakeCfClient.updatedSince[path] = syncCursor{updatedAt: "2019-01-01T00:00:00Z"}
+			}
+
+			res, err := fakeCfClient.GetUpdatedApplications()
+			Expect(err).To(BeNil())
+			Expect(len(res)).To(Equal(14))
+			app := findApp(res, "6d254438-cc3b-44a6-b2e6-343ca92deb5f")
+			Expect(app).NotTo(BeNil())
+			checkAppAttributes(app)
+
+			queries := fakeCloudControllerAPI.GetUsedQueries()
+			for _, path := range []string{"/v3/apps", "/v3/processes", "/v3/spaces", "/v3/organizations"} {
+				Expect(queries).To(ContainElement(And(HavePrefix(path+"?"), ContainSubstring("updated_ats%5Bgte%5D="))))
+			}
+			Expect(queries).To(ContainElement(And(HavePrefix("/v3/processes?"), ContainSubstring("app_guids="))))
+		})
+
+		It("skips the endpoints without an update time", func() {
+			_, err := fakeCfClient.GetApplications()
+			Expect(err).To(BeNil())
+			delete(fakeCfClient.updatedSince, "/v3/organizations")
+
+			_, err = fakeCfClient.GetUpdatedApplications()
+			Expect(err).To(BeNil())
+			Expect(fakeCloudControllerAPI.GetUsedQueries()).NotTo(ContainElement(And(
+				HavePrefix("/v3/organizations?"),
+				ContainSubstring("updated_ats%5Bgte%5D="),
+			)))
+		})
+
+		It("skips the resources already seen at the time of the cursor", func() {
+			_, err := fakeCfClient.GetApplications()
+			Expect(err).To(BeNil())
+			cursor := fakeCfClient.updatedSince["/v3/apps"]
+			Expect(cursor.seen).NotTo(BeEmpty())
+			fakeCfClient.updatedSince = map[string]syncCursor{"/v3/apps": cursor}
+
+			res, err := fakeCfClient.GetUpdatedApplications()
+			Expect(err).To(BeNil())
+			for _, app := range res {
+				Expect(cursor.seen).NotTo(HaveKey(app.GUID))
+			}
+			Expect(fakeCloudControllerAPI.GetUsedQueries()).To(ContainElement(
+				HaveSuffix("updated_ats%5Bgte%5D=" + url.QueryEscape(cursor.updatedAt)),
+			))
+		})
+
+		It("re-authenticates when the changes are rejected", func() {
+			_, err := fakeCfClient.GetApplications()
+			Expect(err).To(BeNil())
+			tokenRequests := fakeCloudControllerAPI.TokenRequests()
+
+			fakeCloudControllerAPI.RejectNextRequests(1)
+			_, err = fakeCfClient.GetUpdatedApplications()
+			Expect(err).To(BeNil())
+			Expect(fakeCloudControllerAPI.TokenRequests()).To(Equal(tokenRequests + 1))
+		})
+
+		It("returns an error when the changes can't be fetched", func() {
+			fakeCloudControllerAPI.ETags = true
+			_, err := fakeCfClient.GetApplications()
+			Expect(err).To(BeNil())
+
+			fakeCloudControllerAPI.RejectNextRequests(2)
+			_, err = fakeCfClient.GetUpdatedApplications()
+			Expect(err).NotTo(BeNil())
+			Expect(fakeCfClient.etags).To(BeEmpty())
+		})
+
+		It("reuses the pages that did not change", func() {
+			fakeCloudControllerAPI.ETags = true
+			_, err := fakeCfClient.GetApplications()
+			Expect(err).To(BeNil())
+
+			first, err := fakeCfClient.GetUpdatedApplications()
+			Expect(err).To(BeNil())
+			Expect(fakeCloudControllerAPI.NotModifiedPages()).To(Equal(0))
+
+			second, err := fakeCfClient.GetUpdatedApplications()
+			Expect(err).To(BeNil())
+			Expect(fakeCloudControllerAPI.NotModifiedPages()).To(BeNumerically(">", 0))
+			Expect(len(second)).To(Equal(len(first)))
+			checkAppAttributes(findApp(second, "6d254438-cc3b-44a6-b2e6-343ca92deb5f"))
+		})
+	})
+
+	Context("GetAuditEvents method", func() {
+		It("retrieves the events of the given types since a time", func() {
+			res, err := fakeCfClient.GetAuditEvents([]string{"audit.app.update", "audit.app.delete-request"}, "2019-10-04T11:00:00Z")
+			Expect(err).To(BeNil())
+			Expect(len(res)).To(Equal(5))
+			Expect(res[0].GUID).To(Equal("a595fe2f-01ff-4965-a50c-290258ab8582"))
+			Expect(res[0].Type).To(Equal("audit.app.update"))
+			Expect(res[0].CreatedAt).To(Equal("2019-10-04T11:12:00Z"))
+			Expect(res[0].Actor).To(Equal(AuditEventResource{GUID: "d144abe3-3d7b-40d4-b63f-2584798d3ee5", Type: "user", Name: "admin"}))
+			Expect(res[0].Target.GUID).To(Equal("6d254438-cc3b-44a6-b2e6-343ca92deb5f"))
+			Expect(res[0].Space.GUID).To(Equal("417b893e-291e-48ec-94c7-7b2348604365"))
+			Expect(res[0].Organization.GUID).To(Equal("671557cf-edcd-49df-9863-ee14513d13c7"))
+
+			Expect(fakeCloudControllerAPI.GetUsedQueries()).To(ContainElement(And(
+				HavePrefix("/v3/audit_events?"),
+				ContainSubstring("types=audit.app.update%2Caudit.app.delete-request"),
+				ContainSubstring("created_ats%5Bgte%5D=2019-10-04T11%3A00%3A00Z"),
+				ContainSubstring("order_by=created_at"),
+			)))
+		})
+	})
+
+	Context("GetApplicationsByGUID method", func() {
+		It("retrieves the apps with v3 endpoints", func() {
+			_, err := fakeCfClient.GetApplications()
+			Expect(err).To(BeNil())
+
+			res, err := fakeCfClient.GetApplicationsByGUID([]string{"6d254438-cc3b-44a6-b2e6-343ca92deb5f"})
+			Expect(err).To(BeNil())
+			var app *CFApplication
+			for i := range res {
+				if res[i].GUID == "6d254438-cc3b-44a6-b2e6-343ca92deb5f" {
+					app = &res[i]
+				}
+			}
+			Expect(app).NotTo(BeNil())
+			checkAppAttributes(app)
+			Expect(fakeCloudControllerAPI.GetUsedQueries()).To(ContainElement(
+				HavePrefix("/v3/apps?guids=6d254438-cc3b-44a6-b2e6-343ca92deb5f&")))
+		})
+
+		It("retrieves the apps with v2 endpoints", func() {
+			fakeCfClient.ApiVersion = 2
+			res, err := fakeCfClient.GetApplicationsByGUID([]string{"6d254438-cc3b-44a6-b2e6-343ca92deb5f"})
+			Expect(err).To(BeNil())
+			Expect(len(res)).To(Equal(1))
+			checkAppAttributes(&res[0])
+		})
+	})
+
 	Context("GetApplication method", func() {
 		It("retrieves app correctly", func() {
 			res, err := fakeCfClient.GetApplication("6d254438-cc3b-44a6-b2e6-343ca92deb5f")
@@ -232,5 +394,33 @@ var _ = Describe("CloudFoundryClient", func() {
 			checkAppAttributes(res)
 		})
 	})
+
+	Context("the cloud controller rejects the token", func() {
+		It("re-authenticates and retries the request", func() {
+			// Make sure the client already has a token
+			_, err := fakeCfClient.getV3Orgs(nil)
+			Expect(err).To(BeNil())
+			tokenRequests := fakeCloudControllerAPI.TokenRequests()
+
+			fakeCloudControllerAPI.RejectNextRequests(1)
+			res, err := fakeCfClient.getV3Orgs(nil)
+			Expect(err).To(BeNil())
+			Expect(len(res)).To(Equal(2))
+			Expect(fakeCloudControllerAPI.TokenRequests()).To(Equal(tokenRequests + 1))
+		})
+
+		It("re-authenticates for v2 endpoints", func() {
+			fakeCloudControllerAPI.RejectNextRequests(1)
+			res, err := fakeCfClient.GetApplication("6d254438-cc3b-44a6-b2e6-343ca92deb5f")
+			Expect(err).To(BeNil())
+			checkAppAttributes(res)
+		})
+
+		It("returns the error when the new token is rejected too", func() {
+			fakeCloudControllerAPI.RejectNextRequests(2)
+			_, err := fakeCfClient.getV3Orgs(nil)
+			Expect(err).NotTo(BeNil())
+		})
+	})
 })
 
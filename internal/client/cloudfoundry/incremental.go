@@ -0,0 +1,423 @@
+package cloudfoundry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/pkg/errors"
+)
+
+// updatedSinceFilter is the v3 filter on the update time of the resources
+const updatedSinceFilter = "updated_ats[gte]"
+
+// guidsPerQuery is how many guids are sent in a single filter, to keep the urls short
+const guidsPerQuery = 100
+
+// ErrIncrementalSyncUnavailable is returned by GetUpdatedApplications until a full v3 sync has completed
+var ErrIncrementalSyncUnavailable = fmt.Errorf("incremental sync needs a full v3 sync first")
+
+// syncCursor is the most recent update time of the resources of an endpoint, with the guids of the resources
+// updated at that time. The filter includes the resources of the cursor time, the ones already seen are skipped.
+type syncCursor struct {
+	updatedAt string
+	seen      map[string]bool
+}
+
+// isSeen tells whether the resource guid updated at updatedAt was already returned by a sync
+func (c syncCursor) isSeen(guid, updatedAt string) bool {
+	return c.seen[guid] && sameTime(updatedAt, c.updatedAt)
+}
+
+// cachedResponse is the last response to a page of changes
+type cachedResponse struct {
+	query string
+	etag  string
+	body  []byte
+}
+
+// GetUpdatedApplications returns the apps whose app, processes, space or org changed since the last sync.
+// Deleted apps are not returned, they are only noticed by a full sync.
+func (cfc *CFClient) GetUpdatedApplications() ([]CFApplication, error) {
+	if cfc.ApiVersion != 3 {
+		return nil, ErrIncrementalSyncUnavailable
+	}
+	since := cfc.getUpdatedSince()
+	if since == nil {
+		return nil, ErrIncrementalSyncUnavailable
+	}
+
+	// The endpoints without an update time are skipped until a full sync records one,
+	// requesting them from the epoch would download every resource again
+	var changedApps []CFApplication
+	var changedProcesses []cfclient.Process
+	var changedSpaces []v3SpaceResource
+	var changedOrgs []cfclient.Org
+	if cursor, ok := since["/v3/apps"]; ok {
+		apps, err := cfc.getV3Apps(updatedSince(cursor))
+		if err != nil {
+			return nil, err
+		}
+		for _, cfapp := range apps {
+			if !cursor.isSeen(cfapp.GUID, cfapp.updatedAt) {
+				changedApps = append(changedApps, cfapp)
+			}
+		}
+	}
+	if cursor, ok := since["/v3/processes"]; ok {
+		processes, err := cfc.getV3Processes(updatedSince(cursor))
+		if err != nil {
+			return nil, err
+		}
+		for _, process := range processes {
+			if !cursor.isSeen(process.GUID, process.UpdatedAt) {
+				changedProcesses = append(changedProcesses, process)
+			}
+		}
+	}
+	if cursor, ok := since["/v3/spaces"]; ok {
+		spaces, err := cfc.getV3Spaces(updatedSince(cursor))
+		if err != nil {
+			return nil, err
+		}
+		for _, space := range spaces {
+			if !cursor.isSeen(space.GUID, space.UpdatedAt) {
+				changedSpaces = append(changedSpaces, space)
+			}
+		}
+	}
+	if cursor, ok := since["/v3/organizations"]; ok {
+		orgs, err := cfc.getV3Orgs(updatedSince(cursor))
+		if err != nil {
+			return nil, err
+		}
+		for _, org := range orgs {
+			if !cursor.isSeen(org.Guid, org.UpdatedAt) {
+				changedOrgs = append(changedOrgs, org)
+			}
+		}
+	}
+
+	// Collect the apps affected by the changes of their processes, space or org
+	cfapps := map[string]CFApplication{}
+	for _, cfapp := range changedApps {
+		cfapps[cfapp.GUID] = cfapp
+	}
+	var missing []string
+	for _, process := range changedProcesses {
+		if guid := processAppGUID(process); !hasApp(cfapps, guid) {
+			missing = append(missing, guid)
+		}
+	}
+	if err := cfc.addV3Apps(cfapps, "guids", missing); err != nil {
+		return nil, err
+	}
+	if err := cfc.addV3Apps(cfapps, "space_guids", spaceGUIDs(changedSpaces)); err != nil {
+		return nil, err
+	}
+	if err := cfc.addV3Apps(cfapps, "organization_guids", orgGUIDs(changedOrgs)); err != nil {
+		return nil, err
+	}
+
+	cfc.setUpdatedSince(latestUpdates(changedApps, changedProcesses, changedSpaces, changedOrgs))
+	return cfc.completeV3Apps(cfapps)
+}
+
+// GetApplicationsByGUID returns the apps with the given guids, the apps not found are left out
+func (cfc *CFClient) GetApplicationsByGUID(guids []string) ([]CFApplication, error) {
+	if cfc.ApiVersion != 3 {
+		var results []CFApplication
+		for _, guid := range guids {
+			app, err := cfc.GetApplication(guid)
+			if err != nil {
+				cfc.logger.Errorf("could not fetch app guid %s: %v", guid, err)
+				continue
+			}
+			results = append(results, *app)
+		}
+		return results, nil
+	}
+
+	cfapps := map[string]CFApplication{}
+	if err := cfc.addV3Apps(cfapps, "guids", guids); err != nil {
+		return nil, err
+	}
+	return cfc.completeV3Apps(cfapps)
+}
+
+// completeV3Apps fetches the processes, spaces and orgs of the apps and completes them with their data
+func (cfc *CFClient) completeV3Apps(cfapps map[string]CFApplication) ([]CFApplication, error) {
+	if len(cfapps) == 0 {
+		return nil, nil
+	}
+
+	var appGUIDs, spaceGUIDs []string
+	for _, cfapp := range cfapps {
+		appGUIDs = append(appGUIDs, cfapp.GUID)
+		spaceGUIDs = append(spaceGUIDs, cfapp.SpaceGUID)
+	}
+	var processes []cfclient.Process
+	err := forEachChunk(appGUIDs, func(guids string) error {
+		chunk, err := cfc.getV3Processes(url.Values{"app_guids": {guids}})
+		processes = append(processes, chunk...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var spaces []v3SpaceResource
+	err = forEachChunk(dedupe(spaceGUIDs), func(guids string) error {
+		chunk, err := cfc.getV3Spaces(url.Values{"guids": {guids}})
+		spaces = append(spaces, chunk...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var orgIDs []string
+	for _, space := range spaces {
+		orgIDs = append(orgIDs, space.Relationships.Organization.Data.GUID)
+	}
+	var orgs []cfclient.Org
+	err = forEachChunk(dedupe(orgIDs), func(guids string) error {
+		chunk, err := cfc.getV3Orgs(url.Values{"guids": {guids}})
+		orgs = append(orgs, chunk...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make([]CFApplication, 0, len(cfapps))
+	for _, cfapp := range cfapps {
+		apps = append(apps, cfapp)
+	}
+	return cfc.joinV3Resources(apps, processes, spaces, orgs), nil
+}
+
+// addV3Apps adds to cfapps the apps matching any of the guids of the filter
+func (cfc *CFClient) addV3Apps(cfapps map[string]CFApplication, filter string, guids []string) error {
+	return forEachChunk(dedupe(guids), func(chunk string) error {
+		apps, err := cfc.getV3Apps(url.Values{filter: {chunk}})
+		if err != nil {
+			return err
+		}
+		for _, cfapp := range apps {
+			cfapps[cfapp.GUID] = cfapp
+		}
+		return nil
+	})
+}
+
+// getConditionally requests a page of changes with the ETag of its last response,
+// the cloud controller answers 304 when the page did not change
+func (cfc *CFClient) getConditionally(path string, q url.Values, page int) ([]byte, error) {
+	key := fmt.Sprintf("%s#%d", path, page)
+	query := q.Encode()
+	cfc.syncLock.Lock()
+	cached, hasCached := cfc.etags[key]
+	cfc.syncLock.Unlock()
+	// The filter moves with the sync, a response to another query is no use
+	hasCached = hasCached && cached.query == query
+
+	var resp *http.Response
+	err := cfc.withReauth(func(client *cfclient.Client) error {
+		req, err := http.NewRequest("GET", client.Config.ApiAddress+path+"?"+query, nil)
+		if err != nil {
+			return err
+		}
+		if hasCached {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		resp, err = client.Do(req)
+		if err != nil {
+			return err
+		}
+		// The token is renewed by withReauth, the other errors are returned with the body of the response
+		if resp.StatusCode == http.StatusUnauthorized {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return cfclient.CloudFoundryHTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && hasCached {
+		return cached.body, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, cfclient.CloudFoundryHTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       body,
+		}
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		cfc.syncLock.Lock()
+		if cfc.etags == nil {
+			cfc.etags = map[string]cachedResponse{}
+		}
+		cfc.etags[key] = cachedResponse{query: query, etag: etag, body: body}
+		cfc.syncLock.Unlock()
+	}
+	return body, nil
+}
+
+func (cfc *CFClient) getUpdatedSince() map[string]syncCursor {
+	cfc.syncLock.Lock()
+	defer cfc.syncLock.Unlock()
+
+	if cfc.updatedSince == nil {
+		return nil
+	}
+	since := make(map[string]syncCursor, len(cfc.updatedSince))
+	for path, cursor := range cfc.updatedSince {
+		since[path] = cursor
+	}
+	return since
+}
+
+// setUpdatedSince moves forward the update times the next changes are requested from,
+// the resources updated at the same time as the current cursor are added to its seen ones
+func (cfc *CFClient) setUpdatedSince(latest map[string]syncCursor) {
+	cfc.syncLock.Lock()
+	defer cfc.syncLock.Unlock()
+
+	if cfc.updatedSince == nil {
+		cfc.updatedSince = map[string]syncCursor{}
+	}
+	for path, cursor := range latest {
+		current, ok := cfc.updatedSince[path]
+		if !ok || laterThan(cursor.updatedAt, current.updatedAt) {
+			cfc.updatedSince[path] = cursor
+			continue
+		}
+		if sameTime(cursor.updatedAt, current.updatedAt) {
+			seen := make(map[string]bool, len(current.seen)+len(cursor.seen))
+			for guid := range current.seen {
+				seen[guid] = true
+			}
+			for guid := range cursor.seen {
+				seen[guid] = true
+			}
+			cfc.updatedSince[path] = syncCursor{updatedAt: current.updatedAt, seen: seen}
+		}
+	}
+}
+
+// latestUpdates returns the most recent update time of the resources of each endpoint and the resources updated then
+func latestUpdates(cfapps []CFApplication, processes []cfclient.Process, spaces []v3SpaceResource, orgs []cfclient.Org) map[string]syncCursor {
+	latest := map[string]syncCursor{}
+	keep := func(path, guid, updatedAt string) {
+		if _, err := time.Parse(time.RFC3339, updatedAt); err != nil {
+			return
+		}
+		cursor, ok := latest[path]
+		if !ok || laterThan(updatedAt, cursor.updatedAt) {
+			latest[path] = syncCursor{updatedAt: updatedAt, seen: map[string]bool{guid: true}}
+		} else if sameTime(updatedAt, cursor.updatedAt) {
+			cursor.seen[guid] = true
+		}
+	}
+	for _, cfapp := range cfapps {
+		keep("/v3/apps", cfapp.GUID, cfapp.updatedAt)
+	}
+	for _, process := range processes {
+		keep("/v3/processes", process.GUID, process.UpdatedAt)
+	}
+	for _, space := range spaces {
+		keep("/v3/spaces", space.GUID, space.UpdatedAt)
+	}
+	for _, org := range orgs {
+		keep("/v3/organizations", org.Guid, org.UpdatedAt)
+	}
+	return latest
+}
+
+// updatedSince returns the filter on the resources updated at or after the time of the cursor.
+// The update times only have a precision of a second, the resources updated right after the last sync
+// may have the time of the cursor.
+func updatedSince(cursor syncCursor) url.Values {
+	return url.Values{updatedSinceFilter: {cursor.updatedAt}}
+}
+
+func laterThan(updatedAt, other string) bool {
+	t, err := time.Parse(time.RFC3339, updatedAt)
+	if err != nil {
+		return false
+	}
+	o, err := time.Parse(time.RFC3339, other)
+	return err != nil || t.After(o)
+}
+
+func sameTime(updatedAt, other string) bool {
+	t, err := time.Parse(time.RFC3339, updatedAt)
+	if err != nil {
+		return false
+	}
+	o, err := time.Parse(time.RFC3339, other)
+	return err == nil && t.Equal(o)
+}
+
+func processAppGUID(process cfclient.Process) string {
+	parts := strings.Split(process.Links.App.Href, "/")
+	return parts[len(parts)-1]
+}
+
+func hasApp(cfapps map[string]CFApplication, guid string) bool {
+	_, ok := cfapps[guid]
+	return ok
+}
+
+func spaceGUIDs(spaces []v3SpaceResource) []string {
+	guids := make([]string, 0, len(spaces))
+	for _, space := range spaces {
+		guids = append(guids, space.GUID)
+	}
+	return guids
+}
+
+func orgGUIDs(orgs []cfclient.Org) []string {
+	guids := make([]string, 0, len(orgs))
+	for _, org := range orgs {
+		guids = append(guids, org.Guid)
+	}
+	return guids
+}
+
+func dedupe(guids []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, guid := range guids {
+		if guid != "" && !seen[guid] {
+			seen[guid] = true
+			result = append(result, guid)
+		}
+	}
+	return result
+}
+
+// forEachChunk calls f with the guids joined by commas, guidsPerQuery at a time
+func forEachChunk(guids []string, f func(guids string) error) error {
+	for start := 0; start < len(guids); start += guidsPerQuery {
+		end := start + guidsPerQuery
+		if end > len(guids) {
+			end = len(guids)
+		}
+		if err := f(strings.Join(guids[start:end], ",")); err != nil {
+			return errors.Wrap(err, "Error requesting the changed apps")
+		}
+	}
+	return nil
+}
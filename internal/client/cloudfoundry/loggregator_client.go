@@ -20,19 +20,49 @@ type LoggregatorClient struct {
 	RLPGatewayClient *loggregator.RLPGatewayClient
 	stopConsumer     context.CancelFunc
 	shardId          string
+	selectors        []*loggregator_v2.Selector
+}
+
+// AuthTokenFetcher is an interface for fetching an auth token from uaa
+type AuthTokenFetcher interface {
+	FetchAuthToken() (string, error)
+	RefreshAuthToken() (string, error)
 }
 
 type rlpGatewayClientDoer struct {
-	token  string
-	client *http.Client
+	tokenFetcher AuthTokenFetcher
+	client       *http.Client
+	log          *gosteno.Logger
 }
 
+// Do sends the request with the current auth token, and once more with a new token if the gateway rejected it
 func (d *rlpGatewayClientDoer) Do(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Authorization", d.token)
+	// Access control is disabled
+	if d.tokenFetcher == nil {
+		return d.client.Do(req)
+	}
+
+	authToken, err := d.tokenFetcher.FetchAuthToken()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authToken)
+	resp, err := d.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	d.log.Info("The RLP gateway rejected the auth token, fetching a new one")
+	authToken, err = d.tokenFetcher.RefreshAuthToken()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authToken)
 	return d.client.Do(req)
 }
 
-func newRLPGatewayClientDoer(token string, insecureSkipVerify bool) *rlpGatewayClientDoer {
+func newRLPGatewayClientDoer(tokenFetcher AuthTokenFetcher, insecureSkipVerify bool, log *gosteno.Logger) *rlpGatewayClientDoer {
 	client := &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
@@ -42,12 +72,14 @@ func newRLPGatewayClientDoer(token string, insecureSkipVerify bool) *rlpGatewayC
 	}
 
 	return &rlpGatewayClientDoer{
-		token:  token,
-		client: client,
+		tokenFetcher: tokenFetcher,
+		client:       client,
+		log:          log,
 	}
 }
 
-func NewLoggregatorClient(cfg *config.Config, lgr *gosteno.Logger, authToken string) (*LoggregatorClient, error) {
+// NewLoggregatorClient creates a new LoggregatorClient, tokenFetcher is nil when access control is disabled
+func NewLoggregatorClient(cfg *config.Config, lgr *gosteno.Logger, tokenFetcher AuthTokenFetcher) (*LoggregatorClient, error) {
 	var logStreamURL string
 	if cfg.RLPGatewayURL != "" {
 		logStreamURL = cfg.RLPGatewayURL
@@ -58,17 +90,52 @@ func NewLoggregatorClient(cfg *config.Config, lgr *gosteno.Logger, authToken str
 		return nil, fmt.Errorf("neither CloudControllerEndpoint nor RLPGatewayURL specified, can't determine log stream URL")
 	}
 
+	selectors := []*loggregator_v2.Selector{
+		{
+			Message: &loggregator_v2.Selector_Counter{
+				Counter: &loggregator_v2.CounterSelector{},
+			},
+		},
+		{
+			Message: &loggregator_v2.Selector_Gauge{
+				Gauge: &loggregator_v2.GaugeSelector{},
+			},
+		},
+	}
+	if cfg.TimerMetrics {
+		selectors = append(selectors, &loggregator_v2.Selector{
+			Message: &loggregator_v2.Selector_Timer{
+				Timer: &loggregator_v2.TimerSelector{},
+			},
+		})
+	}
+	if cfg.EnableLogs {
+		selectors = append(selectors, &loggregator_v2.Selector{
+			Message: &loggregator_v2.Selector_Log{
+				Log: &loggregator_v2.LogSelector{},
+			},
+		})
+	}
+	if cfg.EnableEvents {
+		selectors = append(selectors, &loggregator_v2.Selector{
+			Message: &loggregator_v2.Selector_Event{
+				Event: &loggregator_v2.EventSelector{},
+			},
+		})
+	}
+
 	logForwarder := *logger.NewRLPLogForwarder(lgr)
 	return &LoggregatorClient{
 		RLPGatewayClient: loggregator.NewRLPGatewayClient(
 			logStreamURL,
 			loggregator.WithRLPGatewayClientLogger(log.New(logForwarder, "", log.LstdFlags)),
 			loggregator.WithRLPGatewayHTTPClient(
-				newRLPGatewayClientDoer(authToken, cfg.InsecureSSLSkipVerify),
+				newRLPGatewayClientDoer(tokenFetcher, cfg.InsecureSSLSkipVerify, lgr),
 			),
 		),
 		shardId:      cfg.FirehoseSubscriptionID,
 		stopConsumer: nil,
+		selectors:    selectors,
 	}, nil
 }
 
@@ -78,19 +145,8 @@ func (l *LoggregatorClient) EnvelopeStream() loggregator.EnvelopeStream {
 	es := l.RLPGatewayClient.Stream(
 		ctx,
 		&loggregator_v2.EgressBatchRequest{
-			ShardId: l.shardId,
-			Selectors: []*loggregator_v2.Selector{
-				{
-					Message: &loggregator_v2.Selector_Counter{
-						Counter: &loggregator_v2.CounterSelector{},
-					},
-				},
-				{
-					Message: &loggregator_v2.Selector_Gauge{
-						Gauge: &loggregator_v2.GaugeSelector{},
-					},
-				},
-			},
+			ShardId:   l.shardId,
+			Selectors: l.selectors,
 		},
 	)
 
@@ -0,0 +1,83 @@
+package cloudfoundry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/DataDog/datadog-firehose-nozzle/test/helper"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/gosteno"
+)
+
+var _ = Describe("rlpGatewayClientDoer", func() {
+	var (
+		server         *httptest.Server
+		lock           sync.Mutex
+		authorizations []string
+		rejected       int
+	)
+
+	BeforeEach(func() {
+		authorizations = nil
+		rejected = 0
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			authorizations = append(authorizations, r.Header.Get("Authorization"))
+			if rejected > 0 {
+				rejected--
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("sends the auth token", func() {
+		tokenFetcher := &FakeTokenFetcher{}
+		doer := newRLPGatewayClientDoer(tokenFetcher, true, gosteno.NewLogger("test"))
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		resp, err := doer.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(authorizations).To(Equal([]string{"auth token"}))
+		Expect(tokenFetcher.NumRefresh).To(Equal(0))
+	})
+
+	It("refreshes the token and retries when the gateway rejects it", func() {
+		rejected = 1
+		tokenFetcher := &FakeTokenFetcher{}
+		doer := newRLPGatewayClientDoer(tokenFetcher, true, gosteno.NewLogger("test"))
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		resp, err := doer.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(authorizations).To(HaveLen(2))
+		Expect(tokenFetcher.NumRefresh).To(Equal(1))
+	})
+
+	It("returns an error without calling the gateway when no token can be fetched", func() {
+		tokenFetcher := &FakeTokenFetcher{Err: errors.New("uaa is down")}
+		doer := newRLPGatewayClientDoer(tokenFetcher, true, gosteno.NewLogger("test"))
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		_, err := doer.Do(req)
+		Expect(err).To(MatchError("uaa is down"))
+		Expect(authorizations).To(BeEmpty())
+	})
+
+	It("does not send a token when access control is disabled", func() {
+		doer := newRLPGatewayClientDoer(nil, true, gosteno.NewLogger("test"))
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		_, err := doer.Do(req)
+		Expect(err).To(BeNil())
+		Expect(authorizations).To(Equal([]string{""}))
+	})
+})
@@ -2,26 +2,40 @@ package datadog
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"io/ioutil"
 
 	"code.cloudfoundry.org/localip"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/events"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
 	"github.com/cloudfoundry/gosteno"
 	"github.com/hashicorp/go-retryablehttp"
 )
 
+// maxConcurrentEvents is how many events a client posts at the same time
+const maxConcurrentEvents = 10
+
+// maxReplayedPayloads is how many spooled payloads a client posts before the metrics of a flush,
+// the backlog of a long outage is replayed over several flushes
+const maxReplayedPayloads = 20
+
 type Client struct {
 	apiURL       string
+	logsURL      string
+	spool        *Spool
 	apiKey       string
 	prefix       string
 	deployment   string
@@ -31,6 +45,9 @@ type Client struct {
 	maxPostBytes uint32
 	log          *gosteno.Logger
 	formatter    Formatter
+	route        int // index of the app metrics route posted by the client, -1 for the platform account
+	routeName    string
+	allRoutes    bool // the client of a platform account also posts the app metrics of the routes
 }
 
 type Payload struct {
@@ -100,6 +117,7 @@ func New(
 		formatter: Formatter{
 			log: logger,
 		},
+		route: -1,
 	}
 }
 
@@ -120,7 +138,7 @@ func NewClients(config *config.Config, log *gosteno.Logger) ([]*Client, error) {
 
 	// Instantiating Datadog primary client
 	var ddClients []*Client
-	ddClients = append(ddClients, New(
+	primaryClient := New(
 		config.DataDogURL,
 		config.DataDogAPIKey,
 		config.MetricPrefix,
@@ -132,40 +150,107 @@ func NewClients(config *config.Config, log *gosteno.Logger) ([]*Client, error) {
 		log,
 		config.CustomTags,
 		proxy,
-	))
-	// Instantiating Additional Datadog endpoints
-	for endpoint, keys := range config.DataDogAdditionalEndpoints {
-		for keyIndex := range keys {
-			ddClients = append(ddClients, New(
-				endpoint,
-				keys[keyIndex],
-				config.MetricPrefix,
-				config.Deployment,
-				ipAddress,
-				time.Duration(config.DataDogTimeoutSeconds)*time.Second,
-				time.Duration(config.FlushDurationSeconds)*time.Second,
-				config.FlushMaxBytes,
+	)
+	// Logs are only forwarded to the primary account
+	if config.EnableLogs {
+		primaryClient.logsURL = config.DataDogLogsURL
+	}
+	ddClients = append(ddClients, primaryClient)
+	// Instantiating Additional Datadog endpoints, they also get the app metrics of the routes
+	// unlike the platform endpoints, which only get the metrics of the platform account
+	endpointSets := []struct {
+		endpoints map[string][]string
+		allRoutes bool
+	}{
+		{config.DataDogAdditionalEndpoints, true},
+		{config.DataDogPlatformEndpoints, false},
+	}
+	for _, set := range endpointSets {
+		for endpoint, keys := range set.endpoints {
+			for keyIndex := range keys {
+				client := New(
+					endpoint,
+					keys[keyIndex],
+					config.MetricPrefix,
+					config.Deployment,
+					ipAddress,
+					time.Duration(config.DataDogTimeoutSeconds)*time.Second,
+					time.Duration(config.FlushDurationSeconds)*time.Second,
+					config.FlushMaxBytes,
+					log,
+					config.CustomTags,
+					proxy,
+				)
+				client.allRoutes = set.allRoutes
+				ddClients = append(ddClients, client)
+			}
+		}
+	}
+
+	// Each app metrics route posts to its own account
+	for i, route := range config.AppMetricsRoutes {
+		client := New(
+			route.DataDogURL,
+			route.DataDogAPIKey,
+			config.MetricPrefix,
+			config.Deployment,
+			ipAddress,
+			time.Duration(config.DataDogTimeoutSeconds)*time.Second,
+			time.Duration(config.FlushDurationSeconds)*time.Second,
+			config.FlushMaxBytes,
+			log,
+			config.CustomTags,
+			proxy,
+		)
+		client.route = i
+		client.routeName = route.Name
+		ddClients = append(ddClients, client)
+	}
+
+	// Each endpoint and account gets its own spool so that an outage of one doesn't affect the others
+	if config.SpoolDirectory != "" {
+		for _, client := range ddClients {
+			client.spool, err = NewSpool(
+				EndpointSpoolDir(config.SpoolDirectory, client.apiURL, client.apiKey),
+				uint64(config.SpoolMaxBytes),
+				time.Duration(config.SpoolMaxAgeSeconds)*time.Second,
 				log,
-				config.CustomTags,
-				proxy,
-			))
+			)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	return ddClients, nil
 }
 
-// PostMetrics forwards the metrics to datadog
-func (c *Client) PostMetrics(metrics metric.MetricsMap) error {
-	c.log.Debugf("Posting %d metrics to account %s", len(metrics), c.apiKey[len(c.apiKey)-4:])
-	seriesBytes := c.formatter.Format(c.prefix, c.maxPostBytes, metrics)
-	for _, data := range seriesBytes {
+// PostMetrics forwards the metrics of all the maps to datadog, the maps are only read
+// When a spool is configured, payloads that could not be posted are spooled and replayed on the next calls
+func (c *Client) PostMetrics(metrics ...metric.MetricsMap) error {
+	seriesBytes := [][]byte{}
+	for _, data := range c.formatter.Format(c.prefix, c.maxPostBytes, metrics...) {
 		if uint32(len(data)) > c.maxPostBytes {
 			c.log.Debugf("Throwing out metric that exceeds %d bytes", c.maxPostBytes)
 			continue
 		}
+		seriesBytes = append(seriesBytes, data)
+	}
+	c.log.Debugf("Posting %d metrics to account %s", seriesCount(metrics), c.apiKey[len(c.apiKey)-4:])
 
+	// Payloads spooled during previous failures are sent first to keep them in order
+	if c.spool != nil {
+		if err := c.spool.Replay(c.replayMetrics, maxReplayedPayloads); err != nil {
+			c.spoolMetrics(seriesBytes)
+			return err
+		}
+	}
+
+	for i, data := range seriesBytes {
 		if err := c.postMetrics(data); err != nil {
+			if isRetryable(err) {
+				c.spoolMetrics(seriesBytes[i:])
+			}
 			return err
 		}
 	}
@@ -173,6 +258,64 @@ func (c *Client) PostMetrics(metrics metric.MetricsMap) error {
 	return nil
 }
 
+func (c *Client) replayMetrics(seriesBytes []byte) error {
+	err := c.postMetrics(seriesBytes)
+	if err != nil && !isRetryable(err) {
+		// The payload would be rejected again, don't let it block the spool
+		c.log.Errorf("Dropping spooled payload rejected by datadog: %v", err)
+		return nil
+	}
+	return err
+}
+
+// spoolBatch formats the metrics of a batch that could not be posted and spools them,
+// it returns false when the client has no spool
+func (c *Client) spoolBatch(metrics ...metric.MetricsMap) bool {
+	if c.spool == nil {
+		return false
+	}
+	c.log.Warnf("Spooling a batch of %d metrics that could not be posted to %s in time", seriesCount(metrics), c.apiURL)
+	var seriesBytes [][]byte
+	for _, data := range c.formatter.Format(c.prefix, c.maxPostBytes, metrics...) {
+		if uint32(len(data)) <= c.maxPostBytes {
+			seriesBytes = append(seriesBytes, data)
+		}
+	}
+	c.spoolMetrics(seriesBytes)
+	return true
+}
+
+func (c *Client) spoolMetrics(seriesBytes [][]byte) {
+	if c.spool == nil {
+		return
+	}
+	for _, data := range seriesBytes {
+		if err := c.spool.Push(data); err != nil {
+			c.log.Errorf("Error spooling metrics payload: %v", err)
+		}
+	}
+}
+
+// Route returns the index of the app metrics route posted by the client, -1 for the platform account
+func (c *Client) Route() int {
+	return c.route
+}
+
+// RouteName returns the name of the app metrics route posted by the client
+func (c *Client) RouteName() string {
+	return c.routeName
+}
+
+// AllRoutes returns whether the client also posts the app metrics of the routes, as the additional endpoints do
+func (c *Client) AllRoutes() bool {
+	return c.allRoutes
+}
+
+// Spool returns the spool of the client, nil if spooling is disabled
+func (c *Client) Spool() *Spool {
+	return c.spool
+}
+
 func (c *Client) postMetrics(seriesBytes []byte) error {
 	url, err := c.seriesURL()
 	if err != nil {
@@ -186,6 +329,114 @@ func (c *Client) postMetrics(seriesBytes []byte) error {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Content-Encoding", "deflate") // Additional header for zlib compression
 
+	return c.do(req)
+}
+
+// PostLogs forwards the log messages to the datadog logs intake
+func (c *Client) PostLogs(logMessages []logs.LogMessage) error {
+	// Clients for additional endpoints don't have a logs intake configured
+	if c.logsURL == "" {
+		return nil
+	}
+
+	c.log.Debugf("Posting %d logs to account %s", len(logMessages), c.apiKey[len(c.apiKey)-4:])
+	logsBytes := c.formatter.FormatLogs(c.maxPostBytes, logMessages)
+	for _, data := range logsBytes {
+		if uint32(len(data)) > c.maxPostBytes {
+			c.log.Debugf("Throwing out log that exceeds %d bytes", c.maxPostBytes)
+			continue
+		}
+
+		if err := c.postLogs(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) postLogs(logsBytes []byte) error {
+	url, err := c.logsIntakeURL()
+	if err != nil {
+		return err
+	}
+
+	req, err := retryablehttp.NewRequest("POST", url, logsBytes)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "deflate") // Additional header for zlib compression
+	req.Header.Set("DD-API-KEY", c.apiKey)
+
+	return c.do(req)
+}
+
+// PostEvents forwards the events to datadog and returns how many were posted.
+// The events API only accepts one event per request, up to maxConcurrentEvents requests are sent at the same time
+// and a failed event doesn't stop the others.
+func (c *Client) PostEvents(eventsToPost []events.Event) (int, error) {
+	c.log.Debugf("Posting %d events to account %s", len(eventsToPost), c.apiKey[len(c.apiKey)-4:])
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		posted  int
+		failed  int
+		lastErr error
+	)
+	slots := make(chan struct{}, maxConcurrentEvents)
+	for _, event := range eventsToPost {
+		data, err := json.Marshal(event)
+		if err != nil {
+			c.log.Errorf("Error marshalling event: %v", err)
+			continue
+		}
+		if uint32(len(data)) > c.maxPostBytes {
+			c.log.Debugf("Throwing out event that exceeds %d bytes", c.maxPostBytes)
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(data []byte) {
+			defer wg.Done()
+			err := c.postEvent(data)
+			<-slots
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				failed++
+				lastErr = err
+			} else {
+				posted++
+			}
+		}(data)
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		return posted, fmt.Errorf("%d of %d events could not be posted, last error: %v", failed, posted+failed, lastErr)
+	}
+	return posted, nil
+}
+
+func (c *Client) postEvent(eventBytes []byte) error {
+	url, err := c.eventsURL()
+	if err != nil {
+		return err
+	}
+
+	req, err := retryablehttp.NewRequest("POST", url, eventBytes)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req)
+}
+
+func (c *Client) do(req *retryablehttp.Request) error {
 	// If an error is returned by the client (connection errors, etc.), or if a 500-range
 	// response code is received, then a retry is invoked on this request after a wait period
 	resp, err := c.httpClient.Do(req)
@@ -201,12 +452,36 @@ func (c *Client) postMetrics(seriesBytes []byte) error {
 		if err != nil {
 			body = []byte("failed to read body")
 		}
-		return fmt.Errorf("datadog request returned HTTP response: %s\nResponse Body: %s", resp.Status, body)
+		return &responseError{
+			statusCode: resp.StatusCode,
+			status:     resp.Status,
+			body:       body,
+		}
 	}
 
 	return nil
 }
 
+// responseError is returned when datadog answers with a non 2xx status code
+type responseError struct {
+	statusCode int
+	status     string
+	body       []byte
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("datadog request returned HTTP response: %s\nResponse Body: %s", e.status, e.body)
+}
+
+// isRetryable returns whether a request that failed with err may succeed later
+func isRetryable(err error) bool {
+	if respErr, ok := err.(*responseError); ok {
+		return respErr.statusCode >= 500 || respErr.statusCode == http.StatusTooManyRequests
+	}
+	// Connection errors, timeouts...
+	return true
+}
+
 func (c *Client) seriesURL() (string, error) {
 	apiURL, err := url.Parse(c.apiURL)
 	if err != nil {
@@ -221,8 +496,35 @@ func (c *Client) seriesURL() (string, error) {
 	return apiURL.String(), nil
 }
 
-// MakeInternalMetric creates a metric with the provided name, value and timestamp
-func (c *Client) MakeInternalMetric(name string, value uint64, timestamp int64) (metric.MetricKey, metric.MetricValue) {
+func (c *Client) eventsURL() (string, error) {
+	apiURL, err := url.Parse(c.apiURL)
+	if err != nil {
+		return "", fmt.Errorf("error parsing API URL %s: %v", c.apiURL, err)
+	}
+	// The API URL may point to the series endpoint, events are posted next to it
+	apiURL.Path = strings.TrimSuffix(strings.TrimSuffix(apiURL.Path, "/"), "api/v1/series")
+	if !strings.Contains(apiURL.EscapedPath(), "api/v1/events") {
+		apiURL.Path = path.Join(apiURL.Path, "api/v1/events")
+	}
+	query := apiURL.Query()
+	query.Add("api_key", c.apiKey)
+	apiURL.RawQuery = query.Encode()
+	return apiURL.String(), nil
+}
+
+func (c *Client) logsIntakeURL() (string, error) {
+	logsURL, err := url.Parse(c.logsURL)
+	if err != nil {
+		return "", fmt.Errorf("error parsing logs URL %s: %v", c.logsURL, err)
+	}
+	if !strings.Contains(logsURL.EscapedPath(), "api/v2/logs") {
+		logsURL.Path = path.Join(logsURL.Path, "api/v2/logs")
+	}
+	return logsURL.String(), nil
+}
+
+// MakeInternalMetric creates a metric with the provided name, value, timestamp and additional tags
+func (c *Client) MakeInternalMetric(name string, value uint64, timestamp int64, extraTags ...string) (metric.MetricKey, metric.MetricValue) {
 	point := metric.Point{
 		Timestamp: timestamp,
 		Value:     float64(value),
@@ -233,6 +535,8 @@ func (c *Client) MakeInternalMetric(name string, value uint64, timestamp int64)
 		fmt.Sprintf("ip:%s", c.ip),
 	}
 	tags = append(tags, c.customTags...)
+	tags = append(tags, extraTags...)
+	sort.Strings(tags)
 
 	key := metric.MetricKey{
 		Name:     name,
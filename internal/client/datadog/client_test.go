@@ -6,7 +6,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudfoundry/gosteno"
@@ -14,6 +16,9 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/events"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
 	"github.com/DataDog/datadog-firehose-nozzle/test/helper"
@@ -21,6 +26,7 @@ import (
 
 var (
 	bodies       [][]byte
+	bodiesLock   sync.Mutex
 	reqs         chan *http.Request
 	responseCode int
 	responseBody []byte
@@ -90,6 +96,38 @@ var _ = Describe("DatadogClient", func() {
 		})
 	})
 
+	Context("It parses configured logs URL correctly", func() {
+		It("appends api/v2/logs if not present", func() {
+			c.logsURL = "https://http-intake.logs.datadoghq.com"
+			result, err := c.logsIntakeURL()
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal("https://http-intake.logs.datadoghq.com/api/v2/logs"))
+		})
+
+		It("doesn't append api/v2/logs if present", func() {
+			c.logsURL = "https://http-intake.logs.datadoghq.com/api/v2/logs"
+			result, err := c.logsIntakeURL()
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal("https://http-intake.logs.datadoghq.com/api/v2/logs"))
+		})
+	})
+
+	Context("It parses configured events URL correctly", func() {
+		It("appends api/v1/events if not present", func() {
+			c.apiURL = "https://app.datadoghq.com/"
+			result, err := c.eventsURL()
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal("https://app.datadoghq.com/api/v1/events?api_key=dummykey"))
+		})
+
+		It("replaces api/v1/series if present", func() {
+			c.apiURL = "https://app.datadoghq.com/api/v1/series"
+			result, err := c.eventsURL()
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal("https://app.datadoghq.com/api/v1/events?api_key=dummykey"))
+		})
+	})
+
 	Context("datadog does not respond", func() {
 		var fakeBuffer *helper.FakeBufferSink
 
@@ -403,6 +441,182 @@ var _ = Describe("DatadogClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 	})
 
+	Context("a spool is configured", func() {
+		var spoolDir string
+
+		BeforeEach(func() {
+			c = New(
+				ts.URL,
+				"dummykey",
+				"datadog.nozzle.",
+				"test-deployment",
+				"dummy-ip",
+				time.Second,
+				100*time.Millisecond,
+				2000,
+				gosteno.NewLogger("datadogclient test"),
+				[]string{},
+				nil,
+			)
+
+			var err error
+			spoolDir, err = ioutil.TempDir("", "spool")
+			Expect(err).To(BeNil())
+			c.spool, err = NewSpool(spoolDir, 1024*1024, time.Hour, gosteno.NewLogger("datadogclient test"))
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(spoolDir)
+		})
+
+		It("spools payloads that failed and replays them in order once datadog recovers", func() {
+			k, v := makeFakeMetric("first", 1, 1, defaultTags)
+			metricsMap.Add(k, v)
+			responseCode = http.StatusServiceUnavailable
+			err := c.PostMetrics(metricsMap)
+			Expect(err).To(HaveOccurred())
+			Expect(c.Spool().Len()).To(Equal(1))
+
+			metricsMap = make(metric.MetricsMap)
+			k, v = makeFakeMetric("second", 2, 2, defaultTags)
+			metricsMap.Add(k, v)
+			err = c.PostMetrics(metricsMap)
+			Expect(err).To(HaveOccurred())
+			Expect(c.Spool().Len()).To(Equal(2))
+
+			bodies = nil
+			responseCode = http.StatusAccepted
+			metricsMap = make(metric.MetricsMap)
+			k, v = makeFakeMetric("third", 3, 3, defaultTags)
+			metricsMap.Add(k, v)
+			err = c.PostMetrics(metricsMap)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Spool().Len()).To(Equal(0))
+
+			Expect(bodies).To(HaveLen(3))
+			for i, name := range []string{"first", "second", "third"} {
+				var payload Payload
+				err = json.Unmarshal(helper.Decompress(bodies[i]), &payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(payload.Series[0].Metric).To(Equal("datadog.nozzle." + name))
+			}
+		})
+
+		It("does not spool payloads rejected by datadog", func() {
+			k, v := makeFakeMetric("metricName", 1, 1, defaultTags)
+			metricsMap.Add(k, v)
+			responseCode = http.StatusBadRequest
+			err := c.PostMetrics(metricsMap)
+			Expect(err).To(HaveOccurred())
+			Expect(c.Spool().Len()).To(Equal(0))
+		})
+	})
+
+	It("posts logs to the logs intake", func() {
+		c.logsURL = ts.URL
+		err := c.PostLogs([]logs.LogMessage{{
+			Message: "hello",
+			Status:  "info",
+			Tags:    []string{"some:tag"},
+		}})
+		Expect(err).ToNot(HaveOccurred())
+
+		var req *http.Request
+		Eventually(reqs).Should(Receive(&req))
+		Expect(req.URL.Path).To(Equal("/api/v2/logs"))
+		Expect(req.Header.Get("DD-API-KEY")).To(Equal("dummykey"))
+		Expect(req.Header.Get("Content-Encoding")).To(Equal("deflate"))
+
+		Eventually(bodies).Should(HaveLen(1))
+		var logMessages []logs.LogMessage
+		err = json.Unmarshal(helper.Decompress(bodies[0]), &logMessages)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logMessages).To(Equal([]logs.LogMessage{{
+			Message: "hello",
+			Status:  "info",
+			Tags:    []string{"some:tag"},
+		}}))
+	})
+
+	It("does not post logs when no logs intake is configured", func() {
+		err := c.PostLogs([]logs.LogMessage{{Message: "hello"}})
+		Expect(err).ToNot(HaveOccurred())
+		Consistently(reqs).ShouldNot(Receive())
+	})
+
+	It("posts events to the events API", func() {
+		posted, err := c.PostEvents([]events.Event{{
+			Title: "some title",
+			Text:  "some text",
+			Tags:  []string{"some:tag"},
+		}, {
+			Title: "other title",
+		}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(posted).To(Equal(2))
+
+		var req *http.Request
+		Eventually(reqs).Should(Receive(&req))
+		Expect(req.URL.Path).To(Equal("/api/v1/events"))
+		Expect(req.URL.Query().Get("api_key")).To(Equal("dummykey"))
+
+		// The events are posted concurrently
+		Expect(bodies).To(HaveLen(2))
+		var postedEvents []events.Event
+		for _, body := range bodies {
+			var event events.Event
+			err = json.Unmarshal(body, &event)
+			Expect(err).NotTo(HaveOccurred())
+			postedEvents = append(postedEvents, event)
+		}
+		Expect(postedEvents).To(ContainElement(events.Event{
+			Title: "some title",
+			Text:  "some text",
+			Tags:  []string{"some:tag"},
+		}))
+	})
+
+	It("keeps posting the events after a failed one", func() {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var event events.Event
+			json.NewDecoder(r.Body).Decode(&event)
+			if event.Title == "rejected" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer failing.Close()
+		c.apiURL = failing.URL
+
+		posted, err := c.PostEvents([]events.Event{{Title: "rejected"}, {Title: "first"}, {Title: "second"}})
+		Expect(err).To(MatchError(ContainSubstring("1 of 3 events could not be posted")))
+		Expect(posted).To(Equal(2))
+	})
+
+	It("posts the app metrics of the routes to the additional endpoints but not to the platform endpoints", func() {
+		clients, err := NewClients(&config.Config{
+			DataDogURL:                 "https://app.datadoghq.com",
+			DataDogAPIKey:              "primarykey",
+			DataDogAdditionalEndpoints: map[string][]string{"https://app.datadoghq.com": {"additionalkey"}},
+			DataDogPlatformEndpoints:   map[string][]string{"https://app.datadoghq.eu": {"platformkey"}},
+			AppMetricsRoutes:           []config.MetricsRoute{{Name: "payments", DataDogAPIKey: "routekey"}},
+		}, gosteno.NewLogger("datadogclient test"))
+		Expect(err).ToNot(HaveOccurred())
+
+		allRoutes := map[string]bool{}
+		for _, client := range clients {
+			allRoutes[client.apiKey] = client.AllRoutes()
+		}
+		Expect(allRoutes).To(Equal(map[string]bool{
+			"primarykey":    false,
+			"additionalkey": true,
+			"platformkey":   false,
+			"routekey":      false,
+		}))
+	})
+
 	It("parses proxy URLs correctly & chooses the correct proxy to use by scheme", func() {
 		println("proxy test")
 		proxy := &Proxy{
@@ -477,7 +691,9 @@ func handlePost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	reqs <- r
+	bodiesLock.Lock()
 	bodies = append(bodies, body)
+	bodiesLock.Unlock()
 	w.WriteHeader(responseCode)
 	w.Write(responseBody)
 }
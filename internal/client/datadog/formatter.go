@@ -6,18 +6,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
-	"strings"
 
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/cloudfoundry/gosteno"
 )
 
+// maxLogsPerPayload is the maximum number of log messages accepted by the logs intake in one request
+const maxLogsPerPayload = 1000
+
 type Formatter struct {
 	log *gosteno.Logger
 }
 
-func (f Formatter) Format(prefix string, maxPostBytes uint32, data map[metric.MetricKey]metric.MetricValue) [][]byte {
-	if len(data) == 0 {
+// Format puts the series of all the maps in the same payloads, they are only split to fit within maxPostBytes
+func (f Formatter) Format(prefix string, maxPostBytes uint32, data ...metric.MetricsMap) [][]byte {
+	if seriesCount(data) == 0 {
 		return nil
 	}
 
@@ -29,8 +33,8 @@ func (f Formatter) Format(prefix string, maxPostBytes uint32, data map[metric.Me
 	}
 	if uint32(len(compressedSeriesBytes)) > maxPostBytes && canSplit(data) {
 		metricsA, metricsB := splitPoints(data)
-		result = append(result, f.Format(prefix, maxPostBytes, metricsA)...)
-		result = append(result, f.Format(prefix, maxPostBytes, metricsB)...)
+		result = append(result, f.Format(prefix, maxPostBytes, metricsA...)...)
+		result = append(result, f.Format(prefix, maxPostBytes, metricsB...)...)
 
 		return result
 	}
@@ -39,25 +43,30 @@ func (f Formatter) Format(prefix string, maxPostBytes uint32, data map[metric.Me
 	return result
 }
 
-func (f Formatter) formatMetrics(prefix string, data map[metric.MetricKey]metric.MetricValue) ([]byte, error) {
-	s := []metric.Series{}
-	for key, mVal := range data {
-		// dogate feature
-		if strings.HasPrefix(key.Name, "bosh.healthmonitor") {
-			prefix = ""
-		}
+func (f Formatter) formatMetrics(prefix string, data []metric.MetricsMap) ([]byte, error) {
+	s := make([]metric.Series, 0, seriesCount(data))
+	for _, metricsMap := range data {
+		for key, mVal := range metricsMap {
+			name := key.Name
+			if !key.Prefixed {
+				name = prefix + key.Name
+			}
+			points := f.removeNANs(mVal.Points, name, mVal.Tags)
 
-		name := prefix + key.Name
-		points := f.removeNANs(mVal.Points, name, mVal.Tags)
+			metricType := mVal.Type
+			if metricType == "" {
+				metricType = metric.GaugeType
+			}
 
-		m := metric.Series{
-			Metric: name,
-			Points: points,
-			Type:   "gauge",
-			Tags:   mVal.Tags,
-			Host:   mVal.Host,
+			m := metric.Series{
+				Metric: name,
+				Points: points,
+				Type:   metricType,
+				Tags:   mVal.Tags,
+				Host:   mVal.Host,
+			}
+			s = append(s, m)
 		}
-		s = append(s, m)
 	}
 
 	encodedMetric, err := json.Marshal(Payload{Series: s})
@@ -71,6 +80,50 @@ func (f Formatter) formatMetrics(prefix string, data map[metric.MetricKey]metric
 	return compressedPayload, nil
 }
 
+// FormatLogs splits the log messages into compressed payloads that fit within maxPostBytes
+func (f Formatter) FormatLogs(maxPostBytes uint32, data []logs.LogMessage) [][]byte {
+	if len(data) == 0 {
+		return nil
+	}
+
+	var result [][]byte
+	if len(data) > maxLogsPerPayload {
+		split := len(data) / 2
+		result = append(result, f.FormatLogs(maxPostBytes, data[:split])...)
+		result = append(result, f.FormatLogs(maxPostBytes, data[split:])...)
+
+		return result
+	}
+
+	compressedLogsBytes, err := f.formatLogs(data)
+	if err != nil {
+		f.log.Errorf("Error formatting logs payload: %v", err)
+		return result
+	}
+	if uint32(len(compressedLogsBytes)) > maxPostBytes && len(data) > 1 {
+		split := len(data) / 2
+		result = append(result, f.FormatLogs(maxPostBytes, data[:split])...)
+		result = append(result, f.FormatLogs(maxPostBytes, data[split:])...)
+
+		return result
+	}
+
+	result = append(result, compressedLogsBytes)
+	return result
+}
+
+func (f Formatter) formatLogs(data []logs.LogMessage) ([]byte, error) {
+	encodedLogs, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling logs: %v", err)
+	}
+	compressedPayload, err := compress(encodedLogs)
+	if err != nil {
+		return nil, fmt.Errorf("Error compressing payload: %v", err)
+	}
+	return compressedPayload, nil
+}
+
 func (f Formatter) removeNANs(points []metric.Point, metricName string, tags []string) []metric.Point {
 	var sanitizedPoints []metric.Point
 	for _, point := range points {
@@ -84,40 +137,58 @@ func (f Formatter) removeNANs(points []metric.Point, metricName string, tags []s
 
 }
 
-func canSplit(data map[metric.MetricKey]metric.MetricValue) bool {
-	for _, v := range data {
-		if len(v.Points) > 1 {
-			return true
+func seriesCount(data []metric.MetricsMap) int {
+	count := 0
+	for _, metricsMap := range data {
+		count += len(metricsMap)
+	}
+	return count
+}
+
+func canSplit(data []metric.MetricsMap) bool {
+	for _, metricsMap := range data {
+		for _, v := range metricsMap {
+			if len(v.Points) > 1 {
+				return true
+			}
 		}
 	}
 
 	return false
 }
 
-func splitPoints(data map[metric.MetricKey]metric.MetricValue) (a, b map[metric.MetricKey]metric.MetricValue) {
-	a = make(map[metric.MetricKey]metric.MetricValue)
-	b = make(map[metric.MetricKey]metric.MetricValue)
-	for k, v := range data {
-		split := len(v.Points) / 2
-		if split == 0 {
-			a[k] = metric.MetricValue{
+// splitPoints splits the points of each series in two halves, the maps are kept apart
+func splitPoints(data []metric.MetricsMap) (a, b []metric.MetricsMap) {
+	for _, metricsMap := range data {
+		metricsA := make(metric.MetricsMap)
+		metricsB := make(metric.MetricsMap)
+		for k, v := range metricsMap {
+			split := len(v.Points) / 2
+			if split == 0 {
+				metricsA[k] = metric.MetricValue{
+					Tags:   v.Tags,
+					Points: v.Points,
+					Host:   v.Host,
+					Type:   v.Type,
+				}
+				continue
+			}
+
+			metricsA[k] = metric.MetricValue{
 				Tags:   v.Tags,
-				Points: v.Points,
+				Points: v.Points[:split],
 				Host:   v.Host,
+				Type:   v.Type,
+			}
+			metricsB[k] = metric.MetricValue{
+				Tags:   v.Tags,
+				Points: v.Points[split:],
+				Host:   v.Host,
+				Type:   v.Type,
 			}
-			continue
-		}
-
-		a[k] = metric.MetricValue{
-			Tags:   v.Tags,
-			Points: v.Points[:split],
-			Host:   v.Host,
-		}
-		b[k] = metric.MetricValue{
-			Tags:   v.Tags,
-			Points: v.Points[split:],
-			Host:   v.Host,
 		}
+		a = append(a, metricsA)
+		b = append(b, metricsB)
 	}
 	return a, b
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"math"
 
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/DataDog/datadog-firehose-nozzle/test/helper"
 	"github.com/cloudfoundry/gosteno"
@@ -36,6 +37,34 @@ var _ = Describe("Formatter", func() {
 		Expect(string(helper.Decompress(result[0]))).To(Equal(`{"series":[{"metric":"foobar","points":[[0,9.000000]],"type":"gauge"}]}`))
 	})
 
+	It("sends the metric type", func() {
+		m := make(map[metric.MetricKey]metric.MetricValue)
+		m[metric.MetricKey{Name: "bar"}] = metric.MetricValue{
+			Points: []metric.Point{{
+				Value: 9,
+			}},
+			Type: metric.CountType,
+		}
+		result := formatter.Format("foo", 1024, m)
+		Expect(string(helper.Decompress(result[0]))).To(Equal(`{"series":[{"metric":"foobar","points":[[0,9.000000]],"type":"count"}]}`))
+	})
+
+	It("keeps the metric type when splitting", func() {
+		m := make(map[metric.MetricKey]metric.MetricValue)
+		m[metric.MetricKey{Name: "a"}] = metric.MetricValue{
+			Points: []metric.Point{{Value: 9}, {Value: 10}},
+			Type:   metric.CountType,
+		}
+		result := formatter.Format("some-prefix.", 1, m)
+		Expect(result).To(HaveLen(2))
+		for _, r := range result {
+			payload := Payload{}
+			err := json.Unmarshal(helper.Decompress(r), &payload)
+			Expect(err).To(BeNil())
+			Expect(payload.Series[0].Type).To(Equal("count"))
+		}
+	})
+
 	It("does not 'delete' points when trying to split", func() {
 		m := make(map[metric.MetricKey]metric.MetricValue)
 		m[metric.MetricKey{Name: "a"}] = metric.MetricValue{
@@ -48,21 +77,43 @@ var _ = Describe("Formatter", func() {
 		Expect(result).To(HaveLen(1))
 	})
 
-	It("does not prepend prefix to `bosh.healthmonitor`", func() {
+	It("puts the series of all the maps in the same payload", func() {
+		a := metric.MetricsMap{
+			metric.MetricKey{Name: "a"}: metric.MetricValue{Points: []metric.Point{{Value: 9}}},
+		}
+		b := metric.MetricsMap{
+			metric.MetricKey{Name: "b"}: metric.MetricValue{Points: []metric.Point{{Value: 10}}},
+		}
+		result := formatter.Format("some-prefix.", 1024, a, nil, b)
+		Expect(result).To(HaveLen(1))
+
+		payload := Payload{}
+		err := json.Unmarshal(helper.Decompress(result[0]), &payload)
+		Expect(err).To(BeNil())
+		Expect(payload.Series).To(HaveLen(2))
+	})
+
+	It("does not prepend prefix to metrics that already have theirs", func() {
 		m := make(map[metric.MetricKey]metric.MetricValue)
-		m[metric.MetricKey{Name: "bosh.healthmonitor.foo"}] = metric.MetricValue{
+		m[metric.MetricKey{Name: "bosh.healthmonitor.foo", Prefixed: true}] = metric.MetricValue{
 			Points: []metric.Point{{
 				Value: 9,
 			}},
 		}
-		result := formatter.Format("some-prefix", 1024, m)
+		m[metric.MetricKey{Name: "bar"}] = metric.MetricValue{
+			Points: []metric.Point{{
+				Value: 9,
+			}},
+		}
+		result := formatter.Format("some-prefix.", 1024, m)
 
 		Expect(string(helper.Decompress(result[0]))).To(ContainSubstring(`"metric":"bosh.healthmonitor.foo"`))
+		Expect(string(helper.Decompress(result[0]))).To(ContainSubstring(`"metric":"some-prefix.bar"`))
 	})
 
 	It("drops metrics that have a NAN value", func() {
 		m := make(map[metric.MetricKey]metric.MetricValue)
-		m[metric.MetricKey{Name: "bosh.healthmonitor.foo"}] = metric.MetricValue{
+		m[metric.MetricKey{Name: "bosh.healthmonitor.foo", Prefixed: true}] = metric.MetricValue{
 			Points: []metric.Point{{
 				Value: 9,
 			}, {
@@ -137,4 +188,49 @@ var _ = Describe("Formatter", func() {
 		Expect(s2.Host).To(Equal("some.host"))
 		Expect(s2.Tags).To(Equal([]string{"some:tag", "other:tag"}))
 	})
+
+	Context("logs", func() {
+		It("does not return empty data", func() {
+			result := formatter.FormatLogs(1024, nil)
+			Expect(result).To(HaveLen(0))
+		})
+
+		It("compresses logs with zlib", func() {
+			result := formatter.FormatLogs(1024, []logs.LogMessage{{
+				Message:   "hello",
+				Status:    "info",
+				Timestamp: 1000,
+				Hostname:  "some.host",
+				Service:   "some-app",
+				Source:    "cloudfoundry",
+				Tags:      []string{"some:tag", "other:tag"},
+			}})
+			Expect(result).To(HaveLen(1))
+			Expect(string(helper.Decompress(result[0]))).To(Equal(`[{"message":"hello","status":"info","timestamp":1000,` +
+				`"hostname":"some.host","service":"some-app","ddsource":"cloudfoundry","ddtags":"some:tag,other:tag"}]`))
+		})
+
+		It("splits logs that exceed maxPostBytes", func() {
+			logMessages := []logs.LogMessage{}
+			for i := 0; i < 10; i++ {
+				logMessages = append(logMessages, logs.LogMessage{Message: "hello"})
+			}
+			result := formatter.FormatLogs(1, logMessages)
+			Expect(result).To(HaveLen(10))
+
+			var decoded []logs.LogMessage
+			err := json.Unmarshal(helper.Decompress(result[0]), &decoded)
+			Expect(err).To(BeNil())
+			Expect(decoded).To(Equal([]logs.LogMessage{{Message: "hello"}}))
+		})
+
+		It("splits logs that exceed the maximum number of logs per payload", func() {
+			logMessages := []logs.LogMessage{}
+			for i := 0; i < 1500; i++ {
+				logMessages = append(logMessages, logs.LogMessage{Message: "hello"})
+			}
+			result := formatter.FormatLogs(10240, logMessages)
+			Expect(result).To(HaveLen(2))
+		})
+	})
 })
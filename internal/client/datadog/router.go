@@ -0,0 +1,80 @@
+package datadog
+
+import (
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+type route struct {
+	orgs   map[string]bool
+	spaces map[string]bool
+}
+
+func (r route) matches(tenant *metric.Tenant) bool {
+	if len(r.orgs) > 0 && !r.orgs[tenant.OrgName] && !r.orgs[tenant.OrgID] {
+		return false
+	}
+	if len(r.spaces) > 0 && !r.spaces[tenant.SpaceName] && !r.spaces[tenant.SpaceID] {
+		return false
+	}
+	return true
+}
+
+// Router splits the metrics between the platform account and the accounts of the app metrics routes
+type Router struct {
+	routes []route
+}
+
+// NewRouter creates a router for the app metrics routes of the config
+func NewRouter(routes []config.MetricsRoute) *Router {
+	r := &Router{}
+	for _, cfgRoute := range routes {
+		rt := route{
+			orgs:   map[string]bool{},
+			spaces: map[string]bool{},
+		}
+		for _, org := range cfgRoute.Orgs {
+			rt.orgs[org] = true
+		}
+		for _, space := range cfgRoute.Spaces {
+			rt.spaces[space] = true
+		}
+		r.routes = append(r.routes, rt)
+	}
+	return r
+}
+
+// Route returns the index of the first route matching the metric, -1 when it goes to the platform account
+func (r *Router) Route(value metric.MetricValue) int {
+	if value.Tenant == nil {
+		return -1
+	}
+	for i, rt := range r.routes {
+		if rt.matches(value.Tenant) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Split returns the metrics of the platform account and the metrics of each route
+// Infra metrics and app metrics matching no route go to the platform account
+func (r *Router) Split(metrics metric.MetricsMap) (metric.MetricsMap, []metric.MetricsMap) {
+	if len(r.routes) == 0 {
+		return metrics, nil
+	}
+
+	platform := make(metric.MetricsMap, len(metrics))
+	routed := make([]metric.MetricsMap, len(r.routes))
+	for i := range routed {
+		routed[i] = make(metric.MetricsMap)
+	}
+	for k, v := range metrics {
+		if i := r.Route(v); i >= 0 {
+			routed[i][k] = v
+		} else {
+			platform[k] = v
+		}
+	}
+	return platform, routed
+}
@@ -0,0 +1,65 @@
+package datadog
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+var _ = Describe("Router", func() {
+	var (
+		router   *Router
+		payments = &metric.Tenant{OrgName: "payments", OrgID: "org-1", SpaceName: "prod", SpaceID: "space-1"}
+		search   = &metric.Tenant{OrgName: "search", OrgID: "org-2", SpaceName: "staging", SpaceID: "space-2"}
+		other    = &metric.Tenant{OrgName: "other", OrgID: "org-3", SpaceName: "prod", SpaceID: "space-3"}
+	)
+
+	BeforeEach(func() {
+		router = NewRouter([]config.MetricsRoute{
+			{Name: "payments", Orgs: []string{"payments"}},
+			{Name: "search-staging", Orgs: []string{"org-2"}, Spaces: []string{"staging"}},
+			{Name: "space", Spaces: []string{"space-3"}},
+		})
+	})
+
+	It("routes app metrics by org or space name or GUID", func() {
+		Expect(router.Route(metric.MetricValue{Tenant: payments})).To(Equal(0))
+		Expect(router.Route(metric.MetricValue{Tenant: search})).To(Equal(1))
+		Expect(router.Route(metric.MetricValue{Tenant: other})).To(Equal(2))
+	})
+
+	It("requires both the org and the space to match", func() {
+		tenant := &metric.Tenant{OrgName: "search", OrgID: "org-2", SpaceName: "prod", SpaceID: "space-4"}
+		Expect(router.Route(metric.MetricValue{Tenant: tenant})).To(Equal(-1))
+	})
+
+	It("sends infra metrics to the platform account", func() {
+		Expect(router.Route(metric.MetricValue{})).To(Equal(-1))
+	})
+
+	It("splits the metrics between the platform account and the routes", func() {
+		metrics := metric.MetricsMap{
+			metric.MetricKey{Name: "infra"}:    metric.MetricValue{},
+			metric.MetricKey{Name: "payments"}: metric.MetricValue{Tenant: payments},
+			metric.MetricKey{Name: "search"}:   metric.MetricValue{Tenant: search},
+		}
+		platform, routed := router.Split(metrics)
+		Expect(platform).To(HaveLen(1))
+		Expect(platform).To(HaveKey(metric.MetricKey{Name: "infra"}))
+		Expect(routed).To(HaveLen(3))
+		Expect(routed[0]).To(HaveKey(metric.MetricKey{Name: "payments"}))
+		Expect(routed[1]).To(HaveKey(metric.MetricKey{Name: "search"}))
+		Expect(routed[2]).To(BeEmpty())
+	})
+
+	It("doesn't copy the metrics without routes", func() {
+		metrics := metric.MetricsMap{
+			metric.MetricKey{Name: "app"}: metric.MetricValue{Tenant: payments},
+		}
+		platform, routed := NewRouter(nil).Split(metrics)
+		Expect(platform).To(HaveLen(1))
+		Expect(routed).To(BeNil())
+	})
+})
@@ -0,0 +1,152 @@
+package datadog
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/cloudfoundry/gosteno"
+)
+
+// Sender posts the metrics of one endpoint from its own goroutine,
+// so that a slow or failing endpoint doesn't delay the flushes of the other ones
+type Sender struct {
+	client        *Client
+	queue         chan []metric.MetricsMap
+	queueLock     sync.Mutex // serializes Send so that dropping the oldest batch can't block
+	stopped       bool       // set by Stop under queueLock, the batches sent afterwards are dropped
+	done          chan struct{}
+	log           *gosteno.Logger
+	lastLatencyMs uint64 // modified by the sender goroutine, read by the nozzle
+	errors        uint64 // modified by the sender goroutine, read by the nozzle
+	sent          uint64 // modified by the sender goroutine, read by the nozzle
+	dropped       uint64
+}
+
+// NewSender creates a sender for client, at most queueSize batches of metrics wait to be posted
+func NewSender(client *Client, queueSize uint32, log *gosteno.Logger) *Sender {
+	if queueSize == 0 {
+		queueSize = 1
+	}
+	return &Sender{
+		client: client,
+		queue:  make(chan []metric.MetricsMap, queueSize),
+		done:   make(chan struct{}),
+		log:    log,
+	}
+}
+
+// NewSenders creates and starts a sender for each client
+func NewSenders(clients []*Client, queueSize uint32, log *gosteno.Logger) []*Sender {
+	senders := make([]*Sender, 0, len(clients))
+	for _, client := range clients {
+		sender := NewSender(client, queueSize, log)
+		sender.Start()
+		senders = append(senders, sender)
+	}
+	return senders
+}
+
+// Start starts posting the queued batches
+func (s *Sender) Start() {
+	go s.run()
+}
+
+func (s *Sender) run() {
+	defer close(s.done)
+	for metrics := range s.queue {
+		start := time.Now()
+		err := s.client.PostMetrics(metrics...)
+		atomic.StoreUint64(&s.lastLatencyMs, uint64(time.Since(start)/time.Millisecond))
+		if err != nil {
+			atomic.AddUint64(&s.errors, 1)
+			s.log.Errorf("Error posting metrics to %s: %s\n\n", s.client.apiURL, err)
+			continue
+		}
+		atomic.AddUint64(&s.sent, uint64(seriesCount(metrics)))
+	}
+}
+
+// Send queues a batch of metrics without blocking, the oldest batch is spooled when the queue is full,
+// or dropped when the client has no spool. The batch is made of the metrics of all the maps, which are shared with the other senders
+// and must not be modified.
+func (s *Sender) Send(metrics ...metric.MetricsMap) {
+	if oldest := s.push(metrics); oldest != nil && !s.client.spoolBatch(oldest...) {
+		atomic.AddUint64(&s.dropped, 1)
+		s.log.Warnf("Send queue of %s is full, dropping the oldest batch of metrics", s.client.apiURL)
+	}
+}
+
+// push queues the batch, and returns the oldest batch when it was taken out of the queue to make room for it
+func (s *Sender) push(metrics []metric.MetricsMap) []metric.MetricsMap {
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+
+	if s.stopped {
+		atomic.AddUint64(&s.dropped, 1)
+		s.log.Warnf("Sender of %s is stopped, dropping a batch of metrics", s.client.apiURL)
+		return nil
+	}
+
+	select {
+	case s.queue <- metrics:
+		return nil
+	default:
+	}
+
+	var oldest []metric.MetricsMap
+	select {
+	case oldest = <-s.queue:
+	default:
+	}
+	// Only Send pushes to the queue, so there is room for the batch now
+	s.queue <- metrics
+	return oldest
+}
+
+// Stop posts the batches left in the queue and waits for the sender to finish, at most timeout
+func (s *Sender) Stop(timeout time.Duration) {
+	s.queueLock.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.queue)
+	}
+	s.queueLock.Unlock()
+
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+		s.log.Warnf("Could not post the metrics left for %s after %s", s.client.apiURL, timeout)
+	}
+}
+
+// Client returns the client used to post the metrics
+func (s *Sender) Client() *Client {
+	return s.client
+}
+
+// Backlog returns the number of batches waiting to be posted
+func (s *Sender) Backlog() int {
+	return len(s.queue)
+}
+
+// LastLatencyMs returns how long the last batch took to be posted, in milliseconds
+func (s *Sender) LastLatencyMs() uint64 {
+	return atomic.LoadUint64(&s.lastLatencyMs)
+}
+
+// Errors returns the number of batches that could not be posted
+func (s *Sender) Errors() uint64 {
+	return atomic.LoadUint64(&s.errors)
+}
+
+// Sent returns the number of series posted by the sender
+func (s *Sender) Sent() uint64 {
+	return atomic.LoadUint64(&s.sent)
+}
+
+// Dropped returns the number of batches dropped because the queue was full or the sender stopped
+func (s *Sender) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
@@ -0,0 +1,154 @@
+package datadog
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/test/helper"
+)
+
+var _ = Describe("Sender", func() {
+	var (
+		log     *gosteno.Logger
+		release chan struct{}
+		slow    *httptest.Server
+		fast    *httptest.Server
+		posted  chan string
+	)
+
+	newTestClient := func(url string) *Client {
+		return New(url, "dummykey", "datadog.nozzle.", "test-deployment", "dummy-ip",
+			5*time.Second, 2*time.Second, 2000, log, []string{}, nil)
+	}
+
+	batch := func(name string) metric.MetricsMap {
+		return metric.MetricsMap{
+			metric.MetricKey{Name: name}: metric.MetricValue{
+				Points: []metric.Point{{Timestamp: 1, Value: 1}},
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		log = gosteno.NewLogger("sender test")
+		release = make(chan struct{})
+		posted = make(chan string, 10)
+		slow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			posted <- "slow"
+		}))
+		fast = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			posted <- "fast"
+		}))
+	})
+
+	AfterEach(func() {
+		slow.Close()
+		fast.Close()
+	})
+
+	It("doesn't let a slow endpoint delay the other ones", func() {
+		senders := NewSenders([]*Client{newTestClient(slow.URL), newTestClient(fast.URL)}, 2, log)
+		for _, sender := range senders {
+			sender.Send(batch("metric"))
+		}
+
+		Eventually(posted).Should(Receive(Equal("fast")))
+		Consistently(posted, 100*time.Millisecond).ShouldNot(Receive())
+
+		close(release)
+		Eventually(posted).Should(Receive(Equal("slow")))
+		for _, sender := range senders {
+			sender.Stop(time.Second)
+		}
+		Expect(senders[0].Errors()).To(BeEquivalentTo(0))
+		Expect(senders[0].LastLatencyMs()).To(BeNumerically(">=", 100))
+	})
+
+	It("drops the oldest batch when the queue is full", func() {
+		sender := NewSender(newTestClient(slow.URL), 2, log)
+		sender.Send(batch("a"))
+		sender.Send(batch("b"))
+		sender.Send(batch("c"))
+		Expect(sender.Backlog()).To(Equal(2))
+		Expect(sender.Dropped()).To(BeEquivalentTo(1))
+
+		close(release)
+		sender.Start()
+		sender.Stop(time.Second)
+		Expect(posted).To(HaveLen(2))
+		Expect(sender.Backlog()).To(Equal(0))
+		Expect(sender.Sent()).To(BeEquivalentTo(2))
+	})
+
+	It("spools the oldest batch when the queue is full and a spool is configured", func() {
+		dir, err := ioutil.TempDir("", "spool")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+		client := newTestClient(slow.URL)
+		client.spool, err = NewSpool(dir, 1024*1024, time.Hour, log)
+		Expect(err).To(BeNil())
+
+		sender := NewSender(client, 1, log)
+		sender.Send(batch("a"))
+		sender.Send(batch("b"))
+		Expect(sender.Backlog()).To(Equal(1))
+		Expect(sender.Dropped()).To(BeEquivalentTo(0))
+		Expect(client.Spool().Len()).To(Equal(1))
+		close(release)
+	})
+
+	It("posts the metrics of all the maps of a batch", func() {
+		bodies := make(chan []byte, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies <- body
+		}))
+		defer server.Close()
+
+		sender := NewSender(newTestClient(server.URL), 2, log)
+		sender.Start()
+		sender.Send(batch("shared"), batch("internal"))
+		sender.Stop(time.Second)
+
+		var payloads []string
+		for len(bodies) > 0 {
+			payloads = append(payloads, string(helper.Decompress(<-bodies)))
+		}
+		Expect(strings.Join(payloads, "")).To(ContainSubstring(`"metric":"datadog.nozzle.shared"`))
+		Expect(strings.Join(payloads, "")).To(ContainSubstring(`"metric":"datadog.nozzle.internal"`))
+	})
+
+	It("drops the batches sent after it is stopped", func() {
+		sender := NewSender(newTestClient(fast.URL), 2, log)
+		sender.Start()
+		sender.Stop(time.Second)
+
+		Expect(func() { sender.Send(batch("a")) }).NotTo(Panic())
+		Expect(sender.Dropped()).To(BeEquivalentTo(1))
+		Expect(posted).To(BeEmpty())
+	})
+
+	It("counts the batches that could not be posted", func() {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer failing.Close()
+
+		sender := NewSender(newTestClient(failing.URL), 2, log)
+		sender.Start()
+		sender.Send(batch("a"))
+		sender.Stop(time.Second)
+		Expect(sender.Errors()).To(BeEquivalentTo(1))
+		Expect(sender.Sent()).To(BeEquivalentTo(0))
+	})
+})
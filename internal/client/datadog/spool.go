@@ -0,0 +1,234 @@
+package datadog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+)
+
+const spoolFileSuffix = ".payload"
+
+type spoolFile struct {
+	name    string
+	size    uint64
+	created time.Time
+}
+
+// Spool is a bounded, disk backed FIFO queue of payloads that failed to be posted
+type Spool struct {
+	dir      string
+	maxBytes uint64
+	maxAge   time.Duration
+	lock     sync.Mutex
+	replay   sync.Mutex  // serializes the replays, which send without holding lock
+	files    []spoolFile // oldest first
+	size     uint64
+	seq      uint64
+	log      *gosteno.Logger
+}
+
+// NewSpool creates a spool in dir, payloads left in dir by a previous run are kept
+func NewSpool(dir string, maxBytes uint64, maxAge time.Duration, log *gosteno.Logger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating spool directory %s: %v", dir, err)
+	}
+
+	s := &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		log:      log,
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool directory %s: %v", dir, err)
+	}
+	for _, entry := range entries {
+		// Leftovers of a write interrupted by a crash
+		if strings.HasSuffix(entry.Name(), spoolFileSuffix+".tmp") {
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		created, ok := parseSpoolFileName(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+		s.files = append(s.files, spoolFile{
+			name:    entry.Name(),
+			size:    uint64(entry.Size()),
+			created: created,
+		})
+		s.size += uint64(entry.Size())
+	}
+	// File names start with a fixed width timestamp so they sort in creation order
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].name < s.files[j].name })
+	if len(s.files) > 0 {
+		log.Infof("Found %d spooled payloads (%d bytes) in %s", len(s.files), s.size, dir)
+	}
+
+	return s, nil
+}
+
+// EndpointSpoolDir returns the directory used to spool the payloads of one endpoint and account
+func EndpointSpoolDir(baseDir string, apiURL string, apiKey string) string {
+	hash := sha256.Sum256([]byte(apiURL + "|" + apiKey))
+	return filepath.Join(baseDir, hex.EncodeToString(hash[:8]))
+}
+
+// Push writes a payload at the end of the spool, dropping the oldest payloads when the spool is full
+func (s *Spool) Push(payload []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	size := uint64(len(payload))
+	if size > s.maxBytes {
+		return fmt.Errorf("payload of %d bytes exceeds the spool size of %d bytes", size, s.maxBytes)
+	}
+
+	now := time.Now()
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", now.UnixNano(), s.seq%1000000, spoolFileSuffix)
+	// Write to a temporary file first so that a crash never leaves a truncated payload behind
+	tmpPath := filepath.Join(s.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmpPath, payload, 0600); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing spooled payload: %v", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing spooled payload: %v", err)
+	}
+
+	s.files = append(s.files, spoolFile{name: name, size: size, created: now})
+	s.size += size
+	for s.size > s.maxBytes {
+		s.log.Warnf("Spool %s is full, dropping oldest payload", s.dir)
+		s.removeOldest()
+	}
+
+	return nil
+}
+
+// Replay sends the spooled payloads in order and removes the ones that were sent, at most maxPayloads of them
+// when it is positive. It stops at the first payload send fails on and returns that error, the payload is kept
+// for the next replay. The payloads are sent without holding the lock so that Push doesn't wait for the network.
+func (s *Spool) Replay(send func([]byte) error, maxPayloads int) error {
+	s.replay.Lock()
+	defer s.replay.Unlock()
+
+	s.lock.Lock()
+	s.dropExpired()
+	s.lock.Unlock()
+	for sent := 0; maxPayloads <= 0 || sent < maxPayloads; sent++ {
+		file, payload, ok := s.head()
+		if !ok {
+			return nil
+		}
+		if err := send(payload); err != nil {
+			return err
+		}
+		s.lock.Lock()
+		s.remove(file.name)
+		s.lock.Unlock()
+	}
+	return nil
+}
+
+// head returns the oldest readable payload, the unreadable ones are dropped
+func (s *Spool) head() (spoolFile, []byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.files) > 0 {
+		file := s.files[0]
+		payload, err := ioutil.ReadFile(filepath.Join(s.dir, file.name))
+		if err == nil {
+			return file, payload, true
+		}
+		s.log.Errorf("Error reading spooled payload %s, dropping it: %v", file.name, err)
+		s.removeOldest()
+	}
+	return spoolFile{}, nil, false
+}
+
+// Len returns the number of spooled payloads
+func (s *Spool) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.files)
+}
+
+// Size returns the number of bytes used by the spooled payloads
+func (s *Spool) Size() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+func (s *Spool) dropExpired() {
+	if s.maxAge <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-s.maxAge)
+	dropped := 0
+	for len(s.files) > 0 && s.files[0].created.Before(deadline) {
+		s.removeOldest()
+		dropped++
+	}
+	if dropped > 0 {
+		s.log.Warnf("Dropped %d spooled payloads older than %s from %s", dropped, s.maxAge, s.dir)
+	}
+}
+
+func (s *Spool) removeOldest() {
+	s.removeAt(0)
+}
+
+// remove removes the payload named name, if a full spool didn't drop it already
+func (s *Spool) remove(name string) {
+	for i, file := range s.files {
+		if file.name == name {
+			s.removeAt(i)
+			return
+		}
+	}
+}
+
+func (s *Spool) removeAt(i int) {
+	file := s.files[i]
+	if err := os.Remove(filepath.Join(s.dir, file.name)); err != nil && !os.IsNotExist(err) {
+		s.log.Errorf("Error removing spooled payload %s: %v", file.name, err)
+	}
+	if i == 0 {
+		s.files = s.files[1:]
+	} else {
+		s.files = append(s.files[:i], s.files[i+1:]...)
+	}
+	s.size -= file.size
+}
+
+func parseSpoolFileName(name string) (time.Time, bool) {
+	if !strings.HasSuffix(name, spoolFileSuffix) {
+		return time.Time{}, false
+	}
+	parts := strings.SplitN(strings.TrimSuffix(name, spoolFileSuffix), "-", 2)
+	if len(parts) != 2 {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
@@ -0,0 +1,165 @@
+package datadog
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Spool", func() {
+	var (
+		dir   string
+		spool *Spool
+		log   *gosteno.Logger
+	)
+
+	replayAll := func(s *Spool) []string {
+		sent := []string{}
+		err := s.Replay(func(payload []byte) error {
+			sent = append(sent, string(payload))
+			return nil
+		}, 0)
+		Expect(err).To(BeNil())
+		return sent
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spool")
+		Expect(err).To(BeNil())
+		log = gosteno.NewLogger("spool test")
+		spool, err = NewSpool(dir, 1024, time.Hour, log)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("replays payloads in order", func() {
+		Expect(spool.Push([]byte("a"))).To(Succeed())
+		Expect(spool.Push([]byte("b"))).To(Succeed())
+		Expect(spool.Push([]byte("c"))).To(Succeed())
+		Expect(spool.Len()).To(Equal(3))
+		Expect(spool.Size()).To(BeEquivalentTo(3))
+
+		Expect(replayAll(spool)).To(Equal([]string{"a", "b", "c"}))
+		Expect(spool.Len()).To(Equal(0))
+		Expect(spool.Size()).To(BeEquivalentTo(0))
+	})
+
+	It("replays at most the given number of payloads", func() {
+		Expect(spool.Push([]byte("a"))).To(Succeed())
+		Expect(spool.Push([]byte("b"))).To(Succeed())
+		Expect(spool.Push([]byte("c"))).To(Succeed())
+
+		sent := []string{}
+		err := spool.Replay(func(payload []byte) error {
+			sent = append(sent, string(payload))
+			return nil
+		}, 2)
+		Expect(err).To(BeNil())
+		Expect(sent).To(Equal([]string{"a", "b"}))
+		Expect(spool.Len()).To(Equal(1))
+	})
+
+	It("stops replaying at the first failure and keeps the remaining payloads", func() {
+		Expect(spool.Push([]byte("a"))).To(Succeed())
+		Expect(spool.Push([]byte("b"))).To(Succeed())
+
+		sent := []string{}
+		err := spool.Replay(func(payload []byte) error {
+			if string(payload) == "b" {
+				return errors.New("endpoint is down")
+			}
+			sent = append(sent, string(payload))
+			return nil
+		}, 0)
+		Expect(err).NotTo(BeNil())
+		Expect(sent).To(Equal([]string{"a"}))
+		Expect(spool.Len()).To(Equal(1))
+
+		Expect(replayAll(spool)).To(Equal([]string{"b"}))
+	})
+
+	It("accepts payloads while a payload is being sent", func() {
+		spool, err := NewSpool(dir, 10, time.Hour, log)
+		Expect(err).To(BeNil())
+		Expect(spool.Push([]byte("aaaa"))).To(Succeed())
+
+		sent := []string{}
+		err = spool.Replay(func(payload []byte) error {
+			if string(payload) == "aaaa" {
+				// The spool is full, the payload being sent is dropped
+				Expect(spool.Push([]byte("bbbb"))).To(Succeed())
+				Expect(spool.Push([]byte("cccc"))).To(Succeed())
+			}
+			sent = append(sent, string(payload))
+			return nil
+		}, 0)
+		Expect(err).To(BeNil())
+		Expect(sent).To(Equal([]string{"aaaa", "bbbb", "cccc"}))
+		Expect(spool.Len()).To(Equal(0))
+		Expect(spool.Size()).To(BeEquivalentTo(0))
+	})
+
+	It("drops the oldest payloads when full", func() {
+		spool, err := NewSpool(dir, 10, time.Hour, log)
+		Expect(err).To(BeNil())
+		Expect(spool.Push([]byte("aaaa"))).To(Succeed())
+		Expect(spool.Push([]byte("bbbb"))).To(Succeed())
+		Expect(spool.Push([]byte("cccc"))).To(Succeed())
+		Expect(spool.Size()).To(BeEquivalentTo(8))
+
+		Expect(replayAll(spool)).To(Equal([]string{"bbbb", "cccc"}))
+	})
+
+	It("rejects payloads bigger than the spool", func() {
+		spool, err := NewSpool(dir, 2, time.Hour, log)
+		Expect(err).To(BeNil())
+		Expect(spool.Push([]byte("aaaa"))).NotTo(Succeed())
+		Expect(spool.Len()).To(Equal(0))
+	})
+
+	It("drops payloads older than the max age", func() {
+		spool, err := NewSpool(dir, 1024, 10*time.Millisecond, log)
+		Expect(err).To(BeNil())
+		Expect(spool.Push([]byte("a"))).To(Succeed())
+		time.Sleep(20 * time.Millisecond)
+		Expect(spool.Push([]byte("b"))).To(Succeed())
+
+		Expect(replayAll(spool)).To(Equal([]string{"b"}))
+	})
+
+	It("keeps payloads across restarts", func() {
+		Expect(spool.Push([]byte("a"))).To(Succeed())
+		Expect(spool.Push([]byte("b"))).To(Succeed())
+		// Leftover of an interrupted write
+		Expect(ioutil.WriteFile(filepath.Join(dir, "00000000000000000001-000001.payload.tmp"), []byte("x"), 0600)).To(Succeed())
+
+		restarted, err := NewSpool(dir, 1024, time.Hour, log)
+		Expect(err).To(BeNil())
+		Expect(restarted.Len()).To(Equal(2))
+		Expect(replayAll(restarted)).To(Equal([]string{"a", "b"}))
+
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).To(BeNil())
+		Expect(files).To(BeEmpty())
+	})
+
+	It("uses a different directory for each endpoint and account", func() {
+		a := EndpointSpoolDir("/spool", "https://app.datadoghq.com", "key1")
+		b := EndpointSpoolDir("/spool", "https://app.datadoghq.com", "key2")
+		c := EndpointSpoolDir("/spool", "https://app.datadoghq.eu", "key1")
+		Expect(a).To(HavePrefix("/spool/"))
+		Expect(a).NotTo(Equal(b))
+		Expect(a).NotTo(Equal(c))
+		Expect(a).To(Equal(EndpointSpoolDir("/spool", "https://app.datadoghq.com", "key1")))
+	})
+})
@@ -16,42 +16,169 @@ const (
 	defaultIdleTimeoutSeconds          uint32 = 60
 	defaultWorkerTimeoutSeconds        uint32 = 10
 	defaultOrgDataCollectionInterval   uint32 = 600
+	defaultDataDogLogsURL              string = "https://http-intake.logs.datadoghq.com"
+	defaultSpoolMaxBytes               uint32 = 100 * 1024 * 1024
+	defaultSpoolMaxAgeSeconds          uint32 = 3600
+	defaultSendQueueSize               uint32 = 10
+	defaultCardinalityWindowSeconds    uint32 = 3600
+	defaultAggregationShards           int    = 16
+	defaultAppCacheNegativeTTLSeconds  uint32 = 60
+	defaultAuditEventsIntervalSeconds  uint32 = 60
+	defaultLogsBufferSize              uint32 = 100000
+	defaultEventsBufferSize            uint32 = 10000
 )
 
 // Config contains all the config parameters
 type Config struct {
 	// NOTE: When adding new attributes that can be considered secrets,
 	// make sure to mark them for omission when logging config in AsLogString
-	UAAURL                      string
-	Client                      string
-	ClientSecret                string
-	RLPGatewayURL               string
-	FirehoseSubscriptionID      string
-	DataDogURL                  string
-	DataDogAPIKey               string
-	DataDogAdditionalEndpoints  map[string][]string
-	HTTPProxyURL                string
-	HTTPSProxyURL               string
-	NoProxy                     []string
-	CloudControllerEndpoint     string
-	CloudControllerAPIBatchSize uint32
-	DataDogTimeoutSeconds       uint32
-	FlushDurationSeconds        uint32
-	FlushMaxBytes               uint32
-	InsecureSSLSkipVerify       bool
-	MetricPrefix                string
-	Deployment                  string
-	DeploymentFilter            string
-	DisableAccessControl        bool
-	IdleTimeoutSeconds          uint32
-	AppMetrics                  bool
-	NumWorkers                  int
-	NumCacheWorkers             int
-	GrabInterval                int
-	CustomTags                  []string
-	EnvironmentName             string
-	WorkerTimeoutSeconds        uint32
-	OrgDataCollectionInterval   uint32
+	UAAURL                       string
+	Client                       string
+	ClientSecret                 string
+	RLPGatewayURL                string
+	FirehoseSubscriptionID       string
+	DataDogURL                   string
+	DataDogAPIKey                string
+	DataDogAdditionalEndpoints   map[string][]string
+	DataDogPlatformEndpoints     map[string][]string
+	HTTPProxyURL                 string
+	HTTPSProxyURL                string
+	NoProxy                      []string
+	CloudControllerEndpoint      string
+	CloudControllerAPIBatchSize  uint32
+	DataDogTimeoutSeconds        uint32
+	FlushDurationSeconds         uint32
+	FlushMaxBytes                uint32
+	InsecureSSLSkipVerify        bool
+	MetricPrefix                 string
+	Deployment                   string
+	DeploymentFilter             string
+	DisableAccessControl         bool
+	IdleTimeoutSeconds           uint32
+	AppMetrics                   bool
+	TimerMetrics                 bool
+	NumWorkers                   int
+	NumCacheWorkers              int
+	NumAggregationShards         int
+	GrabInterval                 int
+	CustomTags                   []string
+	EnvironmentName              string
+	WorkerTimeoutSeconds         uint32
+	OrgDataCollectionInterval    uint32
+	EnableLogs                   bool
+	DataDogLogsURL               string
+	LogsBufferSize               uint32
+	EnableEvents                 bool
+	EventsBufferSize             uint32
+	CounterTotals                bool
+	SpoolDirectory               string
+	SpoolMaxBytes                uint32
+	SpoolMaxAgeSeconds           uint32
+	SendQueueSize                uint32
+	AppMetricsRoutes             []MetricsRoute
+	MetricsInclude               []MetricsFilterRule
+	MetricsExclude               []MetricsFilterRule
+	TagRules                     []TagRule
+	DisableLegacyMetricNames     bool
+	MetricNameRules              []MetricNameRule
+	CardinalityLimit             uint32
+	CardinalityWindowSeconds     uint32
+	CardinalityRules             []CardinalityRule
+	RollupFunction               string
+	RollupIntervalSeconds        uint32
+	RollupRules                  []RollupRule
+	LateDataPolicy               string
+	MaxTimestampSkewSeconds      uint32
+	ContainerMetricsNamespace    string
+	AppCacheNegativeTTLSeconds   uint32
+	AppCacheFile                 string
+	AppCacheReconcileInterval    int
+	AppCacheWatchIntervalSeconds uint32
+	EnableAuditEvents            bool
+	AuditEventsIntervalSeconds   uint32
+	AuditEventsCursorFile        string
+	AuditEventsInclude           []string
+	AuditEventsExclude           []string
+}
+
+// RollupRule sets the rollup function of the metrics whose name matches Name, it overrides RollupFunction.
+// Function is one of none, last, avg, min, max, sum or count.
+// Name is a glob (`*` and `?`), or a regular expression when written between slashes
+type RollupRule struct {
+	Name     string
+	Function string
+}
+
+// CardinalityRule sets the maximum number of series of the metrics whose name matches Name within a window,
+// it overrides CardinalityLimit for these metrics. A Limit of 0 doesn't limit them.
+// Action is what happens to the new series of a metric over its limit:
+// - reject: the series are dropped (default)
+// - drop_tags: the Tags tags are removed from the series
+// Name is a glob (`*` and `?`), or a regular expression when written between slashes
+type CardinalityRule struct {
+	Name   string
+	Limit  uint32
+	Action string
+	Tags   []string
+}
+
+// MetricNameRule renames the infra metrics whose name matches the Pattern regular expression to Replacement,
+// which can refer to the submatches of Pattern ($1). The first matching rule applies.
+// The metric is also kept under its original name when Alias is set.
+// Prefix replaces the MetricPrefix of the new name when it is set, "" reports it without prefix.
+type MetricNameRule struct {
+	Pattern     string
+	Replacement string
+	Alias       bool
+	Prefix      *string
+}
+
+// DefaultMetricNameRules returns the rules used when MetricNameRules is not set:
+// the `bosh-hm-forwarder` metrics are also reported as `bosh.healthmonitor` metrics without prefix
+func DefaultMetricNameRules() []MetricNameRule {
+	noPrefix := ""
+	return []MetricNameRule{{
+		Pattern:     "^bosh-hm-forwarder",
+		Replacement: "bosh.healthmonitor",
+		Alias:       true,
+		Prefix:      &noPrefix,
+	}}
+}
+
+// TagRule rewrites the tags of the metrics, the rules are applied in order. Action is one of:
+// - drop: removes the Tag tags
+// - rename: renames the Tag tags to Target
+// - add: adds a Tag tag with Value
+// - replace: replaces the values of the Tag tags matching the Pattern regular expression with Replacement
+// - map: replaces the values of the Tag tags found in Mapping with their mapped value
+type TagRule struct {
+	Action      string
+	Tag         string
+	Target      string
+	Value       string
+	Pattern     string
+	Replacement string
+	Mapping     map[string]string
+}
+
+// MetricsFilterRule matches the metrics for which every set field matches
+// Patterns are globs (`*` and `?`), or regular expressions when written between slashes: `/^gorouter\./`
+type MetricsFilterRule struct {
+	Name       string
+	Origin     string
+	Job        string
+	Deployment string
+	Tags       map[string]string
+}
+
+// MetricsRoute sends the app metrics of the matching orgs and spaces to their own Datadog account
+// Orgs and Spaces contain names or GUIDs, a route matches an app when both lists are empty or contain its org and space
+type MetricsRoute struct {
+	Name          string
+	Orgs          []string
+	Spaces        []string
+	DataDogURL    string
+	DataDogAPIKey string
 }
 
 // AsLogString returns a string representation of the config that is safe to log (no secrets)
@@ -72,11 +199,18 @@ func (c *Config) AsLogString() (string, error) {
 			asMap[attr] = "*****"
 		}
 	}
-	if addKeys, ok := asMap["DataDogAdditionalEndpoints"]; ok && addKeys != nil {
-		for _, v := range addKeys.(map[string]interface{}) {
-			keyList := v.([]interface{})
-			for i := range keyList {
-				keyList[i] = "*****"
+	if routes, ok := asMap["AppMetricsRoutes"].([]interface{}); ok {
+		for _, route := range routes {
+			route.(map[string]interface{})["DataDogAPIKey"] = "*****"
+		}
+	}
+	for _, attr := range []string{"DataDogAdditionalEndpoints", "DataDogPlatformEndpoints"} {
+		if addKeys, ok := asMap[attr]; ok && addKeys != nil {
+			for _, v := range addKeys.(map[string]interface{}) {
+				keyList := v.([]interface{})
+				for i := range keyList {
+					keyList[i] = "*****"
+				}
 			}
 		}
 	}
@@ -108,7 +242,7 @@ func Parse(configPath string) (*Config, error) {
 	overrideWithEnvVar("NOZZLE_FIREHOSESUBSCRIPTIONID", &config.FirehoseSubscriptionID)
 	overrideWithEnvVar("NOZZLE_DATADOGURL", &config.DataDogURL)
 	overrideWithEnvVar("NOZZLE_DATADOGAPIKEY", &config.DataDogAPIKey)
-	//NOTE: Override of DataDogAdditionalEndpoints not supported
+	//NOTE: Override of DataDogAdditionalEndpoints and DataDogPlatformEndpoints not supported
 
 	overrideWithEnvVar("HTTP_PROXY", &config.HTTPProxyURL)
 	overrideWithEnvVar("HTTPS_PROXY", &config.HTTPSProxyURL)
@@ -129,6 +263,38 @@ func Parse(configPath string) (*Config, error) {
 	overrideWithEnvUint32("NOZZLE_WORKERTIMEOUTSECONDS", &config.WorkerTimeoutSeconds)
 	overrideWithEnvSliceStrings("NO_PROXY", &config.NoProxy)
 	overrideWithEnvVar("NOZZLE_ENVIRONMENT_NAME", &config.EnvironmentName)
+	overrideWithEnvBool("NOZZLE_TIMER_METRICS", &config.TimerMetrics)
+	overrideWithEnvBool("NOZZLE_ENABLE_LOGS", &config.EnableLogs)
+	overrideWithEnvVar("NOZZLE_DATADOG_LOGS_URL", &config.DataDogLogsURL)
+	overrideWithEnvUint32("NOZZLE_LOGS_BUFFER_SIZE", &config.LogsBufferSize)
+	overrideWithEnvBool("NOZZLE_ENABLE_EVENTS", &config.EnableEvents)
+	overrideWithEnvUint32("NOZZLE_EVENTS_BUFFER_SIZE", &config.EventsBufferSize)
+	overrideWithEnvBool("NOZZLE_COUNTER_TOTALS", &config.CounterTotals)
+	overrideWithEnvVar("NOZZLE_SPOOL_DIRECTORY", &config.SpoolDirectory)
+	overrideWithEnvUint32("NOZZLE_SPOOL_MAX_BYTES", &config.SpoolMaxBytes)
+	overrideWithEnvUint32("NOZZLE_SPOOL_MAX_AGE_SECONDS", &config.SpoolMaxAgeSeconds)
+	overrideWithEnvUint32("NOZZLE_SEND_QUEUE_SIZE", &config.SendQueueSize)
+	overrideWithEnvBool("NOZZLE_DISABLE_LEGACY_METRIC_NAMES", &config.DisableLegacyMetricNames)
+	overrideWithEnvUint32("NOZZLE_CARDINALITY_LIMIT", &config.CardinalityLimit)
+	overrideWithEnvUint32("NOZZLE_CARDINALITY_WINDOW_SECONDS", &config.CardinalityWindowSeconds)
+	overrideWithEnvVar("NOZZLE_ROLLUP_FUNCTION", &config.RollupFunction)
+	overrideWithEnvUint32("NOZZLE_ROLLUP_INTERVAL_SECONDS", &config.RollupIntervalSeconds)
+	overrideWithEnvVar("NOZZLE_LATE_DATA_POLICY", &config.LateDataPolicy)
+	overrideWithEnvUint32("NOZZLE_MAX_TIMESTAMP_SKEW_SECONDS", &config.MaxTimestampSkewSeconds)
+	overrideWithEnvVar("NOZZLE_CONTAINER_METRICS_NAMESPACE", &config.ContainerMetricsNamespace)
+	overrideWithEnvUint32("NOZZLE_APP_CACHE_NEGATIVE_TTL_SECONDS", &config.AppCacheNegativeTTLSeconds)
+	overrideWithEnvVar("NOZZLE_APP_CACHE_FILE", &config.AppCacheFile)
+	overrideWithEnvInt("NOZZLE_APP_CACHE_RECONCILE_INTERVAL", &config.AppCacheReconcileInterval)
+	overrideWithEnvUint32("NOZZLE_APP_CACHE_WATCH_INTERVAL_SECONDS", &config.AppCacheWatchIntervalSeconds)
+	overrideWithEnvBool("NOZZLE_ENABLE_AUDIT_EVENTS", &config.EnableAuditEvents)
+	overrideWithEnvUint32("NOZZLE_AUDIT_EVENTS_INTERVAL_SECONDS", &config.AuditEventsIntervalSeconds)
+	overrideWithEnvVar("NOZZLE_AUDIT_EVENTS_CURSOR_FILE", &config.AuditEventsCursorFile)
+	if os.Getenv("NOZZLE_AUDIT_EVENTS_INCLUDE") != "" {
+		overrideWithEnvSliceStrings("NOZZLE_AUDIT_EVENTS_INCLUDE", &config.AuditEventsInclude)
+	}
+	if os.Getenv("NOZZLE_AUDIT_EVENTS_EXCLUDE") != "" {
+		overrideWithEnvSliceStrings("NOZZLE_AUDIT_EVENTS_EXCLUDE", &config.AuditEventsExclude)
+	}
 
 	if config.MetricPrefix == "" {
 		config.MetricPrefix = "cloudfoundry.nozzle."
@@ -146,6 +312,10 @@ func Parse(configPath string) (*Config, error) {
 		config.NumCacheWorkers = defaultWorkers
 	}
 
+	if config.NumAggregationShards == 0 {
+		config.NumAggregationShards = defaultAggregationShards
+	}
+
 	if config.IdleTimeoutSeconds == 0 {
 		config.IdleTimeoutSeconds = defaultIdleTimeoutSeconds
 	}
@@ -164,8 +334,67 @@ func Parse(configPath string) (*Config, error) {
 		config.OrgDataCollectionInterval = defaultOrgDataCollectionInterval
 	}
 
+	if config.DataDogLogsURL == "" {
+		config.DataDogLogsURL = defaultDataDogLogsURL
+	}
+
+	if config.LogsBufferSize == 0 {
+		config.LogsBufferSize = defaultLogsBufferSize
+	}
+
+	if config.EventsBufferSize == 0 {
+		config.EventsBufferSize = defaultEventsBufferSize
+	}
+
+	if config.SpoolMaxBytes == 0 {
+		config.SpoolMaxBytes = defaultSpoolMaxBytes
+	}
+
+	if config.SpoolMaxAgeSeconds == 0 {
+		config.SpoolMaxAgeSeconds = defaultSpoolMaxAgeSeconds
+	}
+
+	if config.SendQueueSize == 0 {
+		config.SendQueueSize = defaultSendQueueSize
+	}
+
+	if config.CardinalityWindowSeconds == 0 {
+		config.CardinalityWindowSeconds = defaultCardinalityWindowSeconds
+	}
+
+	if config.AppCacheNegativeTTLSeconds == 0 {
+		config.AppCacheNegativeTTLSeconds = defaultAppCacheNegativeTTLSeconds
+	}
+
+	if config.AuditEventsIntervalSeconds == 0 {
+		config.AuditEventsIntervalSeconds = defaultAuditEventsIntervalSeconds
+	}
+
+	// An empty list of rules disables the default ones
+	if config.MetricNameRules == nil {
+		config.MetricNameRules = DefaultMetricNameRules()
+	}
+
+	for i := range config.AppMetricsRoutes {
+		route := &config.AppMetricsRoutes[i]
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route%d", i)
+		}
+		if len(route.Orgs) == 0 && len(route.Spaces) == 0 {
+			return nil, fmt.Errorf("AppMetricsRoutes %s must match at least one org or space", route.Name)
+		}
+		if route.DataDogAPIKey == "" {
+			return nil, fmt.Errorf("AppMetricsRoutes %s must have a DataDogAPIKey", route.Name)
+		}
+		// Routes post to the same site as the platform account by default
+		if route.DataDogURL == "" {
+			route.DataDogURL = config.DataDogURL
+		}
+	}
+
 	overrideWithEnvInt("NOZZLE_NUM_WORKERS", &config.NumWorkers)
 	overrideWithEnvInt("NOZZLE_NUM_CACHE_WORKERS", &config.NumCacheWorkers)
+	overrideWithEnvInt("NOZZLE_NUM_AGGREGATION_SHARDS", &config.NumAggregationShards)
 
 	return &config, nil
 }
@@ -0,0 +1,13 @@
+package events
+
+// Event holds a single event in the format expected by the Datadog events API
+type Event struct {
+	Title          string   `json:"title"`
+	Text           string   `json:"text"`
+	DateHappened   int64    `json:"date_happened,omitempty"` // in seconds
+	Host           string   `json:"host,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+	AlertType      string   `json:"alert_type,omitempty"`
+	SourceTypeName string   `json:"source_type_name,omitempty"`
+	AggregationKey string   `json:"aggregation_key,omitempty"`
+}
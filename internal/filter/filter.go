@@ -0,0 +1,225 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+type result int
+
+const (
+	noMatch result = iota
+	match
+	// unknown means that every field available matched, but some fields of the rule were not available
+	unknown
+)
+
+type rule struct {
+	name       *regexp.Regexp
+	origin     *regexp.Regexp
+	job        *regexp.Regexp
+	deployment *regexp.Regexp
+	tags       map[string]*regexp.Regexp
+}
+
+// Filter keeps or drops metrics according to include and exclude rules.
+// Envelopes are filtered in the workers on their origin, job, deployment and tags,
+// then series are filtered before being posted on their name and tags.
+// Each step only drops the metrics it has enough information about, the others are left to the next step.
+type Filter struct {
+	include []rule
+	exclude []rule
+	prefix  string
+}
+
+// New creates a filter, prefix is the metric prefix added to the series names
+func New(include []config.MetricsFilterRule, exclude []config.MetricsFilterRule, prefix string) (*Filter, error) {
+	f := &Filter{prefix: prefix}
+	var err error
+	if f.include, err = compileRules(include); err != nil {
+		return nil, fmt.Errorf("invalid MetricsInclude rule: %v", err)
+	}
+	if f.exclude, err = compileRules(exclude); err != nil {
+		return nil, fmt.Errorf("invalid MetricsExclude rule: %v", err)
+	}
+	return f, nil
+}
+
+// KeepEnvelope returns whether the metrics of the envelope should be processed
+func (f *Filter) KeepEnvelope(envelope *loggregator_v2.Envelope) bool {
+	if f == nil {
+		return true
+	}
+	return f.keep(func(r rule) result { return r.matchEnvelope(envelope) })
+}
+
+// KeepMetric returns whether the series should be posted
+func (f *Filter) KeepMetric(key metric.MetricKey, value metric.MetricValue) bool {
+	if f == nil {
+		return true
+	}
+	tags := splitTags(value.Tags)
+	return f.keep(func(r rule) result { return r.matchSeries(f.prefix, key.Name, tags) })
+}
+
+// FilterMetrics removes the series that should not be posted from metrics and returns how many were removed
+func (f *Filter) FilterMetrics(metrics metric.MetricsMap) int {
+	if f == nil || (len(f.include) == 0 && len(f.exclude) == 0) {
+		return 0
+	}
+	removed := 0
+	for k, v := range metrics {
+		if !f.KeepMetric(k, v) {
+			delete(metrics, k)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (f *Filter) keep(matches func(rule) result) bool {
+	for _, r := range f.exclude {
+		if matches(r) == match {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, r := range f.include {
+		if matches(r) != noMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// matchEnvelope matches the rule against the envelope, names are only known once the envelope is processed
+func (r rule) matchEnvelope(envelope *loggregator_v2.Envelope) result {
+	envelopeTags := envelope.GetTags()
+	res := match
+	if r.name != nil {
+		res = unknown
+	}
+	fields := []struct {
+		pattern *regexp.Regexp
+		value   string
+	}{
+		{r.origin, envelopeTags["origin"]},
+		{r.job, envelopeTags["job"]},
+		{r.deployment, envelopeTags["deployment"]},
+	}
+	for _, field := range fields {
+		if field.pattern != nil && !field.pattern.MatchString(field.value) {
+			return noMatch
+		}
+	}
+	for name, pattern := range r.tags {
+		if !pattern.MatchString(envelopeTags[name]) {
+			return noMatch
+		}
+	}
+	return res
+}
+
+// matchSeries matches the rule against the name and tags of a series, tags the series doesn't have are unknown
+func (r rule) matchSeries(prefix string, name string, tags map[string][]string) result {
+	if r.name != nil && !r.name.MatchString(name) && !r.name.MatchString(prefix+name) {
+		return noMatch
+	}
+	res := match
+	matchTag := func(pattern *regexp.Regexp, tagName string) bool {
+		values, ok := tags[tagName]
+		if !ok {
+			res = unknown
+			return true
+		}
+		for _, value := range values {
+			if pattern.MatchString(value) {
+				return true
+			}
+		}
+		return false
+	}
+	if r.origin != nil && !matchTag(r.origin, "origin") {
+		return noMatch
+	}
+	if r.job != nil && !matchTag(r.job, "job") {
+		return noMatch
+	}
+	if r.deployment != nil && !matchTag(r.deployment, "deployment") {
+		return noMatch
+	}
+	for tagName, pattern := range r.tags {
+		if !matchTag(pattern, tagName) {
+			return noMatch
+		}
+	}
+	return res
+}
+
+func splitTags(tags []string) map[string][]string {
+	split := make(map[string][]string, len(tags))
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		split[parts[0]] = append(split[parts[0]], parts[1])
+	}
+	return split
+}
+
+func compileRules(cfgRules []config.MetricsFilterRule) ([]rule, error) {
+	var rules []rule
+	for _, cfgRule := range cfgRules {
+		r := rule{tags: map[string]*regexp.Regexp{}}
+		var err error
+		if r.name, err = CompilePattern(cfgRule.Name); err != nil {
+			return nil, err
+		}
+		if r.origin, err = CompilePattern(cfgRule.Origin); err != nil {
+			return nil, err
+		}
+		if r.job, err = CompilePattern(cfgRule.Job); err != nil {
+			return nil, err
+		}
+		if r.deployment, err = CompilePattern(cfgRule.Deployment); err != nil {
+			return nil, err
+		}
+		for name, pattern := range cfgRule.Tags {
+			if r.tags[name], err = CompilePattern(pattern); err != nil {
+				return nil, err
+			}
+		}
+		if r.name == nil && r.origin == nil && r.job == nil && r.deployment == nil && len(r.tags) == 0 {
+			return nil, fmt.Errorf("rule must set at least one of Name, Origin, Job, Deployment or Tags")
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// CompilePattern compiles a glob, or a regular expression when the pattern is written between slashes
+func CompilePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("error compiling regular expression %s: %v", pattern, err)
+		}
+		return re, nil
+	}
+	glob := regexp.QuoteMeta(pattern)
+	glob = strings.Replace(glob, `\*`, ".*", -1)
+	glob = strings.Replace(glob, `\?`, ".", -1)
+	return regexp.Compile("^" + glob + "$")
+}
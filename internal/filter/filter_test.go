@@ -0,0 +1,128 @@
+package filter
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+var _ = Describe("Filter", func() {
+	envelope := func(tags map[string]string) *loggregator_v2.Envelope {
+		return &loggregator_v2.Envelope{
+			Tags: tags,
+			Message: &loggregator_v2.Envelope_Counter{
+				Counter: &loggregator_v2.Counter{Name: "total_requests", Delta: 1},
+			},
+		}
+	}
+
+	series := func(name string, tags ...string) (metric.MetricKey, metric.MetricValue) {
+		return metric.MetricKey{Name: name}, metric.MetricValue{Tags: tags}
+	}
+
+	It("keeps everything without rules", func() {
+		f, err := New(nil, nil, "cloudfoundry.nozzle.")
+		Expect(err).To(BeNil())
+		Expect(f.KeepEnvelope(envelope(map[string]string{"origin": "gorouter"}))).To(BeTrue())
+		Expect(f.KeepMetric(series("gorouter.total_requests"))).To(BeTrue())
+	})
+
+	It("rejects invalid rules", func() {
+		_, err := New([]config.MetricsFilterRule{{Name: "/[/"}}, nil, "")
+		Expect(err).NotTo(BeNil())
+		_, err = New(nil, []config.MetricsFilterRule{{}}, "")
+		Expect(err).NotTo(BeNil())
+	})
+
+	Context("with exclude rules", func() {
+		var f *Filter
+
+		BeforeEach(func() {
+			var err error
+			f, err = New(nil, []config.MetricsFilterRule{
+				{Deployment: "cf-*", Job: "diego_cell"},
+				{Name: "*.latency", Origin: "gorouter"},
+				{Name: "/^cloudfoundry\\.nozzle\\.bosh-hm-forwarder\\./"},
+				{Tags: map[string]string{"source_id": "/^test-/"}},
+			}, "cloudfoundry.nozzle.")
+			Expect(err).To(BeNil())
+		})
+
+		It("drops the envelopes matching a rule", func() {
+			Expect(f.KeepEnvelope(envelope(map[string]string{"deployment": "cf-1234", "job": "diego_cell"}))).To(BeFalse())
+			Expect(f.KeepEnvelope(envelope(map[string]string{"deployment": "cf-1234", "job": "router"}))).To(BeTrue())
+			Expect(f.KeepEnvelope(envelope(map[string]string{"source_id": "test-app"}))).To(BeFalse())
+		})
+
+		It("leaves rules on names to the series", func() {
+			Expect(f.KeepEnvelope(envelope(map[string]string{"origin": "gorouter"}))).To(BeTrue())
+			Expect(f.KeepMetric(series("gorouter.latency", "origin:gorouter"))).To(BeFalse())
+			Expect(f.KeepMetric(series("gorouter.total_requests", "origin:gorouter"))).To(BeTrue())
+			Expect(f.KeepMetric(series("uaa.latency", "origin:uaa"))).To(BeTrue())
+		})
+
+		It("matches names with and without the metric prefix", func() {
+			Expect(f.KeepMetric(series("bosh-hm-forwarder.system.cpu.user"))).To(BeFalse())
+		})
+
+		It("doesn't drop series missing the tags of a rule", func() {
+			Expect(f.KeepMetric(series("app.latency"))).To(BeTrue())
+			Expect(f.KeepMetric(series("app.cpu.pct", "deployment:cf-1234"))).To(BeTrue())
+		})
+
+		It("matches any value of tags set more than once", func() {
+			Expect(f.KeepMetric(series("rep.CapacityTotalMemory", "deployment:cf", "deployment:cf-1234", "job:diego_cell"))).To(BeFalse())
+		})
+
+		It("removes the excluded series", func() {
+			metrics := metric.MetricsMap{}
+			k, v := series("gorouter.latency", "origin:gorouter")
+			metrics[k] = v
+			k, v = series("gorouter.total_requests", "origin:gorouter")
+			metrics[k] = v
+			Expect(f.FilterMetrics(metrics)).To(Equal(1))
+			Expect(metrics).To(HaveLen(1))
+			Expect(metrics).To(HaveKey(metric.MetricKey{Name: "gorouter.total_requests"}))
+		})
+	})
+
+	Context("with include rules", func() {
+		var f *Filter
+
+		BeforeEach(func() {
+			var err error
+			f, err = New([]config.MetricsFilterRule{
+				{Origin: "gorouter"},
+				{Name: "app.*"},
+			}, []config.MetricsFilterRule{
+				{Name: "app.disk.*"},
+			}, "cloudfoundry.nozzle.")
+			Expect(err).To(BeNil())
+		})
+
+		It("only keeps the envelopes that may match a rule", func() {
+			Expect(f.KeepEnvelope(envelope(map[string]string{"origin": "gorouter"}))).To(BeTrue())
+			Expect(f.KeepEnvelope(envelope(map[string]string{"origin": "rep"}))).To(BeTrue())
+		})
+
+		It("only keeps the series matching a rule", func() {
+			Expect(f.KeepMetric(series("gorouter.total_requests", "origin:gorouter"))).To(BeTrue())
+			Expect(f.KeepMetric(series("app.cpu.pct", "app_name:hello"))).To(BeTrue())
+			Expect(f.KeepMetric(series("uaa.requests", "origin:uaa"))).To(BeFalse())
+		})
+
+		It("applies exclude rules first", func() {
+			Expect(f.KeepMetric(series("app.disk.used", "app_name:hello"))).To(BeFalse())
+		})
+
+		It("drops the envelopes that can't match any rule", func() {
+			f, err := New([]config.MetricsFilterRule{{Origin: "gorouter"}}, nil, "")
+			Expect(err).To(BeNil())
+			Expect(f.KeepEnvelope(envelope(map[string]string{"origin": "rep"}))).To(BeFalse())
+		})
+	})
+})
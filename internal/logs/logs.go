@@ -0,0 +1,61 @@
+package logs
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// LogMessage holds a single log line in the format expected by the Datadog logs intake
+type LogMessage struct {
+	Message   string
+	Status    string
+	Timestamp int64 // in milliseconds
+	Hostname  string
+	Service   string
+	Source    string
+	Tags      []string
+}
+
+type intakeLogMessage struct {
+	Message   string `json:"message"`
+	Status    string `json:"status,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Hostname  string `json:"hostname,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Source    string `json:"ddsource,omitempty"`
+	Tags      string `json:"ddtags,omitempty"`
+}
+
+// MarshalJSON serializes the log message, the intake expects tags as a single comma separated string
+func (l LogMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(intakeLogMessage{
+		Message:   l.Message,
+		Status:    l.Status,
+		Timestamp: l.Timestamp,
+		Hostname:  l.Hostname,
+		Service:   l.Service,
+		Source:    l.Source,
+		Tags:      strings.Join(l.Tags, ","),
+	})
+}
+
+// UnmarshalJSON deserializes a log message as sent to the intake
+func (l *LogMessage) UnmarshalJSON(in []byte) error {
+	var msg intakeLogMessage
+	if err := json.Unmarshal(in, &msg); err != nil {
+		return err
+	}
+
+	l.Message = msg.Message
+	l.Status = msg.Status
+	l.Timestamp = msg.Timestamp
+	l.Hostname = msg.Hostname
+	l.Service = msg.Service
+	l.Source = msg.Source
+	l.Tags = nil
+	if msg.Tags != "" {
+		l.Tags = strings.Split(msg.Tags, ",")
+	}
+
+	return nil
+}
@@ -3,6 +3,8 @@ package metric
 import (
 	"errors"
 	"fmt"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
 )
 
 type Point struct {
@@ -32,15 +34,32 @@ func (p *Point) UnmarshalJSON(in []byte) error {
 	return nil
 }
 
+// Metric types supported by the Datadog series API
+const (
+	GaugeType = "gauge"
+	CountType = "count"
+)
+
 type MetricKey struct {
 	Name      string
-	TagsHash  string
+	TagsHash  util.TagsHash
+	Prefixed  bool // Name already has its prefix, the MetricPrefix is not added
 }
 
 type MetricValue struct {
 	Tags   []string
 	Points []Point
 	Host   string
+	Type   string  // defaults to GaugeType when empty
+	Tenant *Tenant // set for app metrics only
+}
+
+// Tenant is the org and space an app metric belongs to, it is used to route the metric to the right account
+type Tenant struct {
+	OrgName   string
+	OrgID     string
+	SpaceName string
+	SpaceID   string
 }
 
 type MetricPackage struct {
@@ -0,0 +1,13 @@
+package metric
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestMetric(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Metric Suite")
+}
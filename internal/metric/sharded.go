@@ -0,0 +1,68 @@
+package metric
+
+import "sync"
+
+// ShardedMap aggregates metrics in shards keyed by MetricKey, each with its own lock,
+// so that concurrent writers rarely wait on each other
+type ShardedMap struct {
+	shards []*shard
+}
+
+type shard struct {
+	lock    sync.Mutex
+	metrics MetricsMap
+}
+
+// NewShardedMap creates a map with numShards shards, at least one
+func NewShardedMap(numShards int) *ShardedMap {
+	if numShards < 1 {
+		numShards = 1
+	}
+	s := &ShardedMap{shards: make([]*shard, numShards)}
+	for i := range s.shards {
+		s.shards[i] = &shard{metrics: make(MetricsMap)}
+	}
+	return s
+}
+
+// Add appends the points of value to the series of key
+func (s *ShardedMap) Add(key MetricKey, value MetricValue) {
+	sh := s.shards[s.index(key)]
+	sh.lock.Lock()
+	sh.metrics.Add(key, value)
+	sh.lock.Unlock()
+}
+
+// Swap replaces the shards with empty ones and returns their metrics in one map
+func (s *ShardedMap) Swap() MetricsMap {
+	swapped := make([]MetricsMap, len(s.shards))
+	total := 0
+	for i, sh := range s.shards {
+		sh.lock.Lock()
+		swapped[i] = sh.metrics
+		// The series are usually the same from one flush to the next
+		sh.metrics = make(MetricsMap, len(swapped[i]))
+		sh.lock.Unlock()
+		total += len(swapped[i])
+	}
+
+	merged := make(MetricsMap, total)
+	for _, metrics := range swapped {
+		for k, v := range metrics {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// index returns the shard of the key with a FNV-1a hash of its name mixed with its tags hash
+func (s *ShardedMap) index(key MetricKey) int {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key.Name); i++ {
+		h ^= uint64(key.Name[i])
+		h *= 1099511628211
+	}
+	h ^= key.TagsHash.Hi ^ key.TagsHash.Lo
+	h ^= h >> 32
+	return int(h % uint64(len(s.shards)))
+}
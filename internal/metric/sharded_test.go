@@ -0,0 +1,88 @@
+package metric
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+)
+
+var _ = Describe("ShardedMap", func() {
+	It("aggregates the points of each series and swaps the shards", func() {
+		s := NewShardedMap(4)
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					s.Add(MetricKey{Name: fmt.Sprintf("metric.%d", i%10), TagsHash: util.HashTags([]string{"foo:bar"})}, MetricValue{
+						Points: []Point{{Timestamp: int64(i), Value: 1}},
+					})
+				}
+			}()
+		}
+		wg.Wait()
+
+		metrics := s.Swap()
+		Expect(metrics).To(HaveLen(10))
+		for _, v := range metrics {
+			Expect(v.Points).To(HaveLen(80))
+		}
+		Expect(s.Swap()).To(BeEmpty())
+	})
+
+	It("has at least one shard", func() {
+		s := NewShardedMap(0)
+		s.Add(MetricKey{Name: "foo"}, MetricValue{})
+		Expect(s.Swap()).To(HaveLen(1))
+	})
+})
+
+// lockedMap is the single map and mutex the metrics were aggregated in before ShardedMap
+type lockedMap struct {
+	lock    sync.Mutex
+	metrics MetricsMap
+}
+
+func (l *lockedMap) Add(key MetricKey, value MetricValue) {
+	l.lock.Lock()
+	l.metrics.Add(key, value)
+	l.lock.Unlock()
+}
+
+func benchmarkKeys() []MetricKey {
+	keys := make([]MetricKey, 10000)
+	for i := range keys {
+		keys[i] = MetricKey{Name: fmt.Sprintf("metric.%d", i%100), TagsHash: util.HashTags([]string{fmt.Sprintf("id:%d", i)})}
+	}
+	return keys
+}
+
+func benchmarkAdd(b *testing.B, add func(MetricKey, MetricValue)) {
+	keys := benchmarkKeys()
+	value := MetricValue{Points: []Point{{Timestamp: 1, Value: 1}}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			add(keys[i%len(keys)], value)
+			i++
+		}
+	})
+}
+
+func BenchmarkLockedMapAdd(b *testing.B) {
+	l := &lockedMap{metrics: make(MetricsMap)}
+	benchmarkAdd(b, l.Add)
+}
+
+func BenchmarkShardedMapAdd(b *testing.B) {
+	s := NewShardedMap(16)
+	benchmarkAdd(b, s.Add)
+}
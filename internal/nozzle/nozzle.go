@@ -5,12 +5,19 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/DataDog/datadog-firehose-nozzle/internal/auditcollector"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/cardinality"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/client/cloudfoundry"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/client/datadog"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/events"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/filter"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/orgcollector"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/processor"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/processor/parser"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/rollup"
 	"github.com/cloudfoundry/gosteno"
 
 	"code.cloudfoundry.org/go-loggregator"
@@ -23,25 +30,47 @@ type Nozzle struct {
 	messages              chan *loggregator_v2.Envelope
 	authTokenFetcher      AuthTokenFetcher
 	ddClients             []*datadog.Client
+	senders               []*datadog.Sender
+	router                *datadog.Router
+	filter                *filter.Filter
+	limiter               *cardinality.Limiter
+	rollup                *rollup.Rollup
+	timestampPolicy       *parser.TimestampPolicy
 	processor             *processor.Processor
 	cfClient              *cloudfoundry.CFClient
 	loggregatorClient     *cloudfoundry.LoggregatorClient
 	processedMetrics      chan []metric.MetricPackage
+	processedLogs         chan logs.LogMessage
+	processedEvents       chan events.Event
 	orgCollector          *orgcollector.OrgCollector
+	auditCollector        *auditcollector.AuditCollector
 	log                   *gosteno.Logger
 	parseAppMetricsEnable bool
 	stopper               chan bool
 	workersStopper        chan bool
-	mapLock               sync.RWMutex
-	metricsMap            metric.MetricsMap // modified by workers & main thread
-	totalMessagesReceived uint64            // modified by workers, read by main thread
-	slowConsumerAlert     uint64            // modified by workers, read by main thread
-	totalMetricsSent      uint64
+	metrics               *metric.ShardedMap // modified by workers & main thread
+	numReaders            int
+	totalMessagesReceived uint64 // modified by workers, read by main thread
+	slowConsumerAlert     uint64 // modified by workers, read by main thread
+	logsLock              sync.Mutex
+	logsBuffer            []logs.LogMessage      // modified by workers & main thread
+	logsQueue             chan []logs.LogMessage // batches of logs waiting to be posted by the logs sender
+	logsSenderDone        chan struct{}
+	totalLogsSent         uint64 // modified by the logs sender, read by main thread
+	totalLogsDropped      uint64 // modified by workers & main thread
+	eventsLock            sync.Mutex
+	eventsBuffer          []events.Event      // modified by workers & main thread
+	eventsQueue           chan []events.Event // batches of events waiting to be posted by the events sender
+	eventsSenderDone      chan struct{}
+	totalEventsSent       uint64 // modified by the events sender, read by main thread
+	totalEventsDropped    uint64 // modified by workers & main thread
 }
 
 // AuthTokenFetcher is an interface for fetching an auth token from uaa
 type AuthTokenFetcher interface {
-	FetchAuthToken() string
+	FetchAuthToken() (string, error)
+	RefreshAuthToken() (string, error)
+	FailureCount() uint64
 }
 
 // NewNozzle creates a new nozzle
@@ -49,8 +78,10 @@ func NewNozzle(config *config.Config, tokenFetcher AuthTokenFetcher, log *gosten
 	return &Nozzle{
 		config:                config,
 		authTokenFetcher:      tokenFetcher,
-		metricsMap:            make(metric.MetricsMap),
+		metrics:               metric.NewShardedMap(config.NumAggregationShards),
 		processedMetrics:      make(chan []metric.MetricPackage, 1000),
+		processedLogs:         make(chan logs.LogMessage, 1000),
+		processedEvents:       make(chan events.Event, 1000),
 		log:                   log,
 		parseAppMetricsEnable: config.AppMetrics,
 		stopper:               make(chan bool),
@@ -63,10 +94,14 @@ func NewNozzle(config *config.Config, tokenFetcher AuthTokenFetcher, log *gosten
 func (n *Nozzle) Start() error {
 	n.log.Info("Starting DataDog Firehose Nozzle...")
 
-	// Fetch Authentication Token
-	var authToken string
+	// Fetch Authentication Token, the token fetcher keeps it fresh afterwards
+	// If the UAA is unavailable the nozzle keeps starting, the token is fetched again when connecting to the gateway
+	var tokenFetcher cloudfoundry.AuthTokenFetcher
 	if !n.config.DisableAccessControl {
-		authToken = n.authTokenFetcher.FetchAuthToken()
+		if _, err := n.authTokenFetcher.FetchAuthToken(); err != nil {
+			n.log.Errorf("Failed to fetch an auth token, will retry when connecting to the RLP gateway: %s", err.Error())
+		}
+		tokenFetcher = n.authTokenFetcher
 	}
 
 	// Fetch Custom Tags
@@ -76,17 +111,80 @@ func (n *Nozzle) Start() error {
 
 	n.log.Info("Starting DataDog Firehose Nozzle...")
 
-	// Initialize Datadog client instances
+	// Initialize the metrics filter
 	var err error
+	n.filter, err = filter.New(n.config.MetricsInclude, n.config.MetricsExclude, n.config.MetricPrefix)
+	if err != nil {
+		return err
+	}
+
+	// Initialize the cardinality limits
+	n.limiter, err = cardinality.New(n.config.CardinalityLimit, n.config.CardinalityWindowSeconds, n.config.CardinalityRules,
+		n.config.NumAggregationShards, n.log)
+	if err != nil {
+		return err
+	}
+
+	// Initialize the rollup of the points before they are posted
+	n.rollup, err = rollup.New(n.config.RollupFunction, n.config.RollupIntervalSeconds, n.config.RollupRules, n.log)
+	if err != nil {
+		return err
+	}
+
+	// Initialize Datadog client instances
 	n.ddClients, err = datadog.NewClients(n.config, n.log)
 	if err != nil {
 		return err
 	}
+	// Each endpoint posts its metrics from its own goroutine
+	n.senders = datadog.NewSenders(n.ddClients, n.config.SendQueueSize, n.log)
+	// Logs and events are posted from their own goroutines as well, so that their intakes don't delay the flushes
+	n.startLogsAndEventsSenders()
+	n.router = datadog.NewRouter(n.config.AppMetricsRoutes)
 
 	// Initialize Cloud Foundry client instance
 	n.cfClient, err = cloudfoundry.NewClient(n.config, n.log)
 
+	// Initialize the tag rules
+	tagRewriter, err := parser.NewTagRewriter(n.config.TagRules)
+	if err != nil {
+		return err
+	}
+
+	// Initialize the metric name rules
+	renamer, err := parser.NewRenamer(!n.config.DisableLegacyMetricNames, n.config.MetricNameRules)
+	if err != nil {
+		return err
+	}
+
+	// Initialize the policy of the late and future metrics
+	n.timestampPolicy, err = parser.NewTimestampPolicy(n.config.LateDataPolicy, n.config.MaxTimestampSkewSeconds)
+	if err != nil {
+		return err
+	}
+
 	// Initialize Firehose processor
+	options := processor.ProcessorOptions{
+		TimerMetrics:    n.config.TimerMetrics,
+		CounterTotals:   n.config.CounterTotals,
+		TagRewriter:     tagRewriter,
+		Renamer:         renamer,
+		TimestampPolicy: n.timestampPolicy,
+		App: parser.AppParserOptions{
+			ContainerMetricsNamespace: n.config.ContainerMetricsNamespace,
+			NegativeTTL:               time.Duration(n.config.AppCacheNegativeTTLSeconds) * time.Second,
+			CacheFile:                 n.config.AppCacheFile,
+			ReconcileInterval:         n.config.AppCacheReconcileInterval,
+			WatchInterval:             time.Duration(n.config.AppCacheWatchIntervalSeconds) * time.Second,
+		},
+	}
+	// Log and event envelopes are only processed when their pipeline is enabled
+	if n.config.EnableLogs {
+		options.Logs = n.processedLogs
+	}
+	if n.config.EnableEvents {
+		options.Events = n.processedEvents
+	}
 	n.processor, n.parseAppMetricsEnable = processor.NewProcessor(
 		n.processedMetrics,
 		n.config.CustomTags,
@@ -95,7 +193,8 @@ func (n *Nozzle) Start() error {
 		n.cfClient,
 		n.config.NumCacheWorkers,
 		n.config.GrabInterval,
-		n.log)
+		n.log,
+		options)
 
     n.orgCollector, err = orgcollector.NewOrgCollector(
 		n.config,
@@ -112,14 +211,33 @@ func (n *Nozzle) Start() error {
 		n.orgCollector.Start()
 	}
 
+	if n.config.EnableAuditEvents {
+		if n.config.EnableEvents {
+			n.auditCollector, err = auditcollector.NewAuditCollector(
+				n.config,
+				n.processedEvents,
+				n.log,
+				n.config.CustomTags,
+			)
+			if err != nil {
+				n.log.Warnf("Failed to initialize the audit events collector, audit events will not be available: %s", err.Error())
+			}
+		} else {
+			n.log.Warnf("EnableAuditEvents needs EnableEvents, audit events will not be available")
+		}
+	}
+	if n.auditCollector != nil {
+		n.auditCollector.Start()
+	}
+
 	// Initialize the firehose consumer (with retry enable)
-	err = n.startFirehoseConsumer(authToken)
+	err = n.startFirehoseConsumer(tokenFetcher)
 	if err != nil {
 		return err
 	}
 
 	// Start multiple workers to parallelize firehose events (event.envelope) transformation into processedMetrics
-	// and then grouped into metricsMap
+	// and then grouped into the metrics shards
 	n.startWorkers()
 
 	// Execute infinite loop.
@@ -137,15 +255,22 @@ func (n *Nozzle) Start() error {
 	if n.orgCollector != nil {
 		n.orgCollector.Stop()
 	}
-	// Submit metrics left in cache if any
+	// Stop auditCollector
+	if n.auditCollector != nil {
+		n.auditCollector.Stop()
+	}
+	// Submit metrics, logs and events left in cache if any
 	n.postMetrics()
+	n.queueLogs()
+	n.queueEvents()
+	n.stopSenders()
 
 	return err
 }
 
-func (n *Nozzle) startFirehoseConsumer(authToken string) error {
+func (n *Nozzle) startFirehoseConsumer(tokenFetcher cloudfoundry.AuthTokenFetcher) error {
 	var err error
-	n.loggregatorClient, err = cloudfoundry.NewLoggregatorClient(n.config, n.log, authToken)
+	n.loggregatorClient, err = cloudfoundry.NewLoggregatorClient(n.config, n.log, tokenFetcher)
 	if err != nil {
 		return err
 	}
@@ -175,8 +300,10 @@ func (n *Nozzle) run() error {
 	for {
 		select {
 		case <-ticker.C:
-			// Submit metrics to Datadog
+			// Submit metrics, logs and events to Datadog
 			n.postMetrics()
+			n.queueLogs()
+			n.queueEvents()
 		case <-n.stopper:
 			return nil
 		}
@@ -192,39 +319,302 @@ func (n *Nozzle) Stop() {
 
 // PostMetrics posts metrics do to datadog
 func (n *Nozzle) postMetrics() {
-	n.mapLock.Lock()
-	// deep copy the metrics map to pass to PostMetrics so that we can unlock n.metricsMap while posting
-	metricsMap := make(metric.MetricsMap)
-	for k, v := range n.metricsMap {
-		metricsMap[k] = v
+	// Take the metrics of the shards and replace them so that workers keep aggregating while posting
+	metricsMap := n.metrics.Swap()
+	totalMessagesReceived := atomic.LoadUint64(&n.totalMessagesReceived)
+
+	// Add the http timer metrics aggregated since the last flush and the metrics of the apps across their instances,
+	// they are limited like the other series
+	flushed := append(n.processor.FlushTimerMetrics(), n.processor.FlushAppMetrics()...)
+	for _, m := range flushed {
+		if key, value, ok := n.limiter.Admit(*m.MetricKey, *m.MetricValue); ok {
+			metricsMap.Add(key, value)
+		}
 	}
-	totalMessagesReceived := n.totalMessagesReceived
-	// Reset the map
-	n.metricsMap = make(metric.MetricsMap)
-	n.mapLock.Unlock()
+
+	// Drop the series excluded by the filter rules before formatting them
+	n.filter.FilterMetrics(metricsMap)
+	// Reduce the points of each series to the ones of the rollup interval
+	n.rollup.Apply(metricsMap)
+
+	// App metrics of the orgs and spaces with a route only go to the account of the route
+	platformMetrics, routedMetrics := n.router.Split(metricsMap)
+	limited := n.limiter.Limited()
+	latePoints, futurePoints := n.timestampPolicy.Late(), n.timestampPolicy.Future()
+	cacheStats, hasAppCache := n.processor.AppCacheStats()
 
 	timestamp := time.Now().Unix()
-	for _, client := range n.ddClients {
+	for _, sender := range n.senders {
+		if route := sender.Client().Route(); route >= 0 {
+			sender.Send(routedMetrics[route])
+			continue
+		}
+
+		// The platform metrics are shared by the senders, each one gets its own map of internal metrics
+		clientMetrics := make(metric.MetricsMap, 32)
+
 		// Add internal metrics
+		client := sender.Client()
 		k, v := client.MakeInternalMetric("totalMessagesReceived", totalMessagesReceived, timestamp)
-		metricsMap[k] = v
-		k, v = client.MakeInternalMetric("totalMetricsSent", n.totalMetricsSent, timestamp)
-		metricsMap[k] = v
+		clientMetrics[k] = v
 		k, v = client.MakeInternalMetric("slowConsumerAlert", atomic.LoadUint64(&n.slowConsumerAlert), timestamp)
-		metricsMap[k] = v
+		clientMetrics[k] = v
+		if !n.config.DisableAccessControl {
+			k, v = client.MakeInternalMetric("uaaTokenFetchFailures", n.authTokenFetcher.FailureCount(), timestamp)
+			clientMetrics[k] = v
+		}
+		if n.config.EnableLogs {
+			k, v = client.MakeInternalMetric("totalLogsSent", atomic.LoadUint64(&n.totalLogsSent), timestamp)
+			clientMetrics[k] = v
+			k, v = client.MakeInternalMetric("totalLogsDropped", atomic.LoadUint64(&n.totalLogsDropped), timestamp)
+			clientMetrics[k] = v
+		}
+		if n.config.EnableEvents {
+			k, v = client.MakeInternalMetric("totalEventsSent", atomic.LoadUint64(&n.totalEventsSent), timestamp)
+			clientMetrics[k] = v
+			k, v = client.MakeInternalMetric("totalEventsDropped", atomic.LoadUint64(&n.totalEventsDropped), timestamp)
+			clientMetrics[k] = v
+		}
+		if spool := client.Spool(); spool != nil {
+			k, v = client.MakeInternalMetric("spooledPayloads", uint64(spool.Len()), timestamp)
+			clientMetrics[k] = v
+		}
+		for name, count := range limited {
+			k, v = client.MakeInternalMetric("cardinalityLimitedSeries", count, timestamp, "limited_metric:"+name)
+			clientMetrics[k] = v
+		}
+		if hasAppCache {
+			k, v = client.MakeInternalMetric("appCacheSize", uint64(cacheStats.Size), timestamp)
+			clientMetrics[k] = v
+			k, v = client.MakeInternalMetric("appCacheHits", cacheStats.Hits, timestamp)
+			clientMetrics[k] = v
+			k, v = client.MakeInternalMetric("appCacheMisses", cacheStats.Misses, timestamp)
+			clientMetrics[k] = v
+		}
+		if n.timestampPolicy != nil {
+			k, v = client.MakeInternalMetric("latePoints", latePoints, timestamp)
+			clientMetrics[k] = v
+			k, v = client.MakeInternalMetric("futurePoints", futurePoints, timestamp)
+			clientMetrics[k] = v
+		}
+		// Sender metrics describe the endpoint they are posted to,
+		// the ones of the app metrics routes are posted to the platform accounts with a route tag
+		addSenderMetrics(clientMetrics, client, sender, timestamp)
+		for _, routeSender := range n.senders {
+			if routeSender.Client().Route() >= 0 {
+				addSenderMetrics(clientMetrics, client, routeSender, timestamp, "route:"+routeSender.Client().RouteName())
+			}
+		}
 
-		err := client.PostMetrics(metricsMap)
-		// NOTE: We don't need to have a retry logic since we don't return error on failure.
-		// However, current metrics may be lost.
-		if err != nil {
-			n.log.Errorf("Error posting metrics: %s\n\n", err)
+		// NOTE: Posting errors are logged and counted by the sender, current metrics may be lost.
+		batch := []metric.MetricsMap{platformMetrics, clientMetrics}
+		// The additional endpoints mirror the platform account and the accounts of the routes
+		if client.AllRoutes() {
+			batch = append(batch, routedMetrics...)
 		}
+		sender.Send(batch...)
 	}
 
-	n.totalMetricsSent += uint64(len(metricsMap))
 	n.ResetSlowConsumerError()
 }
 
+func addSenderMetrics(metricsMap metric.MetricsMap, client *datadog.Client, sender *datadog.Sender, timestamp int64, extraTags ...string) {
+	// Only the series posted successfully by the sender are counted as sent
+	k, v := client.MakeInternalMetric("totalMetricsSent", sender.Sent(), timestamp, extraTags...)
+	metricsMap[k] = v
+	k, v = client.MakeInternalMetric("postMetricsLatencyMs", sender.LastLatencyMs(), timestamp, extraTags...)
+	metricsMap[k] = v
+	k, v = client.MakeInternalMetric("postMetricsErrors", sender.Errors(), timestamp, extraTags...)
+	metricsMap[k] = v
+	k, v = client.MakeInternalMetric("postMetricsBacklog", uint64(sender.Backlog()), timestamp, extraTags...)
+	metricsMap[k] = v
+	k, v = client.MakeInternalMetric("postMetricsDropped", sender.Dropped(), timestamp, extraTags...)
+	metricsMap[k] = v
+}
+
+// stopSenders waits for the senders to post the metrics, logs and events left in their queue
+func (n *Nozzle) stopSenders() {
+	timeout := time.Duration(n.config.FlushDurationSeconds) * time.Second
+	var wg sync.WaitGroup
+	for _, sender := range n.senders {
+		wg.Add(1)
+		go func(sender *datadog.Sender) {
+			defer wg.Done()
+			sender.Stop(timeout)
+		}(sender)
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n.stopLogsSender(timeout)
+	}()
+	go func() {
+		defer wg.Done()
+		n.stopEventsSender(timeout)
+	}()
+	wg.Wait()
+}
+
+// startLogsAndEventsSenders starts the goroutines posting the logs and the events when they are enabled,
+// at most SendQueueSize batches of each wait to be posted
+func (n *Nozzle) startLogsAndEventsSenders() {
+	if n.config.EnableLogs {
+		n.logsQueue = make(chan []logs.LogMessage, n.config.SendQueueSize)
+		n.logsSenderDone = make(chan struct{})
+		go n.sendLogs()
+	}
+	if n.config.EnableEvents {
+		n.eventsQueue = make(chan []events.Event, n.config.SendQueueSize)
+		n.eventsSenderDone = make(chan struct{})
+		go n.sendEvents()
+	}
+}
+
+// queueLogs hands the buffered logs to the logs sender without blocking, the oldest batch is dropped when its queue is full
+func (n *Nozzle) queueLogs() {
+	if n.logsQueue == nil {
+		return
+	}
+
+	n.logsLock.Lock()
+	logMessages := n.logsBuffer
+	n.logsBuffer = nil
+	n.logsLock.Unlock()
+
+	if len(logMessages) == 0 {
+		return
+	}
+
+	select {
+	case n.logsQueue <- logMessages:
+		return
+	default:
+	}
+
+	select {
+	case dropped := <-n.logsQueue:
+		atomic.AddUint64(&n.totalLogsDropped, uint64(len(dropped)))
+		n.log.Warnf("Logs queue is full, dropping the oldest %d logs", len(dropped))
+	default:
+	}
+	// Only the main thread pushes to the queue, so there is room for the batch now
+	n.logsQueue <- logMessages
+}
+
+// sendLogs posts the queued logs until the queue is closed
+func (n *Nozzle) sendLogs() {
+	defer close(n.logsSenderDone)
+	for logMessages := range n.logsQueue {
+		n.postLogs(logMessages)
+	}
+}
+
+// stopLogsSender waits for the logs sender to post the logs left in its queue, at most timeout
+func (n *Nozzle) stopLogsSender(timeout time.Duration) {
+	if n.logsQueue == nil {
+		return
+	}
+	close(n.logsQueue)
+	select {
+	case <-n.logsSenderDone:
+	case <-time.After(timeout):
+		n.log.Warnf("Could not post the logs left after %s", timeout)
+	}
+}
+
+// postLogs posts the logs to datadog
+func (n *Nozzle) postLogs(logMessages []logs.LogMessage) {
+	failed := false
+	for _, client := range n.ddClients {
+		err := client.PostLogs(logMessages)
+		if err != nil {
+			n.log.Errorf("Error posting logs: %s\n\n", err)
+			failed = true
+		}
+	}
+
+	// Logs are not spooled, the ones that could not be posted are lost and counted as dropped
+	if failed {
+		atomic.AddUint64(&n.totalLogsDropped, uint64(len(logMessages)))
+		return
+	}
+	atomic.AddUint64(&n.totalLogsSent, uint64(len(logMessages)))
+}
+
+// queueEvents hands the buffered events to the events sender without blocking, the oldest batch is dropped when its queue is full
+func (n *Nozzle) queueEvents() {
+	if n.eventsQueue == nil {
+		return
+	}
+
+	n.eventsLock.Lock()
+	eventsToPost := n.eventsBuffer
+	n.eventsBuffer = nil
+	n.eventsLock.Unlock()
+
+	if len(eventsToPost) == 0 {
+		return
+	}
+
+	select {
+	case n.eventsQueue <- eventsToPost:
+		return
+	default:
+	}
+
+	select {
+	case dropped := <-n.eventsQueue:
+		atomic.AddUint64(&n.totalEventsDropped, uint64(len(dropped)))
+		n.log.Warnf("Events queue is full, dropping the oldest %d events", len(dropped))
+	default:
+	}
+	// Only the main thread pushes to the queue, so there is room for the batch now
+	n.eventsQueue <- eventsToPost
+}
+
+// sendEvents posts the queued events until the queue is closed
+func (n *Nozzle) sendEvents() {
+	defer close(n.eventsSenderDone)
+	for eventsToPost := range n.eventsQueue {
+		n.postEvents(eventsToPost)
+	}
+}
+
+// stopEventsSender waits for the events sender to post the events left in its queue, at most timeout
+func (n *Nozzle) stopEventsSender(timeout time.Duration) {
+	if n.eventsQueue == nil {
+		return
+	}
+	close(n.eventsQueue)
+	select {
+	case <-n.eventsSenderDone:
+	case <-time.After(timeout):
+		n.log.Warnf("Could not post the events left after %s", timeout)
+	}
+}
+
+// postEvents posts the events to datadog
+func (n *Nozzle) postEvents(eventsToPost []events.Event) {
+	// Only the events posted to every account are counted as sent
+	sent := len(eventsToPost)
+	for _, client := range n.ddClients {
+		// The accounts of the app metrics routes only get their app metrics
+		if client.Route() >= 0 {
+			continue
+		}
+		posted, err := client.PostEvents(eventsToPost)
+		// NOTE: Same as metrics, events may be lost on failure.
+		if err != nil {
+			n.log.Errorf("Error posting events: %s\n\n", err)
+		}
+		if posted < sent {
+			sent = posted
+		}
+	}
+
+	atomic.AddUint64(&n.totalEventsSent, uint64(sent))
+}
+
 func (n *Nozzle) keepMessage(envelope *loggregator_v2.Envelope) bool {
 	deployment, _ := envelope.GetTags()["deployment"]
 	return n.config.DeploymentFilter == "" || n.config.DeploymentFilter == deployment
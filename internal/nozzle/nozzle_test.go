@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 
 	"github.com/DataDog/datadog-firehose-nozzle/internal/client/datadog"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/uaatokenfetcher"
 	"github.com/DataDog/datadog-firehose-nozzle/test/helper"
@@ -126,7 +129,7 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			var payload datadog.Payload
 			err := json.Unmarshal(helper.Decompress(contents), &payload)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(payload.Series).To(HaveLen(25)) // +3 is because of the internal metrics, +2 because of org metrics
+			Expect(payload.Series).To(HaveLen(30)) // +8 is because of the internal metrics, +2 because of org metrics
 		}, 2)
 
 		It("gets a valid authentication token", func() {
@@ -170,7 +173,7 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			var payload datadog.Payload
 			err := json.Unmarshal(helper.Decompress(contents), &payload)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(payload.Series).To(HaveLen(25))
+			Expect(payload.Series).To(HaveLen(30))
 
 			validateMetrics(payload, 11, 0) // +1 for total messages because of Org Quota
 
@@ -178,9 +181,9 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			Eventually(fakeDatadogAPI.ReceivedContents, 15*time.Second, time.Second).Should(Receive(&contents))
 			err = json.Unmarshal(helper.Decompress(contents), &payload)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(payload.Series).To(HaveLen(3)) // only internal metrics
+			Expect(payload.Series).To(HaveLen(8)) // only internal metrics
 
-			validateMetrics(payload, 11, 25)
+			validateMetrics(payload, 11, 30)
 		}, 3)
 
 		Context("receives a rlp.dropped value metric", func() {
@@ -457,6 +460,69 @@ var _ = Describe("Datadog Firehose Nozzle", func() {
 			Expect(err).To(BeNil())
 		})
 	})
+
+	Context("when the logs sender falls behind", func() {
+		It("drops the oldest batch of logs without blocking the flush", func() {
+			nozzle = &Nozzle{
+				config:    &config.Config{EnableLogs: true},
+				log:       log,
+				logsQueue: make(chan []logs.LogMessage, 1),
+			}
+			nozzle.logsBuffer = []logs.LogMessage{{Message: "first"}, {Message: "second"}}
+			nozzle.queueLogs()
+			nozzle.logsBuffer = []logs.LogMessage{{Message: "third"}}
+			nozzle.queueLogs()
+
+			Expect(nozzle.totalLogsDropped).To(BeEquivalentTo(2))
+			Expect(nozzle.logsBuffer).To(BeEmpty())
+			var logMessages []logs.LogMessage
+			Expect(nozzle.logsQueue).To(Receive(&logMessages))
+			Expect(logMessages).To(Equal([]logs.LogMessage{{Message: "third"}}))
+		})
+
+		It("drops the oldest logs a chunk at a time when the buffer is full", func() {
+			nozzle = &Nozzle{
+				config:         &config.Config{EnableLogs: true, LogsBufferSize: 20},
+				log:            log,
+				processedLogs:  make(chan logs.LogMessage),
+				workersStopper: make(chan bool),
+			}
+			go nozzle.readProcessedMetrics()
+			for i := 0; i < 21; i++ {
+				nozzle.processedLogs <- logs.LogMessage{Message: fmt.Sprintf("log-%d", i)}
+			}
+			nozzle.workersStopper <- true
+
+			Expect(nozzle.totalLogsDropped).To(BeEquivalentTo(2))
+			Expect(nozzle.logsBuffer).To(HaveLen(19))
+			Expect(nozzle.logsBuffer[0].Message).To(Equal("log-2"))
+			Expect(nozzle.logsBuffer[18].Message).To(Equal("log-20"))
+		})
+
+		It("counts the logs that could not be posted as dropped", func() {
+			failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			}))
+			defer failing.Close()
+
+			configuration = &config.Config{
+				DataDogURL:            failing.URL,
+				DataDogAPIKey:         "1234567890",
+				DataDogLogsURL:        failing.URL,
+				DataDogTimeoutSeconds: 1,
+				FlushDurationSeconds:  1,
+				FlushMaxBytes:         10240,
+				EnableLogs:            true,
+			}
+			clients, err := datadog.NewClients(configuration, log)
+			Expect(err).To(BeNil())
+			nozzle = &Nozzle{config: configuration, log: log, ddClients: clients}
+
+			nozzle.postLogs([]logs.LogMessage{{Message: "first"}, {Message: "second"}})
+			Expect(nozzle.totalLogsDropped).To(BeEquivalentTo(2))
+			Expect(nozzle.totalLogsSent).To(BeEquivalentTo(0))
+		})
+	})
 })
 
 func findSlowConsumerMetric(payload datadog.Payload) *metric.Series {
@@ -485,6 +551,7 @@ func validateMetrics(payload datadog.Payload, totalMessagesReceived int, totalMe
 	totalMessagesReceivedFound := false
 	totalMetricsSentFound := false
 	slowConsumerAlertFound := false
+	uaaTokenFetchFailuresFound := false
 	for _, metric := range payload.Series {
 		Expect(metric.Type).To(Equal("gauge"))
 
@@ -505,6 +572,11 @@ func validateMetrics(payload datadog.Payload, totalMessagesReceived int, totalMe
 			internalMetric = true
 			metricValue = 0
 		}
+		if metric.Metric == "datadog.nozzle.uaaTokenFetchFailures" {
+			uaaTokenFetchFailuresFound = true
+			internalMetric = true
+			metricValue = 0
+		}
 
 		if internalMetric {
 			Expect(metric.Points).To(HaveLen(1))
@@ -517,4 +589,5 @@ func validateMetrics(payload datadog.Payload, totalMessagesReceived int, totalMe
 	Expect(totalMessagesReceivedFound).To(BeTrue())
 	Expect(totalMetricsSentFound).To(BeTrue())
 	Expect(slowConsumerAlertFound).To(BeTrue())
+	Expect(uaaTokenFetchFailuresFound).To(BeTrue())
 }
@@ -1,6 +1,7 @@
 package nozzle
 
 import (
+	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
@@ -10,15 +11,19 @@ func (d *Nozzle) startWorkers() {
 	// Start the (multiple) workers which will process envelopes,
 	// create metricPackages and send them to p.processedMetrics channel
 	// NOTE: Worker are used to process infra or app event envelopes to metricPackages
-	d.log.Infof("Starting processed metrics reader and %d workers...", d.config.NumWorkers)
+	// Start as many readers, which will read from the p.processedMetrics channel and store metrics as they're generated
+	// into the shards of d.metrics
+	d.numReaders = d.config.NumWorkers
+	if d.numReaders < 1 {
+		d.numReaders = 1
+	}
+	d.log.Infof("Starting %d processed metrics readers and %d workers...", d.numReaders, d.config.NumWorkers)
 	for i := 0; i < d.config.NumWorkers; i++ {
 		go d.work()
 	}
-
-	// Start the (one) worker which will read from the p.processedMetrics channel and store metrics as they're generated
-	// into d.metricsMap
-	// NOTE: This step is not parallelized and should part of another class
-	go d.readProcessedMetrics()
+	for i := 0; i < d.numReaders; i++ {
+		go d.readProcessedMetrics()
+	}
 }
 
 func (d *Nozzle) stopWorkers() {
@@ -26,14 +31,15 @@ func (d *Nozzle) stopWorkers() {
 	d.processor.StopAppMetrics()
 
 	timedOut := false
-	for i := 0; i < d.config.NumWorkers+1; i++ {
-		// +1 is for the readProcessedMetrics worker
+	numWorkers := d.config.NumWorkers + d.numReaders
+	for i := 0; i < numWorkers; i++ {
+		// the readProcessedMetrics workers are stopped as well
 		select {
 		case d.workersStopper <- true:
 		case <-time.After(time.Duration(d.config.WorkerTimeoutSeconds) * time.Second):
 			// No worker responded in time to get the stop message
 			// Assuming they crashed
-			d.log.Warnf("Could not stop %d workers after %ds", d.config.NumWorkers+1-i, d.config.WorkerTimeoutSeconds)
+			d.log.Warnf("Could not stop %d workers after %ds", numWorkers-i, d.config.WorkerTimeoutSeconds)
 			timedOut = true
 		}
 		if timedOut {
@@ -51,7 +57,17 @@ func (d *Nozzle) work() {
 				continue
 			}
 			d.handleMessage(envelope)
-			d.processor.ProcessMetric(envelope)
+			switch envelope.GetMessage().(type) {
+			case *loggregator_v2.Envelope_Log:
+				d.processor.ProcessLog(envelope)
+			case *loggregator_v2.Envelope_Event:
+				d.processor.ProcessEvent(envelope)
+			default:
+				// Filter rules are checked again on the series names once the envelope is processed
+				if d.filter.KeepEnvelope(envelope) {
+					d.processor.ProcessMetric(envelope)
+				}
+			}
 		case <-d.workersStopper:
 			d.log.Info("Worker shutting down...")
 			return
@@ -64,12 +80,33 @@ func (d *Nozzle) readProcessedMetrics() {
 	for {
 		select {
 		case pkg := <-d.processedMetrics:
-			d.mapLock.Lock()
-			d.totalMessagesReceived++
+			atomic.AddUint64(&d.totalMessagesReceived, 1)
 			for _, m := range pkg {
-				d.metricsMap.Add(*m.MetricKey, *m.MetricValue)
+				// Series over the cardinality limit of their metric are rejected or lose some tags
+				if key, value, ok := d.limiter.Admit(*m.MetricKey, *m.MetricValue); ok {
+					d.metrics.Add(key, value)
+				}
+			}
+		case logMessage := <-d.processedLogs:
+			d.logsLock.Lock()
+			// The oldest logs are dropped when the logs can't be posted as fast as they come,
+			// a chunk at a time so that the buffer isn't copied for every new log
+			if d.config.LogsBufferSize > 0 && uint32(len(d.logsBuffer)) >= d.config.LogsBufferSize {
+				drop := dropChunk(len(d.logsBuffer))
+				d.logsBuffer = d.logsBuffer[:copy(d.logsBuffer, d.logsBuffer[drop:])]
+				atomic.AddUint64(&d.totalLogsDropped, uint64(drop))
 			}
-			d.mapLock.Unlock()
+			d.logsBuffer = append(d.logsBuffer, logMessage)
+			d.logsLock.Unlock()
+		case event := <-d.processedEvents:
+			d.eventsLock.Lock()
+			if d.config.EventsBufferSize > 0 && uint32(len(d.eventsBuffer)) >= d.config.EventsBufferSize {
+				drop := dropChunk(len(d.eventsBuffer))
+				d.eventsBuffer = d.eventsBuffer[:copy(d.eventsBuffer, d.eventsBuffer[drop:])]
+				atomic.AddUint64(&d.totalEventsDropped, uint64(drop))
+			}
+			d.eventsBuffer = append(d.eventsBuffer, event)
+			d.eventsLock.Unlock()
 		case <-d.workersStopper:
 			d.log.Info("Processed metrics reader shutting down...")
 			return
@@ -77,6 +114,14 @@ func (d *Nozzle) readProcessedMetrics() {
 	}
 }
 
+// dropChunk returns how many of the oldest entries of a full buffer of size entries are dropped at once
+func dropChunk(size int) int {
+	if drop := size / 10; drop > 1 {
+		return drop
+	}
+	return 1
+}
+
 func (d *Nozzle) handleMessage(envelope *loggregator_v2.Envelope) {
 	switch envelope.GetMessage().(type) {
 	case *loggregator_v2.Envelope_Counter:
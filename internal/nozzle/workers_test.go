@@ -0,0 +1,77 @@
+package nozzle
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cloudfoundry/gosteno"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/cardinality"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+)
+
+// benchmarkReaders times the processed metrics readers, from the channel to the aggregation shards,
+// with the cardinality limiter split in limiterShards shards, 0 disables it
+func benchmarkReaders(b *testing.B, limiterShards int) {
+	log := gosteno.NewLogger("benchmark")
+	n := &Nozzle{
+		config:           &config.Config{NumWorkers: 8},
+		metrics:          metric.NewShardedMap(16),
+		processedMetrics: make(chan []metric.MetricPackage, 1000),
+		workersStopper:   make(chan bool),
+		log:              log,
+	}
+	if limiterShards > 0 {
+		var err error
+		n.limiter, err = cardinality.New(100000, 3600, nil, limiterShards, log)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// Packages of 10 series of 100 metrics, as the infra parser creates them
+	pkgs := make([][]metric.MetricPackage, 1000)
+	for i := range pkgs {
+		for j := 0; j < 10; j++ {
+			tags := []string{fmt.Sprintf("id:%d", i%100)}
+			key := metric.MetricKey{Name: fmt.Sprintf("metric.%d", (i+j)%100), TagsHash: util.HashTags(tags)}
+			value := metric.MetricValue{Tags: tags, Points: []metric.Point{{Timestamp: 1, Value: 1}}}
+			pkgs[i] = append(pkgs[i], metric.MetricPackage{MetricKey: &key, MetricValue: &value})
+		}
+	}
+
+	n.numReaders = n.config.NumWorkers
+	for i := 0; i < n.numReaders; i++ {
+		go n.readProcessedMetrics()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.processedMetrics <- pkgs[i%len(pkgs)]
+	}
+	for atomic.LoadUint64(&n.totalMessagesReceived) < uint64(b.N) {
+		runtime.Gosched()
+	}
+	// The readers finish the package they are adding before stopping
+	for i := 0; i < n.numReaders; i++ {
+		n.workersStopper <- true
+	}
+	b.StopTimer()
+}
+
+func BenchmarkReadersWithoutLimiter(b *testing.B) {
+	benchmarkReaders(b, 0)
+}
+
+// BenchmarkReadersWithSingleLockLimiter is the limiter before it was sharded
+func BenchmarkReadersWithSingleLockLimiter(b *testing.B) {
+	benchmarkReaders(b, 1)
+}
+
+func BenchmarkReadersWithShardedLimiter(b *testing.B) {
+	benchmarkReaders(b, 16)
+}
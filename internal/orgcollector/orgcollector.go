@@ -4,6 +4,7 @@ package orgcollector
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -122,6 +123,7 @@ func (o *OrgCollector) pushMetrics() {
 		tags := []string{}
 		tags = append(tags, o.customTags...)
 		tags = append(tags, o.getTagsFromOrg(org)...)
+		sort.Strings(tags)
 		key := metric.MetricKey{
 			Name:     "org.memory.quota",
 			TagsHash: util.HashTags(tags),
@@ -1,8 +1,12 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-firehose-nozzle/internal/client/cloudfoundry"
@@ -14,15 +18,20 @@ import (
 )
 
 type appCache struct {
-	apps     map[string]*App
-	warmedUp bool
-	lock     sync.RWMutex
+	apps      map[string]*App
+	refreshed map[string]time.Time // last time each app was added or updated
+	missing   map[string]time.Time // time until which the apps not found are not requested again
+	warmedUp  bool
+	stale     bool // whether the apps were loaded from a file and not refreshed yet
+	lock      sync.RWMutex
 }
 
 func newAppCache() appCache {
 	return appCache{
-		apps:     make(map[string]*App),
-		warmedUp: false,
+		apps:      make(map[string]*App),
+		refreshed: make(map[string]time.Time),
+		missing:   make(map[string]time.Time),
+		warmedUp:  false,
 	}
 }
 
@@ -32,7 +41,10 @@ func (c *appCache) Add(cfApp cloudfoundry.CFApplication) (*App, error) {
 	defer c.lock.Unlock()
 
 	if app := c.apps[cfApp.GUID]; app != nil {
+		// The cached app is read by the parsers while it is updated
+		app.lock.Lock()
 		err := app.setAppData(cfApp)
+		app.lock.Unlock()
 		if err != nil {
 			return nil, err
 		}
@@ -44,10 +56,81 @@ func (c *appCache) Add(cfApp cloudfoundry.CFApplication) (*App, error) {
 		}
 		c.apps[cfApp.GUID] = app
 	}
+	c.refreshed[cfApp.GUID] = time.Now()
+	delete(c.missing, cfApp.GUID)
 
 	return c.apps[cfApp.GUID], nil
 }
 
+// EvictMissing removes the apps refreshed before since which are not in guids, and returns how many were removed.
+// It also forgets the apps not found whose ttl expired.
+func (c *appCache) EvictMissing(guids map[string]bool, since time.Time) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for guid, until := range c.missing {
+		if !now.Before(until) {
+			delete(c.missing, guid)
+		}
+	}
+	evicted := 0
+	for guid := range c.apps {
+		// The apps fetched during the refresh are more recent than its list
+		if !guids[guid] && c.refreshed[guid].Before(since) {
+			delete(c.apps, guid)
+			delete(c.refreshed, guid)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Remove evicts a deleted app from the cache
+func (c *appCache) Remove(guid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.apps, guid)
+	delete(c.refreshed, guid)
+}
+
+// SetMissing records that the app was not found, it isn't requested again until the ttl expires
+func (c *appCache) SetMissing(guid string, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.missing[guid] = time.Now().Add(ttl)
+}
+
+// IsMissing returns true if the app was not found within its negative ttl
+func (c *appCache) IsMissing(guid string) bool {
+	c.lock.RLock()
+	until, ok := c.missing[guid]
+	c.lock.RUnlock()
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if until, ok := c.missing[guid]; ok && !time.Now().Before(until) {
+		delete(c.missing, guid)
+	}
+	return false
+}
+
+// Len returns the number of apps in the cache
+func (c *appCache) Len() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.apps)
+}
+
 // Get returns a cached app or nil if not found
 func (c *appCache) Get(guid string) *App {
 	c.lock.RLock()
@@ -64,23 +147,116 @@ func (c *appCache) IsWarmedUp() bool {
 	return c.warmedUp
 }
 
-// setWarmedUp signals to the cache that it's ready to be used
+// setWarmedUp signals to the cache that it's ready to be used and up to date
 func (c *appCache) SetWarmedUp() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	c.warmedUp = true
+	c.stale = false
+}
+
+// IsStale returns true if the cache was loaded from a file and not refreshed since
+func (c *appCache) IsStale() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.stale
+}
+
+// errNotAppMetric is returned for the envelopes that are not container metrics
+var errNotAppMetric = errors.New("not an app metric")
+
+// errAppMissing is returned for the apps that were recently not found in Cloud Controller
+var errAppMissing = errors.New("app recently not found in cloud controller")
+
+// appFetch is a request of an app to Cloud Controller, shared by the lookups of the app while it runs
+type appFetch struct {
+	done chan struct{}
+	app  *App
+	err  error
+}
+
+// AppCacheStats describes the app cache, the hits and misses are counted since the last call to CacheStats
+type AppCacheStats struct {
+	Size   int
+	Hits   uint64
+	Misses uint64
+}
+
+// defaultContainerMetricsNamespace prefixes the unknown container gauges when no namespace is set
+const defaultContainerMetricsNamespace = "app.container.gauge."
+
+// containerMetrics are the names of the known container gauges, in the order they are reported
+var containerMetrics = []struct{ gauge, name string }{
+	{"cpu", "app.cpu.pct"},
+	{"disk", "app.disk.used"},
+	{"disk_quota", "app.disk.quota"},
+	{"memory", "app.memory.used"},
+	{"memory_quota", "app.memory.quota"},
+	{"cpu_entitlement", "app.cpu.entitlement_pct"},
+	{"absolute_usage", "app.cpu.absolute_usage"},
+	{"absolute_entitlement", "app.cpu.absolute_entitlement"},
+	{"spike_start", "app.cpu.spike_start"},
+	{"spike_end", "app.cpu.spike_end"},
+	{"log_rate", "app.log_rate.used"},
+	{"log_rate_limit", "app.log_rate.limit"},
+	{"container_age", "app.container.age"},
 }
 
+// knownContainerGauges are the gauges of containerMetrics
+var knownContainerGauges = func() map[string]bool {
+	gauges := make(map[string]bool, len(containerMetrics))
+	for _, known := range containerMetrics {
+		gauges[known.gauge] = true
+	}
+	return gauges
+}()
+
+// knownContainerNames are the metric names of containerMetrics
+var knownContainerNames = func() map[string]bool {
+	names := make(map[string]bool, len(containerMetrics))
+	for _, known := range containerMetrics {
+		names[known.name] = true
+	}
+	return names
+}()
+
 // AppParser is used to parse app metrics
 type AppParser struct {
+	// counters first, they must be 64-bit aligned for atomic operations
+	hits         uint64
+	misses       uint64
 	cfClient     *cloudfoundry.CFClient
 	log          *gosteno.Logger
 	AppCache     appCache
 	cacheWorkers int
 	grabInterval int
 	customTags   []string
+	tagRewriter  *TagRewriter
 	stopper      chan bool
+	namespace    string // prefix of the unknown gauges of the container metrics
+	negativeTTL  time.Duration
+	fetchLock    sync.Mutex
+	fetches      map[string]*appFetch // requests of the apps to Cloud Controller in progress
+	cacheFile    string               // where the apps are saved for the next run, "" when they are not
+	saveLock     sync.Mutex
+	// the refreshes in between request only the changed apps, 0 when they all request every app
+	reconcileInterval time.Duration
+	lastReconcile     time.Time
+	// how often the audit events of the apps are applied to the cache, 0 when they are not
+	watchInterval time.Duration
+	watchStopper  chan bool
+}
+
+// AppParserOptions are the optional settings of an AppParser, their zero values disable them
+type AppParserOptions struct {
+	TagRewriter               *TagRewriter  // rewrites the tags of the metrics, nil when they are not
+	ContainerMetricsNamespace string        // prefix of the unknown container gauges, the default one when empty
+	NegativeTTL               time.Duration // how long the apps not found are not requested again
+	CacheFile                 string        // where the apps are saved for the next run
+	ReconcileInterval         int           // minutes between the refreshes that request every app, 0 when they all do
+	WatchInterval             time.Duration // how often the audit events of the apps are applied to the cache
 }
 
 // NewAppParser create a new AppParser
@@ -91,6 +267,7 @@ func NewAppParser(
 	log *gosteno.Logger,
 	customTags []string,
 	environment string,
+	options AppParserOptions,
 ) (*AppParser, error) {
 
 	if cfClient == nil {
@@ -99,6 +276,10 @@ func NewAppParser(
 	if environment != "" {
 		customTags = append(customTags, fmt.Sprintf("%s:%s", "env", environment))
 	}
+	containerMetricsNamespace := options.ContainerMetricsNamespace
+	if containerMetricsNamespace == "" {
+		containerMetricsNamespace = defaultContainerMetricsNamespace
+	}
 	appMetrics := &AppParser{
 		cfClient:     cfClient,
 		log:          log,
@@ -106,16 +287,29 @@ func NewAppParser(
 		cacheWorkers: cacheWorkers,
 		grabInterval: grabInterval,
 		customTags:   customTags,
+		tagRewriter:  options.TagRewriter,
 		stopper:      make(chan bool, 1),
+		namespace:    containerMetricsNamespace,
+		negativeTTL:  options.NegativeTTL,
+		fetches:      map[string]*appFetch{},
+		cacheFile:    options.CacheFile,
+
+		reconcileInterval: time.Duration(options.ReconcileInterval) * time.Minute,
+		watchInterval:     options.WatchInterval,
+		watchStopper:      make(chan bool, 1),
 	}
+	appMetrics.loadCache()
 
 	// start the background loop to keep the cache up to date
 	go appMetrics.updateCacheLoop()
+	if options.WatchInterval > 0 {
+		go appMetrics.watchAuditEvents()
+	}
 
 	return appMetrics, nil
 }
 
-// updateCacheLoop periodically refreshes the entire cache
+// updateCacheLoop periodically refreshes the cache
 func (am *AppParser) updateCacheLoop() {
 	// Run first cache warmup
 	am.warmupCache()
@@ -129,7 +323,7 @@ func (am *AppParser) updateCacheLoop() {
 		select {
 		case <-ticker.C:
 			jitterWait()
-			am.warmupCache()
+			am.refreshCache()
 		case <-am.stopper:
 			return
 		}
@@ -139,37 +333,136 @@ func (am *AppParser) updateCacheLoop() {
 func (am *AppParser) warmupCache() {
 	am.log.Infof("Warming up cache...")
 
+	start := time.Now()
 	cfapps, err := am.cfClient.GetApplications()
 	if err != nil {
 		am.log.Errorf("error warming up cache, couldn't get list of apps: %v", err)
 		return
 	}
+	guids := make(map[string]bool, len(cfapps))
 	for _, cfapp := range cfapps {
+		guids[cfapp.GUID] = true
 		_, err := am.AppCache.Add(cfapp)
 		if err != nil {
 			am.log.Errorf("an error occurred when adding app to the cache: %v", err)
 			// We intentionally continue adding apps if a single app fails
 		}
 	}
-	if !am.AppCache.IsWarmedUp() {
+	// The apps deleted from Cloud Controller are not in the list anymore
+	if evicted := am.AppCache.EvictMissing(guids, start); evicted > 0 {
+		am.log.Infof("evicted %d deleted apps from the cache", evicted)
+	}
+	am.lastReconcile = start
+	if !am.AppCache.IsWarmedUp() || am.AppCache.IsStale() {
 		am.AppCache.SetWarmedUp()
 	}
 	am.log.Infof("done warming up cache")
+	am.saveCache()
+}
+
+// refreshCache updates the apps changed since the last refresh,
+// and reconciles the entire cache when the reconcile interval has elapsed
+func (am *AppParser) refreshCache() {
+	if am.reconcileInterval <= 0 || time.Since(am.lastReconcile) >= am.reconcileInterval {
+		am.warmupCache()
+		return
+	}
+
+	cfapps, err := am.cfClient.GetUpdatedApplications()
+	if err == cloudfoundry.ErrIncrementalSyncUnavailable {
+		am.warmupCache()
+		return
+	}
+	if err != nil {
+		am.log.Errorf("error refreshing cache, couldn't get list of changed apps: %v", err)
+		return
+	}
+	if len(cfapps) == 0 {
+		return
+	}
+	for _, cfapp := range cfapps {
+		_, err := am.AppCache.Add(cfapp)
+		if err != nil {
+			am.log.Errorf("an error occurred when adding app to the cache: %v", err)
+		}
+	}
+	am.log.Infof("refreshed %d changed apps in the cache", len(cfapps))
+	am.saveCache()
+}
+
+// loadCache makes the apps saved by a previous run available until the first refresh completes
+func (am *AppParser) loadCache() {
+	if am.cacheFile == "" {
+		return
+	}
+	saved, err := am.AppCache.Load(am.cacheFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		am.log.Warnf("could not load the app cache, app metrics are dropped until it is warmed up: %v", err)
+		return
+	}
+	am.log.Infof("loaded %d apps saved at %s in %s, refreshing them in the background", am.AppCache.Len(), saved, am.cacheFile)
+}
+
+// saveCache writes the apps to the cache file, if any
+func (am *AppParser) saveCache() {
+	if am.cacheFile == "" {
+		return
+	}
+	am.saveLock.Lock()
+	defer am.saveLock.Unlock()
+	if err := am.AppCache.Save(am.cacheFile); err != nil {
+		am.log.Errorf("could not save the app cache: %v", err)
+	}
 }
 
 func (am *AppParser) getAppData(guid string) (*App, error) {
 	app := am.AppCache.Get(guid)
 	if app != nil {
 		// If it exists in the cache, use the cache
+		atomic.AddUint64(&am.hits, 1)
 		return app, nil
 	}
-	// Otherwise it's a new app so fetch it via the API
+	atomic.AddUint64(&am.misses, 1)
+	if am.AppCache.IsMissing(guid) {
+		return nil, errAppMissing
+	}
+
+	// Otherwise it's a new app so fetch it via the API, once for all the envelopes of the app received meanwhile
+	am.fetchLock.Lock()
+	if fetch, ok := am.fetches[guid]; ok {
+		am.fetchLock.Unlock()
+		<-fetch.done
+		return fetch.app, fetch.err
+	}
+	fetch := &appFetch{done: make(chan struct{})}
+	am.fetches[guid] = fetch
+	am.fetchLock.Unlock()
+
+	fetch.app, fetch.err = am.fetchApp(guid)
+
+	am.fetchLock.Lock()
+	delete(am.fetches, guid)
+	am.fetchLock.Unlock()
+	close(fetch.done)
+
+	return fetch.app, fetch.err
+}
+
+// fetchApp requests an app to Cloud Controller and adds it to the cache
+func (am *AppParser) fetchApp(guid string) (*App, error) {
 	cfapp, err := am.cfClient.GetApplication(guid)
 	if err != nil {
 		am.log.Warnf("error grabbing instance data for app %s (is this a short-lived app?): %v", guid, err)
+		// Only the apps that do not exist are not requested again, the other errors may not last
+		if am.negativeTTL > 0 && cloudfoundry.IsNotFound(err) {
+			am.AppCache.SetMissing(guid, am.negativeTTL)
+		}
 		return nil, err
 	}
-	app, err = am.AppCache.Add(*cfapp)
+	app, err := am.AppCache.Add(*cfapp)
 	if err != nil {
 		am.log.Errorf("an error occurred when adding app to the cache: %v", err)
 	}
@@ -177,12 +470,21 @@ func (am *AppParser) getAppData(guid string) (*App, error) {
 	return app, nil
 }
 
+// CacheStats returns the size of the app cache, and its hits and misses since the last call
+func (am *AppParser) CacheStats() AppCacheStats {
+	return AppCacheStats{
+		Size:   am.AppCache.Len(),
+		Hits:   atomic.SwapUint64(&am.hits, 0),
+		Misses: atomic.SwapUint64(&am.misses, 0),
+	}
+}
+
 // Parse takes an envelope, and extract app metrics from it
 func (am *AppParser) Parse(envelope *loggregator_v2.Envelope) ([]metric.MetricPackage, error) {
 	metricsPackages := []metric.MetricPackage{}
 
-	if !util.IsContainerMetric(envelope) {
-		return metricsPackages, fmt.Errorf("not an app metric")
+	if !util.IsContainerMetric(envelope) && !util.IsExtendedContainerMetric(envelope) {
+		return metricsPackages, errNotAppMetric
 	}
 
 	message := envelope.GetGauge()
@@ -202,13 +504,21 @@ func (am *AppParser) Parse(envelope *loggregator_v2.Envelope) ([]metric.MetricPa
 	defer app.lock.Unlock()
 
 	app.Host = parseHost(envelope)
+	// The points are reported at the time of the envelope, like infra metrics
+	timestamp := envelope.GetTimestamp() / int64(time.Second)
+	if timestamp == 0 {
+		timestamp = time.Now().Unix()
+	}
 
-	metricsPackages, err = app.getMetrics(am.customTags)
-	if err != nil {
-		am.log.Errorf("there was an error parsing metrics: %v", err)
-		return metricsPackages, err
+	// The metrics of the app are reported with the container metric, not with each extended container gauge envelope
+	if !util.IsExtendedContainerMetric(envelope) {
+		metricsPackages, err = app.getMetrics(am.customTags, am.tagRewriter, timestamp)
+		if err != nil {
+			am.log.Errorf("there was an error parsing metrics: %v", err)
+			return metricsPackages, err
+		}
 	}
-	containerMetrics, err := app.parseContainerMetric(message, envelope.GetInstanceId(), am.customTags)
+	containerMetrics, err := app.parseContainerMetric(message, envelope.GetInstanceId(), am.customTags, am.tagRewriter, timestamp, am.namespace)
 	if err != nil {
 		am.log.Errorf("there was an error parsing container metrics: %v", err)
 		return metricsPackages, err
@@ -218,9 +528,39 @@ func (am *AppParser) Parse(envelope *loggregator_v2.Envelope) ([]metric.MetricPa
 	return metricsPackages, nil
 }
 
+// FlushAggregates returns the metrics of each app across its instances that reported recently, with their points at timestamp.
+// They are reported once per flush rather than with every container metric of the instances.
+func (am *AppParser) FlushAggregates(timestamp int64) []metric.MetricPackage {
+	am.AppCache.lock.RLock()
+	apps := make([]*App, 0, len(am.AppCache.apps))
+	for _, app := range am.AppCache.apps {
+		apps = append(apps, app)
+	}
+	am.AppCache.lock.RUnlock()
+
+	var metricsPackages []metric.MetricPackage
+	for _, app := range apps {
+		app.lock.Lock()
+		names, ms := app.aggregateInstances(timestamp)
+		if len(names) > 0 {
+			aggregates, err := app.mkMetrics(names, ms, am.customTags, am.tagRewriter, timestamp)
+			if err != nil {
+				am.log.Errorf("there was an error aggregating the instances of app %s: %v", app.GUID, err)
+			}
+			metricsPackages = append(metricsPackages, aggregates...)
+		}
+		app.lock.Unlock()
+	}
+	return metricsPackages
+}
+
 // Stop sends a message on the stopper channel to quit the goroutine refreshing the cache
 func (am *AppParser) Stop() {
 	am.stopper <- true
+	if am.watchInterval > 0 {
+		am.watchStopper <- true
+	}
+	am.saveCache()
 }
 
 // App holds all the needed attribute from an app
@@ -241,6 +581,7 @@ type App struct {
 	TotalMemoryProvisioned int
 	Tags                   []string
 	lock                   sync.RWMutex
+	instances              map[string]*instanceSample // last gauges of each instance, by instance index
 }
 
 func newApp(guid string) *App {
@@ -249,7 +590,7 @@ func newApp(guid string) *App {
 	}
 }
 
-func (a *App) getMetrics(customTags []string) ([]metric.MetricPackage, error) {
+func (a *App) getMetrics(customTags []string, tagRewriter *TagRewriter, timestamp int64) ([]metric.MetricPackage, error) {
 	var names = []string{
 		"app.disk.configured",
 		"app.disk.provisioned",
@@ -265,32 +606,51 @@ func (a *App) getMetrics(customTags []string) ([]metric.MetricPackage, error) {
 		float64(a.TotalMemoryProvisioned),
 		float64(a.NumberOfInstances),
 	}
-	return a.mkMetrics(names, ms, customTags)
+	return a.mkMetrics(names, ms, customTags, tagRewriter, timestamp)
 }
 
-func (a *App) parseContainerMetric(message *loggregator_v2.Gauge, instanceID string, customTags []string) ([]metric.MetricPackage, error) {
-	var names = []string{
-		"app.cpu.pct",
-		"app.disk.used",
-		"app.disk.quota",
-		"app.memory.used",
-		"app.memory.quota",
+// parseContainerMetric creates the metrics of the gauges of a container,
+// the unknown gauges are named after the namespace
+func (a *App) parseContainerMetric(message *loggregator_v2.Gauge, instanceID string, customTags []string, tagRewriter *TagRewriter, timestamp int64, namespace string) ([]metric.MetricPackage, error) {
+	gauges := message.GetMetrics()
+	names := make([]string, 0, len(gauges))
+	ms := make([]float64, 0, len(gauges))
+	for _, known := range containerMetrics {
+		if v, ok := gauges[known.gauge]; ok && v != nil {
+			names = append(names, known.name)
+			ms = append(ms, v.Value)
+		}
 	}
 
-	// App.Parse checks that this is container metric, so we're guaranteed that all these tags are present
-	var ms = []float64{
-		float64(message.GetMetrics()["cpu"].Value),
-		float64(message.GetMetrics()["disk"].Value),
-		float64(message.GetMetrics()["disk_quota"].Value),
-		float64(message.GetMetrics()["memory"].Value),
-		float64(message.GetMetrics()["memory_quota"].Value),
+	unknown := make([]string, 0, len(gauges)-len(names))
+	for gauge, v := range gauges {
+		// The instance index is the instance tag of the metrics, and a gauge is never reported under the name of a known one
+		if !knownContainerGauges[gauge] && v != nil && gauge != "instance_index" && !knownContainerNames[namespace+gauge] {
+			unknown = append(unknown, gauge)
+		}
+	}
+	sort.Strings(unknown)
+	for _, gauge := range unknown {
+		names = append(names, namespace+gauge)
+		ms = append(ms, gauges[gauge].Value)
 	}
-	tags := []string{fmt.Sprintf("instance:%v", getContainerInstanceID(message, instanceID))}
+
+	instance := getContainerInstanceID(message, instanceID)
+	derivedNames, derivedValues := a.deriveInstanceMetrics(instance, gauges, timestamp)
+	names = append(names, derivedNames...)
+	ms = append(ms, derivedValues...)
+
+	tags := []string{fmt.Sprintf("instance:%v", instance)}
 	tags = append(tags, customTags...)
-	return a.mkMetrics(names, ms, tags)
+	metricsPackages, err := a.mkMetrics(names, ms, tags, tagRewriter, timestamp)
+	if err != nil {
+		return metricsPackages, err
+	}
+	return metricsPackages, nil
 }
 
-func (a *App) mkMetrics(names []string, ms []float64, moreTags []string) ([]metric.MetricPackage, error) {
+// mkMetrics creates the metrics of the app with their points at timestamp, in seconds
+func (a *App) mkMetrics(names []string, ms []float64, moreTags []string, tagRewriter *TagRewriter, timestamp int64) ([]metric.MetricPackage, error) {
 	metricsPackages := []metric.MetricPackage{}
 	var host string
 	if a.Host != "" {
@@ -303,18 +663,28 @@ func (a *App) mkMetrics(names []string, ms []float64, moreTags []string) ([]metr
 	tags = append(tags, moreTags...)
 	// source_id in envelope always matches app.GUID for app metrics
 	tags = appendTagIfNotEmpty(tags, "source_id", a.GUID)
+	tags = tagRewriter.Rewrite(tags)
+	sort.Strings(tags)
+	tagsHash := util.HashTags(tags)
+	tenant := &metric.Tenant{
+		OrgName:   a.OrgName,
+		OrgID:     a.OrgID,
+		SpaceName: a.SpaceName,
+		SpaceID:   a.SpaceID,
+	}
 
 	for i, name := range names {
 		key := metric.MetricKey{
 			Name:     name,
-			TagsHash: util.HashTags(tags),
+			TagsHash: tagsHash,
 		}
 		mVal := metric.MetricValue{
-			Tags: tags,
-			Host: host,
+			Tags:   tags,
+			Host:   host,
+			Tenant: tenant,
 		}
 		p := metric.Point{
-			Timestamp: time.Now().Unix(),
+			Timestamp: timestamp,
 			Value:     float64(ms[i]),
 		}
 		mVal.Points = append(mVal.Points, p)
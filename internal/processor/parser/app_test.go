@@ -3,7 +3,12 @@ package parser
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	. "github.com/DataDog/datadog-firehose-nozzle/test/helper"
@@ -46,12 +51,12 @@ var _ = Describe("AppMetrics", func() {
 
 	Context("generator function", func() {
 		It("errors out properly when it cannot connect", func() {
-			_, err := NewAppParser(nil, 5, 10, log, []string{}, "")
+			_, err := NewAppParser(nil, 5, 10, log, []string{}, "", AppParserOptions{})
 			Expect(err).NotTo(BeNil())
 		})
 
 		It("generates it properly when it can connect", func() {
-			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "")
+			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{})
 			Expect(err).To(BeNil())
 			Expect(a).NotTo(BeNil())
 		})
@@ -59,7 +64,7 @@ var _ = Describe("AppMetrics", func() {
 
 	Context("cache warmup", func() {
 		It("requests all the apps directly at startup", func() {
-			a, err := NewAppParser(fakeCfClient, 5, 999, log, []string{}, "")
+			a, err := NewAppParser(fakeCfClient, 5, 999, log, []string{}, "", AppParserOptions{})
 			Expect(err).To(BeNil())
 			Expect(a).NotTo(BeNil())
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
@@ -68,7 +73,7 @@ var _ = Describe("AppMetrics", func() {
 
 		It("does not block while warming cache", func() {
 			fakeCloudControllerAPI.RequestTime = 100
-			a, err := NewAppParser(fakeCfClient, 5, 999, log, []string{}, "")
+			a, err := NewAppParser(fakeCfClient, 5, 999, log, []string{}, "", AppParserOptions{})
 			// Assertions are done while cache is warming up in the background
 			Expect(err).To(BeNil())
 			Expect(a).NotTo(BeNil())
@@ -80,7 +85,7 @@ var _ = Describe("AppMetrics", func() {
 
 	Context("app metrics test", func() {
 		It("tries to get it from the cloud controller when not in the cache", func() {
-			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "")
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{})
 			_, err := a.getAppData("app-5")
 			Expect(err).ToNot(BeNil()) // error expected because fake CC won't return an app, so unmarshalling will fail
 			var req *http.Request
@@ -91,7 +96,7 @@ var _ = Describe("AppMetrics", func() {
 		})
 
 		It("grabs from the cache when it present", func() {
-			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "")
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{})
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
 			// 6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a corresponds to hello-datadog-cf-ruby-dev
 			Expect(a.AppCache.apps).To(HaveKey("6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a"))
@@ -99,11 +104,275 @@ var _ = Describe("AppMetrics", func() {
 			Expect(err).To(BeNil())
 			Expect(app).NotTo(BeNil())
 		})
+
+		It("does not request the apps recently not found again", func() {
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{NegativeTTL: time.Minute})
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			_, err := a.getAppData("app-5")
+			Expect(err).NotTo(BeNil())
+			_, err = a.getAppData("app-5")
+			Expect(err).To(Equal(errAppMissing))
+			Expect(countEndpoint(fakeCloudControllerAPI, "/v2/apps/app-5")).To(Equal(1))
+		})
+
+		It("requests the apps again after an error other than not found", func() {
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{NegativeTTL: time.Minute})
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			// The request and its retry with a new token are rejected
+			fakeCloudControllerAPI.RejectNextRequests(2)
+
+			_, err := a.getAppData("app-5")
+			Expect(err).NotTo(BeNil())
+			Expect(err).NotTo(Equal(errAppMissing))
+			Expect(a.AppCache.IsMissing("app-5")).To(BeFalse())
+			_, err = a.getAppData("app-5")
+			Expect(err).NotTo(Equal(errAppMissing))
+			Expect(countEndpoint(fakeCloudControllerAPI, "/v2/apps/app-5")).To(Equal(3))
+		})
+
+		It("requests an app once for concurrent lookups", func() {
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{})
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			fakeCloudControllerAPI.RequestTime = 200
+
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					a.getAppData("app-5")
+				}()
+			}
+			wg.Wait()
+			Expect(countEndpoint(fakeCloudControllerAPI, "/v2/apps/app-5")).To(Equal(1))
+		})
+
+		It("counts the hits and misses of the cache", func() {
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{NegativeTTL: time.Minute})
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			a.getAppData("6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a")
+			a.getAppData("6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a")
+			a.getAppData("app-5")
+			Expect(a.CacheStats()).To(Equal(AppCacheStats{Size: 14, Hits: 2, Misses: 1}))
+			// The counts are reset once read
+			Expect(a.CacheStats()).To(Equal(AppCacheStats{Size: 14}))
+		})
+	})
+
+	Context("incremental refresh", func() {
+		fullQueries := func(queries []string) int {
+			count := 0
+			for _, query := range queries {
+				if strings.HasPrefix(query, "/v3/apps?") && !strings.Contains(query, "%5D=") && !strings.Contains(query, "guids=") {
+					count++
+				}
+			}
+			return count
+		}
+
+		It("requests only the changed apps until the reconcile interval elapses", func() {
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{ReconcileInterval: 60})
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			full := fullQueries(fakeCloudControllerAPI.GetUsedQueries())
+
+			a.refreshCache()
+			queries := fakeCloudControllerAPI.GetUsedQueries()
+			Expect(fullQueries(queries)).To(Equal(full))
+			Expect(queries).To(ContainElement(HavePrefix("/v3/apps?page=1&per_page=")))
+			Expect(queries).To(ContainElement(ContainSubstring("updated_ats%5Bgt%5D=")))
+			Expect(a.AppCache.Len()).To(Equal(14))
+
+			a.lastReconcile = time.Time{}
+			a.refreshCache()
+			Expect(fullQueries(fakeCloudControllerAPI.GetUsedQueries())).To(BeNumerically(">", full))
+		})
+
+		It("requests every app when there is no reconcile interval", func() {
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{})
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			full := fullQueries(fakeCloudControllerAPI.GetUsedQueries())
+
+			a.refreshCache()
+			Expect(fullQueries(fakeCloudControllerAPI.GetUsedQueries())).To(BeNumerically(">", full))
+		})
+	})
+
+	Context("audit events", func() {
+		It("updates the changed apps and evicts the deleted ones", func() {
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{NegativeTTL: time.Minute})
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			Expect(a.AppCache.Get("6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a")).NotTo(BeNil())
+			a.AppCache.Get("6d254438-cc3b-44a6-b2e6-343ca92deb5f").Name = "renamed"
+
+			cursor := a.applyAuditEvents(auditCursor{since: "2019-10-04T11:00:00Z", seen: map[string]bool{}})
+			Expect(a.AppCache.Get("6d254438-cc3b-44a6-b2e6-343ca92deb5f").Name).To(Equal("p-invitations-green"))
+			Expect(a.AppCache.Get("6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a")).To(BeNil())
+			Expect(a.AppCache.IsMissing("6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a")).To(BeTrue())
+			Expect(a.AppCache.Len()).To(Equal(13))
+			Expect(cursor.since).To(Equal("2019-10-04T11:14:00Z"))
+			Expect(cursor.seen).To(Equal(map[string]bool{"e0b3c5a1-8f3f-4c8e-9d56-5f1e0a1a7d11": true}))
+			Expect(fakeCloudControllerAPI.GetUsedQueries()).To(ContainElement(And(
+				HavePrefix("/v3/audit_events?"),
+				ContainSubstring("created_ats%5Bgte%5D=2019-10-04T11%3A00%3A00Z"),
+				ContainSubstring("audit.app.process.scale"),
+			)))
+		})
+
+		It("applies the events created in the same second as the cursor once", func() {
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{})
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			a.AppCache.Get("6d254438-cc3b-44a6-b2e6-343ca92deb5f").Name = "renamed"
+
+			// The scale event is created at the time of the cursor
+			cursor := a.applyAuditEvents(auditCursor{since: "2019-10-04T11:12:30Z", seen: map[string]bool{}})
+			Expect(a.AppCache.Get("6d254438-cc3b-44a6-b2e6-343ca92deb5f").Name).To(Equal("p-invitations-green"))
+			Expect(a.AppCache.Get("6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a")).To(BeNil())
+			Expect(cursor).To(Equal(auditCursor{
+				since: "2019-10-04T11:14:00Z",
+				seen:  map[string]bool{"e0b3c5a1-8f3f-4c8e-9d56-5f1e0a1a7d11": true},
+			}))
+
+			// The next poll returns the last event again and skips it
+			a.AppCache.Get("6d254438-cc3b-44a6-b2e6-343ca92deb5f").Name = "renamed"
+			next := a.applyAuditEvents(cursor)
+			Expect(next).To(Equal(cursor))
+			Expect(a.AppCache.Get("6d254438-cc3b-44a6-b2e6-343ca92deb5f").Name).To(Equal("renamed"))
+		})
+
+		It("skips the events already applied", func() {
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{})
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			a.applyAuditEvents(auditCursor{
+				since: "2019-10-04T11:13:00Z",
+				seen:  map[string]bool{"57d7b8b9-4cbb-47e1-a2a7-8c5b8b5e1b30": true},
+			})
+			Expect(a.AppCache.Get("6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a")).NotTo(BeNil())
+		})
+	})
+
+	Context("cache eviction", func() {
+		It("evicts the apps missing from a refresh", func() {
+			cache := newAppCache()
+			app := func(guid string) cloudfoundry.CFApplication {
+				return cloudfoundry.CFApplication{
+					GUID: guid, Name: "name", SpaceGUID: "space-id", SpaceName: "space", OrgName: "org", OrgGUID: "org-id",
+				}
+			}
+			_, err := cache.Add(app("kept"))
+			Expect(err).To(BeNil())
+			_, err = cache.Add(app("deleted"))
+			Expect(err).To(BeNil())
+			since := time.Now()
+			// Apps fetched while the refresh runs are not in its list
+			_, err = cache.Add(app("new"))
+			Expect(err).To(BeNil())
+
+			Expect(cache.EvictMissing(map[string]bool{"kept": true}, since)).To(Equal(1))
+			Expect(cache.Get("kept")).NotTo(BeNil())
+			Expect(cache.Get("deleted")).To(BeNil())
+			Expect(cache.Get("new")).NotTo(BeNil())
+			Expect(cache.Len()).To(Equal(2))
+		})
+
+		It("updates a cached app under its lock", func() {
+			cache := newAppCache()
+			cfApp := cloudfoundry.CFApplication{
+				GUID: "app-1", Name: "name", SpaceGUID: "space-id", SpaceName: "space", OrgName: "org", OrgGUID: "org-id",
+			}
+			app, err := cache.Add(cfApp)
+			Expect(err).To(BeNil())
+
+			app.lock.RLock()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				cfApp.Name = "renamed"
+				cache.Add(cfApp)
+			}()
+			Consistently(done).ShouldNot(BeClosed())
+			Expect(app.Name).To(Equal("name"))
+			app.lock.RUnlock()
+
+			Eventually(done).Should(BeClosed())
+			Expect(cache.Get("app-1").Name).To(Equal("renamed"))
+		})
+
+		It("forgets the apps not found once their ttl expires", func() {
+			cache := newAppCache()
+			cache.SetMissing("app-5", time.Minute)
+			cache.SetMissing("app-6", -time.Second)
+			Expect(cache.IsMissing("app-5")).To(BeTrue())
+			Expect(cache.IsMissing("app-6")).To(BeFalse())
+			Expect(cache.missing).NotTo(HaveKey("app-6"))
+		})
+
+		It("sweeps the apps not found whose ttl expired on refresh", func() {
+			cache := newAppCache()
+			cache.SetMissing("app-5", time.Minute)
+			cache.SetMissing("app-6", -time.Second)
+			cache.EvictMissing(map[string]bool{}, time.Now())
+			Expect(cache.missing).To(HaveKey("app-5"))
+			Expect(cache.missing).NotTo(HaveKey("app-6"))
+		})
+	})
+
+	Context("cache persistence", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "app-cache")
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("saves and loads the apps", func() {
+			path := filepath.Join(dir, "cache", "apps.json")
+			cache := newAppCache()
+			_, err := cache.Add(cloudfoundry.CFApplication{
+				GUID: "app-1", Name: "name", SpaceGUID: "space-id", SpaceName: "space", OrgName: "org", OrgGUID: "org-id",
+				Instances: 2, Buildpacks: []string{"ruby"}, Memory: 128, TotalMemory: 256,
+			})
+			Expect(err).To(BeNil())
+			Expect(cache.Save(path)).To(Succeed())
+
+			loaded := newAppCache()
+			_, err = loaded.Load(path)
+			Expect(err).To(BeNil())
+			Expect(loaded.IsWarmedUp()).To(BeTrue())
+			Expect(loaded.IsStale()).To(BeTrue())
+			app := loaded.Get("app-1")
+			Expect(app).NotTo(BeNil())
+			Expect(app.Tags).To(Equal(cache.Get("app-1").Tags))
+			Expect(app.NumberOfInstances).To(Equal(2))
+			Expect(app.TotalMemoryProvisioned).To(Equal(256))
+		})
+
+		It("uses the saved apps until the cache is refreshed", func() {
+			path := filepath.Join(dir, "apps.json")
+			a, _ := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{CacheFile: path})
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+			Eventually(func() error { _, err := os.Stat(path); return err }).Should(Succeed())
+			a.Stop()
+
+			fakeCloudControllerAPI.RequestTime = 200
+			a, _ = NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{CacheFile: path})
+			Expect(a.AppCache.IsWarmedUp()).To(BeTrue())
+			Expect(a.AppCache.IsStale()).To(BeTrue())
+			Expect(a.AppCache.Get("6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a")).NotTo(BeNil())
+			Eventually(a.AppCache.IsStale, 10*time.Second).Should(BeFalse())
+		})
 	})
 
 	Context("metric evaluation test", func() {
 		It("parses an event properly", func() {
-			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "env_name")
+			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "env_name", AppParserOptions{})
 			Expect(err).To(BeNil())
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
 
@@ -149,7 +418,7 @@ var _ = Describe("AppMetrics", func() {
 			metrics, err := a.Parse(event)
 
 			Expect(err).To(BeNil())
-			Expect(metrics).To(HaveLen(10))
+			Expect(metrics).To(HaveLen(12))
 
 			Expect(metrics).To(ContainMetric("app.disk.configured"))
 			Expect(metrics).To(ContainMetric("app.disk.provisioned"))
@@ -161,19 +430,217 @@ var _ = Describe("AppMetrics", func() {
 			Expect(metrics).To(ContainMetric("app.disk.quota"))
 			Expect(metrics).To(ContainMetric("app.memory.used"))
 			Expect(metrics).To(ContainMetric("app.memory.quota"))
+			Expect(metrics).To(ContainMetric("app.memory.utilization"))
+			Expect(metrics).To(ContainMetric("app.disk.utilization"))
 
 			for _, metric := range metrics {
+				// The points are reported at the time of the envelope
+				Expect(metric.MetricValue.Points).To(HaveLen(1))
+				Expect(metric.MetricValue.Points[0].Timestamp).To(Equal(int64(1)))
 				Expect(metric.MetricValue.Tags).To(ContainElement("app_name:hello-datadog-cf-ruby-dev"))
 				Expect(metric.MetricValue.Tags).To(ContainElement("guid:6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a"))
 				Expect(metric.MetricValue.Tags).To(ContainElement("env:env_name"))
 				Expect(metric.MetricValue.Tags).To(ContainElement("source_id:6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a"))
+				// The tenant is used to route app metrics to the account of their org or space
+				Expect(metric.MetricValue.Tenant).NotTo(BeNil())
+				Expect(metric.MetricValue.Tags).To(ContainElement("org_name:" + metric.MetricValue.Tenant.OrgName))
+				Expect(metric.MetricValue.Tags).To(ContainElement("org_id:" + metric.MetricValue.Tenant.OrgID))
+				Expect(metric.MetricValue.Tags).To(ContainElement("space_name:" + metric.MetricValue.Tenant.SpaceName))
+				Expect(metric.MetricValue.Tags).To(ContainElement("space_id:" + metric.MetricValue.Tenant.SpaceID))
 			}
 		})
 	})
 
+	Context("extended container metrics", func() {
+		var a *AppParser
+
+		BeforeEach(func() {
+			var err error
+			a, err = NewAppParser(fakeCfClient, 5, 10, log, []string{}, "env_name", AppParserOptions{ContainerMetricsNamespace: "custom."})
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+		})
+
+		gauge := func(metrics map[string]*loggregator_v2.GaugeValue) *loggregator_v2.Envelope {
+			return &loggregator_v2.Envelope{
+				Timestamp:  1000000000,
+				SourceId:   "6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a",
+				InstanceId: "4",
+				Tags:       map[string]string{"origin": "rep"},
+				Message: &loggregator_v2.Envelope_Gauge{
+					Gauge: &loggregator_v2.Gauge{Metrics: metrics},
+				},
+			}
+		}
+
+		It("parses the known and unknown gauges of the container metric", func() {
+			metrics, err := a.Parse(gauge(map[string]*loggregator_v2.GaugeValue{
+				"cpu":             {Unit: "percentage", Value: 1},
+				"memory":          {Unit: "bytes", Value: 1},
+				"disk":            {Unit: "bytes", Value: 1},
+				"memory_quota":    {Unit: "bytes", Value: 1},
+				"disk_quota":      {Unit: "bytes", Value: 1},
+				"cpu_entitlement": {Unit: "percentage", Value: 42},
+				"log_rate":        {Unit: "B/s", Value: 100},
+				"log_rate_limit":  {Unit: "B/s", Value: 1000},
+				"new_gauge":       {Unit: "bytes", Value: 7},
+			}))
+
+			Expect(err).To(BeNil())
+			Expect(metrics).To(HaveLen(16))
+			values := metricValues(metrics)
+			Expect(values).To(HaveKeyWithValue("app.cpu.entitlement_pct", float64(42)))
+			Expect(values).To(HaveKeyWithValue("app.log_rate.used", float64(100)))
+			Expect(values).To(HaveKeyWithValue("app.log_rate.limit", float64(1000)))
+			Expect(values).To(HaveKeyWithValue("custom.new_gauge", float64(7)))
+			for _, metric := range metrics {
+				Expect(metric.MetricValue.Tags).To(ContainElement("app_name:hello-datadog-cf-ruby-dev"))
+			}
+		})
+
+		It("parses the envelopes of the extended gauges without the metrics of the app", func() {
+			metrics, err := a.Parse(gauge(map[string]*loggregator_v2.GaugeValue{
+				"absolute_usage":       {Unit: "nanoseconds", Value: 10},
+				"absolute_entitlement": {Unit: "nanoseconds", Value: 20},
+				"container_age":        {Unit: "nanoseconds", Value: 30},
+				"instance_index":       {Value: 3},
+			}))
+
+			Expect(err).To(BeNil())
+			Expect(metrics).To(HaveLen(3))
+			values := metricValues(metrics)
+			Expect(values).To(HaveKeyWithValue("app.cpu.absolute_usage", float64(10)))
+			Expect(values).To(HaveKeyWithValue("app.cpu.absolute_entitlement", float64(20)))
+			Expect(values).To(HaveKeyWithValue("app.container.age", float64(30)))
+			for _, metric := range metrics {
+				Expect(metric.MetricValue.Tags).To(ContainElement("instance:3"))
+			}
+		})
+
+		It("does not report an unknown gauge under the name of a known one", func() {
+			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "env_name", AppParserOptions{ContainerMetricsNamespace: "app.container."})
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+			metrics, err := a.Parse(gauge(map[string]*loggregator_v2.GaugeValue{
+				"cpu":           {Unit: "percentage", Value: 1},
+				"memory":        {Unit: "bytes", Value: 1},
+				"disk":          {Unit: "bytes", Value: 1},
+				"memory_quota":  {Unit: "bytes", Value: 1},
+				"disk_quota":    {Unit: "bytes", Value: 1},
+				"container_age": {Unit: "nanoseconds", Value: 30},
+				"age":           {Unit: "nanoseconds", Value: 7},
+			}))
+
+			Expect(err).To(BeNil())
+			Expect(metrics).To(HaveLen(13))
+			Expect(metricValues(metrics)).To(HaveKeyWithValue("app.container.age", float64(30)))
+		})
+	})
+
+	Context("utilization metrics", func() {
+		var a *AppParser
+
+		BeforeEach(func() {
+			var err error
+			a, err = NewAppParser(fakeCfClient, 5, 10, log, []string{}, "env_name", AppParserOptions{})
+			Expect(err).To(BeNil())
+			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+		})
+
+		containerMetric := func(timestamp int64, index float64, cpu, memory float64) *loggregator_v2.Envelope {
+			return &loggregator_v2.Envelope{
+				Timestamp: timestamp * int64(time.Second),
+				SourceId:  "6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a",
+				Tags:      map[string]string{"origin": "rep"},
+				Message: &loggregator_v2.Envelope_Gauge{
+					Gauge: &loggregator_v2.Gauge{
+						Metrics: map[string]*loggregator_v2.GaugeValue{
+							"instance_index": {Value: index},
+							"cpu":            {Unit: "percentage", Value: cpu},
+							"memory":         {Unit: "bytes", Value: memory},
+							"memory_quota":   {Unit: "bytes", Value: 400},
+							"disk":           {Unit: "bytes", Value: 10},
+							"disk_quota":     {Unit: "bytes", Value: 40},
+						},
+					},
+				},
+			}
+		}
+
+		It("reports the utilization of each instance", func() {
+			metrics, err := a.Parse(containerMetric(1000, 0, 5, 100))
+			Expect(err).To(BeNil())
+			values := metricValues(metrics)
+			Expect(values).To(HaveKeyWithValue("app.memory.utilization", float64(25)))
+			Expect(values).To(HaveKeyWithValue("app.disk.utilization", float64(25)))
+			for _, m := range metrics {
+				if m.MetricKey.Name == "app.memory.utilization" {
+					Expect(m.MetricValue.Tags).To(ContainElement("instance:0"))
+				}
+			}
+		})
+
+		It("aggregates the instances that reported recently", func() {
+			a.Parse(containerMetric(1000, 0, 5, 100))
+			a.Parse(containerMetric(1010, 1, 20, 300))
+			metrics, err := a.Parse(containerMetric(1020, 2, 10, 200))
+			Expect(err).To(BeNil())
+			// The aggregates are only reported when the metrics are flushed
+			Expect(metrics).NotTo(ContainMetric("app.memory.used.total"))
+
+			metrics = a.FlushAggregates(1020)
+			Expect(metrics).To(HaveLen(5))
+			values := metricValues(metrics)
+			Expect(values).To(HaveKeyWithValue("app.memory.used.total", float64(600)))
+			Expect(values).To(HaveKeyWithValue("app.memory.used.max", float64(300)))
+			Expect(values).To(HaveKeyWithValue("app.disk.used.total", float64(30)))
+			Expect(values).To(HaveKeyWithValue("app.cpu.pct.total", float64(35)))
+			Expect(values).To(HaveKeyWithValue("app.cpu.pct.max", float64(20)))
+			for _, m := range metrics {
+				if m.MetricKey.Name == "app.memory.used.total" {
+					Expect(m.MetricValue.Tags).NotTo(ContainElement(HavePrefix("instance:")))
+				}
+			}
+
+			// The instances that stopped reporting are left out
+			_, err = a.Parse(containerMetric(1200, 2, 10, 200))
+			Expect(err).To(BeNil())
+			values = metricValues(a.FlushAggregates(1200))
+			Expect(values).To(HaveKeyWithValue("app.memory.used.total", float64(200)))
+			Expect(values).To(HaveKeyWithValue("app.cpu.pct.max", float64(10)))
+		})
+
+		It("derives the cpu entitlement from the absolute usage", func() {
+			entitlement := func(usage, entitlement float64) *loggregator_v2.Envelope {
+				return &loggregator_v2.Envelope{
+					Timestamp: 1000000000000,
+					SourceId:  "6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a",
+					Message: &loggregator_v2.Envelope_Gauge{
+						Gauge: &loggregator_v2.Gauge{
+							Metrics: map[string]*loggregator_v2.GaugeValue{
+								"instance_index":       {Value: 0},
+								"absolute_usage":       {Unit: "nanoseconds", Value: usage},
+								"absolute_entitlement": {Unit: "nanoseconds", Value: entitlement},
+							},
+						},
+					},
+				}
+			}
+
+			metrics, err := a.Parse(entitlement(100, 1000))
+			Expect(err).To(BeNil())
+			Expect(metrics).NotTo(ContainMetric("app.cpu.entitlement_pct"))
+
+			metrics, err = a.Parse(entitlement(400, 2000))
+			Expect(err).To(BeNil())
+			Expect(metricValues(metrics)).To(HaveKeyWithValue("app.cpu.entitlement_pct", float64(30)))
+		})
+	})
+
 	Context("expected tags", func() {
 		It("adds proper instance tag", func() {
-			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "env_name")
+			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "env_name", AppParserOptions{})
 			Expect(err).To(BeNil())
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
 
@@ -225,7 +692,7 @@ var _ = Describe("AppMetrics", func() {
 			}
 
 			metrics, err := a.Parse(event)
-			Expect(metrics).To(HaveLen(10))
+			Expect(metrics).To(HaveLen(12))
 			for _, metric := range metrics {
 				if metricsWithInstanceTag[metric.MetricKey.Name] {
 					Expect(metric.MetricValue.Tags).To(ContainElement("instance:4"))
@@ -235,7 +702,7 @@ var _ = Describe("AppMetrics", func() {
 			// instance_index should be preferred over InstanceId
 			event.GetGauge().GetMetrics()["instance_index"] = &loggregator_v2.GaugeValue{Value: float64(3)}
 			metrics, err = a.Parse(event)
-			Expect(metrics).To(HaveLen(10))
+			Expect(metrics).To(HaveLen(12))
 			for _, metric := range metrics {
 				if metricsWithInstanceTag[metric.MetricKey.Name] {
 					Expect(metric.MetricValue.Tags).To(ContainElement("instance:3"))
@@ -247,7 +714,7 @@ var _ = Describe("AppMetrics", func() {
 	Context("custom tags", func() {
 		It("attaches custom tags if present", func() {
 			a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{"custom:tag", "foo:bar"},
-			"env_name")
+			"env_name", AppParserOptions{})
 			Expect(err).To(BeNil())
 			Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
 
@@ -293,7 +760,7 @@ var _ = Describe("AppMetrics", func() {
 			metrics, err := a.Parse(event)
 
 			Expect(err).To(BeNil())
-			Expect(metrics).To(HaveLen(10))
+			Expect(metrics).To(HaveLen(12))
 
 			for _, metric := range metrics {
 				Expect(metric.MetricValue.Tags).To(ContainElement("app_name:hello-datadog-cf-ruby-dev"))
@@ -306,6 +773,26 @@ var _ = Describe("AppMetrics", func() {
 	})
 })
 
+// countEndpoint returns how many times the path was requested
+func countEndpoint(api *FakeCloudControllerAPI, path string) int {
+	count := 0
+	for _, endpoint := range api.GetUsedEndpoints() {
+		if endpoint == path {
+			count++
+		}
+	}
+	return count
+}
+
+// metricValues returns the value of the first point of each metric by name
+func metricValues(metrics []metric.MetricPackage) map[string]float64 {
+	values := map[string]float64{}
+	for _, m := range metrics {
+		values[m.MetricKey.Name] = m.MetricValue.Points[0].Value
+	}
+	return values
+}
+
 type containMetric struct {
 	needle   string
 	haystack []metric.MetricPackage
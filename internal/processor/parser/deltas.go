@@ -0,0 +1,70 @@
+package parser
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+)
+
+// counterTotalTTL is how long the total of a counter that stopped reporting is kept
+const counterTotalTTL = time.Hour
+
+type counterKey struct {
+	name       string
+	sourceID   string
+	instanceID string
+	tagsHash   util.TagsHash
+}
+
+type counterTotal struct {
+	total    uint64
+	lastSeen time.Time
+}
+
+// counterDeltas remembers the last total of each counter series to compute the deltas of the counters
+// that only report their total
+type counterDeltas struct {
+	lock      sync.Mutex
+	totals    map[counterKey]counterTotal
+	lastSweep time.Time
+}
+
+func newCounterDeltas() *counterDeltas {
+	return &counterDeltas{
+		totals:    map[counterKey]counterTotal{},
+		lastSweep: time.Now(),
+	}
+}
+
+// delta records the total of the series and returns its increase since the previous total.
+// It returns false for the first total of a series, whose increase isn't known.
+func (d *counterDeltas) delta(key counterKey, total uint64) (uint64, bool) {
+	now := time.Now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	previous, ok := d.totals[key]
+	d.totals[key] = counterTotal{total: total, lastSeen: now}
+	if now.Sub(d.lastSweep) > counterTotalTTL {
+		d.sweep(now)
+	}
+	if !ok {
+		return 0, false
+	}
+	if total < previous.total {
+		// The emitter restarted and its counter with it
+		return total, true
+	}
+	return total - previous.total, true
+}
+
+// sweep forgets the series that stopped reporting
+func (d *counterDeltas) sweep(now time.Time) {
+	for key, total := range d.totals {
+		if now.Sub(total.lastSeen) > counterTotalTTL {
+			delete(d.totals, key)
+		}
+	}
+	d.lastSweep = now
+}
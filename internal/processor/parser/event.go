@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/events"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+const eventSourceTypeName = "cloudfoundry"
+
+// EventParser is used to turn event envelopes into Datadog events
+type EventParser struct {
+	Environment           string
+	DeploymentUUIDRegex   *regexp.Regexp
+	JobPartitionUUIDRegex *regexp.Regexp
+	CustomTags            []string
+}
+
+// NewEventParser creates a new EventParser
+func NewEventParser(
+	environment string,
+	deploymentUUIDRegex *regexp.Regexp,
+	jobPartitionUUIDRegex *regexp.Regexp,
+	customTags []string) *EventParser {
+	return &EventParser{
+		Environment:           environment,
+		DeploymentUUIDRegex:   deploymentUUIDRegex,
+		JobPartitionUUIDRegex: jobPartitionUUIDRegex,
+		CustomTags:            customTags,
+	}
+}
+
+// Parse takes an event envelope and converts it to a Datadog event
+func (p *EventParser) Parse(envelope *loggregator_v2.Envelope) (events.Event, error) {
+	event := events.Event{}
+	if _, ok := envelope.GetMessage().(*loggregator_v2.Envelope_Event); !ok {
+		return event, fmt.Errorf("not an event")
+	}
+	if envelope.GetEvent().GetTitle() == "" {
+		return event, fmt.Errorf("event has no title")
+	}
+
+	tags := parseTags(nil, envelope, p.Environment, p.DeploymentUUIDRegex, p.JobPartitionUUIDRegex)
+	tags = append(tags, p.CustomTags...)
+
+	event.Title = envelope.GetEvent().GetTitle()
+	event.Text = envelope.GetEvent().GetBody()
+	event.DateHappened = envelope.GetTimestamp() / int64(time.Second)
+	event.Host = parseHost(envelope)
+	event.Tags = tags
+	event.AlertType = "info"
+	event.SourceTypeName = eventSourceTypeName
+	event.AggregationKey = envelope.GetSourceId()
+	return event, nil
+}
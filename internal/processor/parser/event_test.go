@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+var _ = Describe("EventParser", func() {
+	var (
+		eventParser *EventParser
+	)
+
+	BeforeEach(func() {
+		eventParser = NewEventParser(
+			"env_name",
+			regexp.MustCompile("-([0-9a-f]{20})"),
+			regexp.MustCompile("-partition-([0-9a-f]{20})"),
+			[]string{"custom:tag"},
+		)
+	})
+
+	It("ignores envelopes that aren't events", func() {
+		_, err := eventParser.Parse(&loggregator_v2.Envelope{
+			Timestamp: 1000000000,
+			Message: &loggregator_v2.Envelope_Log{
+				Log: &loggregator_v2.Log{Payload: []byte("hello")},
+			},
+		})
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("ignores events without a title", func() {
+		_, err := eventParser.Parse(&loggregator_v2.Envelope{
+			Timestamp: 1000000000,
+			Message: &loggregator_v2.Envelope_Event{
+				Event: &loggregator_v2.Event{Body: "some body"},
+			},
+		})
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("converts an event", func() {
+		event, err := eventParser.Parse(&loggregator_v2.Envelope{
+			Timestamp: 1500000000000000000,
+			SourceId:  "bosh-system-metrics-forwarder",
+			Tags: map[string]string{
+				"origin":     "bosh-system-metrics-forwarder",
+				"deployment": "cf",
+				"job":        "diego_cell",
+				"index":      "1",
+			},
+			Message: &loggregator_v2.Envelope_Event{
+				Event: &loggregator_v2.Event{
+					Title: "process is not running",
+					Body:  "consul_agent has failed",
+				},
+			},
+		})
+		Expect(err).To(BeNil())
+		Expect(event.Title).To(Equal("process is not running"))
+		Expect(event.Text).To(Equal("consul_agent has failed"))
+		Expect(event.DateHappened).To(Equal(int64(1500000000)))
+		Expect(event.Host).To(Equal("1"))
+		Expect(event.AlertType).To(Equal("info"))
+		Expect(event.SourceTypeName).To(Equal("cloudfoundry"))
+		Expect(event.AggregationKey).To(Equal("bosh-system-metrics-forwarder"))
+		Expect(event.Tags).To(ContainElement("deployment:cf"))
+		Expect(event.Tags).To(ContainElement("job:diego_cell"))
+		Expect(event.Tags).To(ContainElement("env:env_name"))
+		Expect(event.Tags).To(ContainElement("custom:tag"))
+	})
+})
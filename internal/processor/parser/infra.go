@@ -1,9 +1,10 @@
 package parser
 
 import (
-	"fmt"
+	"errors"
 	"regexp"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
@@ -17,24 +18,49 @@ type InfraParser struct {
 	DeploymentUUIDRegex   *regexp.Regexp
 	JobPartitionUUIDRegex *regexp.Regexp
 	CustomTags            []string
+	CounterTotals         bool
+	TagRewriter           *TagRewriter
+	Renamer               *Renamer
+	deltas                *counterDeltas
 }
 
+// NewInfraParser creates a new InfraParser, counters are reported as counts of their delta
+// unless counterTotals is set, in which case they are reported as gauges of their cumulative total.
+// The delta of the counters that only report their total is the difference between their consecutive totals.
+// The tags are rewritten by tagRewriter when it is not nil.
+// The names are given by renamer, or by the default legacy names and rules when it is nil.
 func NewInfraParser(
 	environment string,
 	deploymentUUIDRegex *regexp.Regexp,
 	jobPartitionUUIDRegex *regexp.Regexp,
-	customTags []string) (*InfraParser, error) {
+	customTags []string,
+	counterTotals bool,
+	tagRewriter *TagRewriter,
+	renamer *Renamer) (*InfraParser, error) {
 	return &InfraParser{
 		Environment:           environment,
 		DeploymentUUIDRegex:   deploymentUUIDRegex,
 		JobPartitionUUIDRegex: jobPartitionUUIDRegex,
 		CustomTags:            customTags,
+		CounterTotals:         counterTotals,
+		TagRewriter:           tagRewriter,
+		Renamer:               renamer,
+		deltas:                newCounterDeltas(),
 	}, nil
 }
 
-func (p InfraParser) Parse(envelope *loggregator_v2.Envelope) ([]metric.MetricPackage, error) {
-	metrics := []metric.MetricPackage{}
+// errNotInfraMetric is returned for the envelopes the InfraParser doesn't handle, it isn't formatted for each envelope
+var errNotInfraMetric = errors.New("not an infra metric")
+
+// tagsPool holds the buffers the tags of the envelopes are built in before being copied to a slice of their exact size
+var tagsPool = sync.Pool{
+	New: func() interface{} {
+		tags := make([]string, 0, 32)
+		return &tags
+	},
+}
 
+func (p InfraParser) Parse(envelope *loggregator_v2.Envelope) ([]metric.MetricPackage, error) {
 	switch envelope.GetMessage().(type) {
 	case *loggregator_v2.Envelope_Counter:
 		break
@@ -44,75 +70,116 @@ func (p InfraParser) Parse(envelope *loggregator_v2.Envelope) ([]metric.MetricPa
 		}
 		// if it's container metric, return error (we don't handle container metrics here)
 		// NOTE: `fallthrough` is not allowed in type switch
-		return metrics, fmt.Errorf("not an infra metric")
+		return nil, errNotInfraMetric
 	default:
-		return metrics, fmt.Errorf("not an infra metric")
+		return nil, errNotInfraMetric
 	}
 
 	host := parseHost(envelope)
-	tags := parseTags(envelope, p.Environment, p.DeploymentUUIDRegex, p.JobPartitionUUIDRegex)
-	tags = append(tags, p.CustomTags...)
+	tags := p.parseTags(envelope)
 	tagsHash := util.HashTags(tags)
+	metricType := getType(envelope, p.CounterTotals)
+	timestamp := envelope.GetTimestamp() / int64(time.Second)
+	origin := envelope.GetTags()["origin"]
 
-	for name, value := range getValues(envelope) {
+	var metrics []metric.MetricPackage
+	addMetric := func(name string, value float64) {
 		// create metricValues
-		metricValues := metric.MetricValue{}
-		metricValues.Host = host
-		metricValues.Tags = tags
-		metricValues.Points = append(metricValues.Points, metric.Point{
-			Timestamp: envelope.GetTimestamp() / int64(time.Second),
-			Value:     value,
-		})
-
-		var names []string
-		// Basic metric name
-		names = append(names, name)
-		// Legacy metric name
-		if origin, ok := envelope.GetTags()["origin"]; ok {
-			names = append(names, origin+"."+name)
-		}
-		// BOSH alias metric name
-		if strings.HasPrefix(name, "bosh-hm-forwarder") {
-			names = append(names, strings.Replace(name, "bosh-hm-forwarder", "bosh.healthmonitor", 1))
+		metricValues := &metric.MetricValue{
+			Host:   host,
+			Tags:   tags,
+			Type:   metricType,
+			Points: []metric.Point{{Timestamp: timestamp, Value: value}},
 		}
 
 		// Create metric for each names with same values
-		for i := 0; i < len(names); i++ {
+		keys := p.Renamer.Keys(name, origin, tagsHash)
+		for i := range keys {
 			metrics = append(metrics, metric.MetricPackage{
-				MetricKey: &metric.MetricKey{
-					Name:     names[i],
-					TagsHash: tagsHash,
-				},
-				MetricValue: &metricValues,
+				MetricKey:   &keys[i],
+				MetricValue: metricValues,
 			})
 		}
 	}
 
-	return metrics, nil
-}
-
-func getValues(envelope *loggregator_v2.Envelope) map[string]float64 {
-	values := map[string]float64{}
-	switch envelope.GetMessage().(type) {
+	switch message := envelope.GetMessage().(type) {
 	case *loggregator_v2.Envelope_Gauge:
-		for k, v := range envelope.GetGauge().GetMetrics() {
-			values[k] = v.Value
+		for name, value := range message.Gauge.GetMetrics() {
+			addMetric(name, value.GetValue())
 		}
 	case *loggregator_v2.Envelope_Counter:
-		values[envelope.GetCounter().GetName()] = float64(envelope.GetCounter().GetTotal())
-	default:
-		panic("Unknown event type")
+		if p.CounterTotals {
+			addMetric(message.Counter.GetName(), float64(message.Counter.GetTotal()))
+		} else if delta, ok := p.counterDelta(envelope, message.Counter, tagsHash); ok {
+			addMetric(message.Counter.GetName(), float64(delta))
+		}
+	}
+
+	return metrics, nil
+}
+
+// counterDelta returns the delta of the counter, or the increase of its total when it only reports its total.
+// It returns false for the first total of a series.
+func (p InfraParser) counterDelta(envelope *loggregator_v2.Envelope, counter *loggregator_v2.Counter, tagsHash util.TagsHash) (uint64, bool) {
+	if counter.GetTotal() == 0 || p.deltas == nil {
+		return counter.GetDelta(), true
+	}
+	// The total is recorded even when the delta is set, in case the next envelopes of the series only have their total
+	key := counterKey{
+		name:       counter.GetName(),
+		sourceID:   envelope.GetSourceId(),
+		instanceID: envelope.GetInstanceId(),
+		tagsHash:   tagsHash,
 	}
-	return values
+	delta, ok := p.deltas.delta(key, counter.GetTotal())
+	if counter.GetDelta() > 0 {
+		return counter.GetDelta(), true
+	}
+	return delta, ok
 }
 
+// parseTags returns the sorted tags of the envelope, the custom tags and the rewritten tags.
+// They are built in a pooled buffer and the returned slice has their exact size.
+func (p InfraParser) parseTags(envelope *loggregator_v2.Envelope) []string {
+	buffer := tagsPool.Get().(*[]string)
+	built := parseTags((*buffer)[:0], envelope, p.Environment, p.DeploymentUUIDRegex, p.JobPartitionUUIDRegex)
+	built = append(built, p.CustomTags...)
+
+	var tags []string
+	if p.TagRewriter != nil {
+		// Rewrite returns a new slice
+		tags = p.TagRewriter.Rewrite(built)
+	} else {
+		tags = make([]string, len(built))
+		copy(tags, built)
+	}
+	// Sorted tags make the payloads deterministic
+	sort.Strings(tags)
+
+	// Release the strings before putting the buffer back, keeping its capacity
+	for i := range built {
+		built[i] = ""
+	}
+	*buffer = built[:0]
+	tagsPool.Put(buffer)
+	return tags
+}
+
+func getType(envelope *loggregator_v2.Envelope, counterTotals bool) string {
+	if _, ok := envelope.GetMessage().(*loggregator_v2.Envelope_Counter); ok && !counterTotals {
+		return metric.CountType
+	}
+	return metric.GaugeType
+}
+
+// parseTags appends the tags of the envelope to tags
 func parseTags(
+	tags []string,
 	envelope *loggregator_v2.Envelope,
 	environment string,
 	deploymentUUIDRegex *regexp.Regexp,
 	jobPartitionUUIDRegex *regexp.Regexp) []string {
 
-	var tags []string
 	for tname, tvalue := range envelope.GetTags() {
 		tags = appendTagIfNotEmpty(tags, tname, tvalue)
 	}
@@ -127,7 +194,7 @@ func parseTags(
 	if deployment, ok := envelope.GetTags()["deployment"]; ok {
 		newDeploymentTag := deploymentUUIDRegex.ReplaceAllString(deployment, "")
 		if environment != "" {
-			tags = appendTagIfNotEmpty(tags, "deployment", fmt.Sprintf("%s_%s", newDeploymentTag, environment))
+			tags = appendTagIfNotEmpty(tags, "deployment", newDeploymentTag+"_"+environment)
 		}
 		// Do not duplicate tag
 		if newDeploymentTag != deployment {
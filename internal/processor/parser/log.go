@@ -0,0 +1,75 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+const logSource = "cloudfoundry"
+
+// LogParser is used to turn log envelopes into Datadog log messages
+type LogParser struct {
+	Environment           string
+	DeploymentUUIDRegex   *regexp.Regexp
+	JobPartitionUUIDRegex *regexp.Regexp
+	CustomTags            []string
+	appParser             *AppParser
+}
+
+// NewLogParser creates a new LogParser, appParser is optional and only used to enrich app logs with app tags
+func NewLogParser(
+	environment string,
+	deploymentUUIDRegex *regexp.Regexp,
+	jobPartitionUUIDRegex *regexp.Regexp,
+	customTags []string,
+	appParser *AppParser) *LogParser {
+	return &LogParser{
+		Environment:           environment,
+		DeploymentUUIDRegex:   deploymentUUIDRegex,
+		JobPartitionUUIDRegex: jobPartitionUUIDRegex,
+		CustomTags:            customTags,
+		appParser:             appParser,
+	}
+}
+
+// Parse takes a log envelope and converts it to a log message
+func (p *LogParser) Parse(envelope *loggregator_v2.Envelope) (logs.LogMessage, error) {
+	logMessage := logs.LogMessage{}
+	if _, ok := envelope.GetMessage().(*loggregator_v2.Envelope_Log); !ok {
+		return logMessage, fmt.Errorf("not a log")
+	}
+
+	tags := parseTags(nil, envelope, p.Environment, p.DeploymentUUIDRegex, p.JobPartitionUUIDRegex)
+	tags = append(tags, p.CustomTags...)
+
+	service := envelope.GetTags()["origin"]
+	// Only look into the cache: platform components also send logs with a source id,
+	// and querying the cloud controller for each of them would flood it
+	if p.appParser != nil && envelope.GetSourceId() != "" {
+		if app := p.appParser.AppCache.Get(envelope.GetSourceId()); app != nil {
+			app.lock.RLock()
+			tags = append(tags, app.Tags...)
+			service = app.Name
+			app.lock.RUnlock()
+		}
+	}
+
+	status := "info"
+	if envelope.GetLog().GetType() == loggregator_v2.Log_ERR {
+		status = "error"
+	}
+
+	logMessage.Message = string(envelope.GetLog().GetPayload())
+	logMessage.Status = status
+	logMessage.Timestamp = envelope.GetTimestamp() / int64(time.Millisecond)
+	logMessage.Hostname = parseHost(envelope)
+	logMessage.Service = service
+	logMessage.Source = logSource
+	logMessage.Tags = tags
+	return logMessage, nil
+}
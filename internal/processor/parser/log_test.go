@@ -0,0 +1,118 @@
+package parser
+
+import (
+	"regexp"
+
+	. "github.com/DataDog/datadog-firehose-nozzle/test/helper"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/gosteno"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/client/cloudfoundry"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+)
+
+var _ = Describe("LogParser", func() {
+	var (
+		log                    *gosteno.Logger
+		fakeCloudControllerAPI *FakeCloudControllerAPI
+		fakeCfClient           *cloudfoundry.CFClient
+		deploymentUUIDRegex    *regexp.Regexp
+		jobPartitionUUIDRegex  *regexp.Regexp
+	)
+
+	BeforeEach(func() {
+		log = gosteno.NewLogger("logparser test")
+		fakeCloudControllerAPI = NewFakeCloudControllerAPI("bearer", "123456789")
+		fakeCloudControllerAPI.Start()
+
+		cfg := config.Config{
+			CloudControllerEndpoint: fakeCloudControllerAPI.URL(),
+			Client:                  "bearer",
+			ClientSecret:            "123456789",
+			InsecureSSLSkipVerify:   true,
+			NumWorkers:              5,
+		}
+		var err error
+		fakeCfClient, err = cloudfoundry.NewClient(&cfg, log)
+		Expect(err).To(BeNil())
+
+		deploymentUUIDRegex = regexp.MustCompile("-([0-9a-f]{20})")
+		jobPartitionUUIDRegex = regexp.MustCompile("-partition-([0-9a-f]{20})")
+	}, 0)
+
+	It("ignores envelopes that aren't logs", func() {
+		p := NewLogParser("", deploymentUUIDRegex, jobPartitionUUIDRegex, []string{}, nil)
+		_, err := p.Parse(&loggregator_v2.Envelope{
+			Timestamp: 1000000000,
+			Message: &loggregator_v2.Envelope_Counter{
+				Counter: &loggregator_v2.Counter{Name: "counterName", Total: uint64(1)},
+			},
+		})
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("converts a platform log", func() {
+		p := NewLogParser("env_name", deploymentUUIDRegex, jobPartitionUUIDRegex, []string{"custom:tag"}, nil)
+		logMessage, err := p.Parse(&loggregator_v2.Envelope{
+			Timestamp: 1500000000000,
+			SourceId:  "doppler",
+			Tags: map[string]string{
+				"origin":     "doppler",
+				"deployment": "cf",
+				"job":        "doppler",
+				"index":      "1",
+			},
+			Message: &loggregator_v2.Envelope_Log{
+				Log: &loggregator_v2.Log{
+					Payload: []byte("something went wrong"),
+					Type:    loggregator_v2.Log_ERR,
+				},
+			},
+		})
+		Expect(err).To(BeNil())
+		Expect(logMessage.Message).To(Equal("something went wrong"))
+		Expect(logMessage.Status).To(Equal("error"))
+		Expect(logMessage.Timestamp).To(Equal(int64(1500000)))
+		Expect(logMessage.Hostname).To(Equal("1"))
+		Expect(logMessage.Service).To(Equal("doppler"))
+		Expect(logMessage.Source).To(Equal("cloudfoundry"))
+		Expect(logMessage.Tags).To(ContainElement("deployment:cf"))
+		Expect(logMessage.Tags).To(ContainElement("env:env_name"))
+		Expect(logMessage.Tags).To(ContainElement("source_id:doppler"))
+		Expect(logMessage.Tags).To(ContainElement("custom:tag"))
+	})
+
+	It("adds the app tags of cached apps", func() {
+		a, err := NewAppParser(fakeCfClient, 5, 10, log, []string{}, "", AppParserOptions{})
+		Expect(err).To(BeNil())
+		Eventually(a.AppCache.IsWarmedUp).Should(BeTrue())
+
+		p := NewLogParser("", deploymentUUIDRegex, jobPartitionUUIDRegex, []string{}, a)
+		logMessage, err := p.Parse(&loggregator_v2.Envelope{
+			Timestamp:  1000000000,
+			SourceId:   "6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a",
+			InstanceId: "0",
+			Tags: map[string]string{
+				"origin":      "rep",
+				"source_type": "APP/PROC/WEB",
+			},
+			Message: &loggregator_v2.Envelope_Log{
+				Log: &loggregator_v2.Log{
+					Payload: []byte("hello"),
+					Type:    loggregator_v2.Log_OUT,
+				},
+			},
+		})
+		Expect(err).To(BeNil())
+		Expect(logMessage.Status).To(Equal("info"))
+		Expect(logMessage.Service).To(Equal("hello-datadog-cf-ruby-dev"))
+		Expect(logMessage.Tags).To(ContainElement("source_type:APP/PROC/WEB"))
+		Expect(logMessage.Tags).To(ContainElement("app_name:hello-datadog-cf-ruby-dev"))
+		Expect(logMessage.Tags).To(ContainElement("guid:6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a"))
+		Expect(logMessage.Tags).To(ContainElement(HavePrefix("org_name:")))
+		Expect(logMessage.Tags).To(ContainElement(HavePrefix("space_name:")))
+	})
+})
@@ -0,0 +1,87 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+)
+
+type nameRule struct {
+	config.MetricNameRule
+	pattern *regexp.Regexp
+}
+
+// Renamer gives the names under which the infra metrics are reported
+type Renamer struct {
+	legacyNames bool
+	rules       []nameRule
+}
+
+// defaultRenamer is used by a nil Renamer, it keeps the legacy names and the default rules
+var defaultRenamer, _ = NewRenamer(true, config.DefaultMetricNameRules())
+
+// NewRenamer checks and compiles the metric name rules,
+// the metrics are also reported as `origin.name` when legacyNames is set
+func NewRenamer(legacyNames bool, rules []config.MetricNameRule) (*Renamer, error) {
+	r := &Renamer{legacyNames: legacyNames}
+	for i, rule := range rules {
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("metric name rule %d has no Pattern", i)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("metric name rule %d has an invalid Pattern: %v", i, err)
+		}
+		if rule.Alias && rule.Replacement == "" && rule.Prefix == nil {
+			return nil, fmt.Errorf("metric name rule %d is an alias without Replacement nor Prefix", i)
+		}
+		r.rules = append(r.rules, nameRule{MetricNameRule: rule, pattern: pattern})
+	}
+	return r, nil
+}
+
+// Keys returns the keys of the series a metric of the origin is reported as
+func (r *Renamer) Keys(name string, origin string, tagsHash util.TagsHash) []metric.MetricKey {
+	if r == nil {
+		r = defaultRenamer
+	}
+
+	rule := r.match(name)
+	var keys []metric.MetricKey
+	if rule == nil || rule.Alias {
+		keys = append(keys, metric.MetricKey{Name: name, TagsHash: tagsHash})
+	} else {
+		keys = append(keys, rule.rename(name, tagsHash))
+	}
+	if r.legacyNames && origin != "" {
+		keys = append(keys, metric.MetricKey{Name: origin + "." + name, TagsHash: tagsHash})
+	}
+	if rule != nil && rule.Alias {
+		keys = append(keys, rule.rename(name, tagsHash))
+	}
+	return keys
+}
+
+func (r *Renamer) match(name string) *nameRule {
+	for i := range r.rules {
+		if r.rules[i].pattern.MatchString(name) {
+			return &r.rules[i]
+		}
+	}
+	return nil
+}
+
+func (rule *nameRule) rename(name string, tagsHash util.TagsHash) metric.MetricKey {
+	key := metric.MetricKey{Name: name, TagsHash: tagsHash}
+	if rule.Replacement != "" {
+		key.Name = rule.pattern.ReplaceAllString(name, rule.Replacement)
+	}
+	if rule.Prefix != nil {
+		key.Name = *rule.Prefix + key.Name
+		key.Prefixed = true
+	}
+	return key
+}
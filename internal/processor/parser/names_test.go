@@ -0,0 +1,62 @@
+package parser
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
+)
+
+var _ = Describe("Renamer", func() {
+	hash := util.HashTags([]string{"origin:test"})
+
+	It("uses the legacy names and the default rules when nil", func() {
+		var r *Renamer
+		Expect(r.Keys("bosh-hm-forwarder.foo", "bosh-system-metrics-forwarder", hash)).To(Equal([]metric.MetricKey{
+			{Name: "bosh-hm-forwarder.foo", TagsHash: hash},
+			{Name: "bosh-system-metrics-forwarder.bosh-hm-forwarder.foo", TagsHash: hash},
+			{Name: "bosh.healthmonitor.foo", TagsHash: hash, Prefixed: true},
+		}))
+	})
+
+	It("does not report the legacy names when disabled", func() {
+		r, err := NewRenamer(false, nil)
+		Expect(err).To(BeNil())
+		Expect(r.Keys("foo", "origin", hash)).To(Equal([]metric.MetricKey{
+			{Name: "foo", TagsHash: hash},
+		}))
+	})
+
+	It("applies the first matching rule", func() {
+		custom := "custom."
+		r, err := NewRenamer(true, []config.MetricNameRule{
+			{Pattern: "^gorouter\\.(.*)$", Replacement: "router.$1"},
+			{Pattern: "^gorouter\\.latency$", Replacement: "never"},
+			{Pattern: "^uptime$", Alias: true, Prefix: &custom},
+		})
+		Expect(err).To(BeNil())
+
+		Expect(r.Keys("gorouter.latency", "gorouter", hash)).To(Equal([]metric.MetricKey{
+			{Name: "router.latency", TagsHash: hash},
+			{Name: "gorouter.gorouter.latency", TagsHash: hash},
+		}))
+		Expect(r.Keys("uptime", "", hash)).To(Equal([]metric.MetricKey{
+			{Name: "uptime", TagsHash: hash},
+			{Name: "custom.uptime", TagsHash: hash, Prefixed: true},
+		}))
+		Expect(r.Keys("other", "", hash)).To(Equal([]metric.MetricKey{
+			{Name: "other", TagsHash: hash},
+		}))
+	})
+
+	It("rejects invalid rules", func() {
+		_, err := NewRenamer(true, []config.MetricNameRule{{Replacement: "foo"}})
+		Expect(err).To(HaveOccurred())
+		_, err = NewRenamer(true, []config.MetricNameRule{{Pattern: "("}})
+		Expect(err).To(HaveOccurred())
+		_, err = NewRenamer(true, []config.MetricNameRule{{Pattern: "foo", Alias: true}})
+		Expect(err).To(HaveOccurred())
+	})
+})
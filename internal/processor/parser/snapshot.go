@@ -0,0 +1,103 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/client/cloudfoundry"
+)
+
+// cacheSnapshot is the content of the app cache file
+type cacheSnapshot struct {
+	Saved time.Time
+	Apps  []cloudfoundry.CFApplication
+}
+
+// Save writes the apps of the cache to path
+func (c *appCache) Save(path string) error {
+	c.lock.RLock()
+	snapshot := cacheSnapshot{
+		Saved: time.Now(),
+		Apps:  make([]cloudfoundry.CFApplication, 0, len(c.apps)),
+	}
+	for _, app := range c.apps {
+		snapshot.Apps = append(snapshot.Apps, app.cfApplication())
+	}
+	c.lock.RUnlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("error encoding app cache: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating app cache directory: %v", err)
+	}
+	// Write to a temporary file first so that a crash never leaves a truncated cache behind
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing app cache: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing app cache: %v", err)
+	}
+	return nil
+}
+
+// Load adds the apps saved in path to the cache and marks it as stale until the next refresh.
+// It returns when the apps were saved.
+func (c *appCache) Load(path string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return time.Time{}, fmt.Errorf("error decoding app cache %s: %v", path, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, cfApp := range snapshot.Apps {
+		if _, ok := c.apps[cfApp.GUID]; ok {
+			continue
+		}
+		app := newApp(cfApp.GUID)
+		if err := app.setAppData(cfApp); err != nil {
+			continue
+		}
+		// The app has no refresh time, it is evicted by the next refresh if it was deleted meanwhile
+		c.apps[cfApp.GUID] = app
+	}
+	if !c.warmedUp {
+		c.warmedUp = true
+		c.stale = true
+	}
+	return snapshot.Saved, nil
+}
+
+// cfApplication returns the data the app was set from
+func (a *App) cfApplication() cloudfoundry.CFApplication {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return cloudfoundry.CFApplication{
+		GUID:           a.GUID,
+		Name:           a.Name,
+		SpaceGUID:      a.SpaceID,
+		SpaceName:      a.SpaceName,
+		OrgName:        a.OrgName,
+		OrgGUID:        a.OrgID,
+		Instances:      a.NumberOfInstances,
+		Buildpacks:     a.Buildpacks,
+		DiskQuota:      a.TotalDiskConfigured,
+		TotalDiskQuota: a.TotalDiskProvisioned,
+		Memory:         a.TotalMemoryConfigured,
+		TotalMemory:    a.TotalMemoryProvisioned,
+	}
+}
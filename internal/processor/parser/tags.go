@@ -0,0 +1,121 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+)
+
+// Tag rule actions
+const (
+	TagActionDrop    = "drop"
+	TagActionRename  = "rename"
+	TagActionAdd     = "add"
+	TagActionReplace = "replace"
+	TagActionMap     = "map"
+)
+
+type tagRule struct {
+	config.TagRule
+	pattern *regexp.Regexp
+}
+
+// TagRewriter applies the tag rules of the config to the tags of the metrics
+type TagRewriter struct {
+	rules []tagRule
+}
+
+// NewTagRewriter checks and compiles the tag rules, it returns nil when there are no rules
+func NewTagRewriter(rules []config.TagRule) (*TagRewriter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	r := &TagRewriter{}
+	for i, rule := range rules {
+		compiled := tagRule{TagRule: rule}
+		if rule.Tag == "" {
+			return nil, fmt.Errorf("tag rule %d has no Tag", i)
+		}
+		switch rule.Action {
+		case TagActionDrop:
+		case TagActionRename:
+			if rule.Target == "" {
+				return nil, fmt.Errorf("tag rule %d renames %s without a Target", i, rule.Tag)
+			}
+		case TagActionAdd:
+			if rule.Value == "" {
+				return nil, fmt.Errorf("tag rule %d adds %s without a Value", i, rule.Tag)
+			}
+		case TagActionReplace:
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("tag rule %d has an invalid Pattern: %v", i, err)
+			}
+			compiled.pattern = pattern
+		case TagActionMap:
+			if len(rule.Mapping) == 0 {
+				return nil, fmt.Errorf("tag rule %d maps %s without a Mapping", i, rule.Tag)
+			}
+		default:
+			return nil, fmt.Errorf("tag rule %d has an unknown Action %q", i, rule.Action)
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// Rewrite returns the tags rewritten by the rules, tags is left untouched
+func (r *TagRewriter) Rewrite(tags []string) []string {
+	if r == nil {
+		return tags
+	}
+
+	rewritten := make([]string, len(tags), len(tags)+len(r.rules))
+	copy(rewritten, tags)
+	for _, rule := range r.rules {
+		if rule.Action == TagActionAdd {
+			rewritten = append(rewritten, rule.Tag+":"+rule.Value)
+			continue
+		}
+
+		kept := rewritten[:0]
+		for _, tag := range rewritten {
+			name, value := splitTag(tag)
+			if name != rule.Tag {
+				kept = append(kept, tag)
+				continue
+			}
+			switch rule.Action {
+			case TagActionRename:
+				kept = append(kept, joinTag(rule.Target, value))
+			case TagActionReplace:
+				// Tags left without a value are dropped
+				kept = appendTagIfNotEmpty(kept, name, rule.pattern.ReplaceAllString(value, rule.Replacement))
+			case TagActionMap:
+				if mapped, ok := rule.Mapping[value]; ok {
+					value = mapped
+				}
+				kept = append(kept, joinTag(name, value))
+			}
+		}
+		rewritten = kept
+	}
+	return rewritten
+}
+
+func splitTag(tag string) (string, string) {
+	if i := strings.Index(tag, ":"); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
+func joinTag(name string, value string) string {
+	if value == "" {
+		return name
+	}
+	return name + ":" + value
+}
@@ -0,0 +1,63 @@
+package parser
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+)
+
+var _ = Describe("TagRewriter", func() {
+	It("leaves the tags untouched without rules", func() {
+		r, err := NewTagRewriter(nil)
+		Expect(err).To(BeNil())
+		Expect(r).To(BeNil())
+		Expect(r.Rewrite([]string{"ip:10.0.0.1"})).To(Equal([]string{"ip:10.0.0.1"}))
+	})
+
+	It("applies the rules in order", func() {
+		r, err := NewTagRewriter([]config.TagRule{
+			{Action: TagActionDrop, Tag: "ip"},
+			{Action: TagActionRename, Tag: "index", Target: "bosh_index"},
+			{Action: TagActionMap, Tag: "deployment", Mapping: map[string]string{"cf": "platform", "mysql": "data"}},
+			{Action: TagActionReplace, Tag: "job", Pattern: "^(.*)-partition-[0-9a-f]+$", Replacement: "$1"},
+			{Action: TagActionAdd, Tag: "team", Value: "sre"},
+		})
+		Expect(err).To(BeNil())
+
+		tags := []string{"ip:10.0.0.1", "index:abc", "deployment:cf", "deployment:other", "job:router-partition-1234", "origin:gorouter"}
+		Expect(r.Rewrite(tags)).To(Equal([]string{
+			"bosh_index:abc",
+			"deployment:platform",
+			"deployment:other",
+			"job:router",
+			"origin:gorouter",
+			"team:sre",
+		}))
+		// The input tags are not modified
+		Expect(tags[0]).To(Equal("ip:10.0.0.1"))
+	})
+
+	It("drops tags left without a value", func() {
+		r, err := NewTagRewriter([]config.TagRule{
+			{Action: TagActionReplace, Tag: "placement_tag", Pattern: "^isolated$", Replacement: ""},
+		})
+		Expect(err).To(BeNil())
+		Expect(r.Rewrite([]string{"placement_tag:isolated", "placement_tag:shared"})).To(Equal([]string{"placement_tag:shared"}))
+	})
+
+	It("rejects invalid rules", func() {
+		invalid := []config.TagRule{
+			{Action: TagActionDrop},
+			{Action: "upcase", Tag: "job"},
+			{Action: TagActionRename, Tag: "index"},
+			{Action: TagActionAdd, Tag: "team"},
+			{Action: TagActionReplace, Tag: "job", Pattern: "("},
+			{Action: TagActionMap, Tag: "deployment"},
+		}
+		for _, rule := range invalid {
+			_, err := NewTagRewriter([]config.TagRule{rule})
+			Expect(err).NotTo(BeNil(), "rule %+v should be rejected", rule)
+		}
+	})
+})
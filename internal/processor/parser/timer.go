@@ -0,0 +1,197 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+// maxLatencySamples bounds the number of latencies kept per app between two flushes
+const maxLatencySamples = 1000
+
+var latencyPercentiles = []struct {
+	name     string
+	quantile float64
+}{
+	{"app.http.latency.p50", 0.50},
+	{"app.http.latency.p95", 0.95},
+	{"app.http.latency.p99", 0.99},
+}
+
+type httpStats struct {
+	requests      uint64
+	statusClasses map[string]uint64
+	latencySum    float64
+	latencyMax    float64
+	samples       []float64
+}
+
+func newHTTPStats() *httpStats {
+	return &httpStats{
+		statusClasses: map[string]uint64{},
+	}
+}
+
+func (s *httpStats) add(latency float64, statusClass string) {
+	s.requests++
+	if statusClass != "" {
+		s.statusClasses[statusClass]++
+	}
+	s.latencySum += latency
+	if latency > s.latencyMax {
+		s.latencyMax = latency
+	}
+	// Reservoir sampling keeps the memory used by busy apps bounded
+	if len(s.samples) < maxLatencySamples {
+		s.samples = append(s.samples, latency)
+	} else if i := rand.Int63n(int64(s.requests)); i < maxLatencySamples {
+		s.samples[i] = latency
+	}
+}
+
+func (s *httpStats) percentile(quantile float64) float64 {
+	if len(s.samples) == 0 {
+		return 0
+	}
+	index := int(math.Ceil(quantile*float64(len(s.samples)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return s.samples[index]
+}
+
+// TimerParser aggregates gorouter http timers into per-app request metrics
+type TimerParser struct {
+	appParser *AppParser
+	lock      sync.Mutex
+	stats     map[string]*httpStats
+	lastFlush time.Time
+}
+
+// NewTimerParser creates a new TimerParser, the app parser is needed to tag metrics with app tags
+func NewTimerParser(appParser *AppParser) (*TimerParser, error) {
+	if appParser == nil {
+		return nil, fmt.Errorf("app metrics need to be enabled to use timer metrics")
+	}
+	return &TimerParser{
+		appParser: appParser,
+		stats:     map[string]*httpStats{},
+		lastFlush: time.Now(),
+	}, nil
+}
+
+// Errors returned for the timers that are not recorded
+var (
+	errNotHTTPTimer         = errors.New("not an http timer")
+	errInvalidTimerDuration = errors.New("invalid http timer duration")
+)
+
+// Parse records a gorouter http timer, metrics are only returned by Flush
+func (p *TimerParser) Parse(envelope *loggregator_v2.Envelope) ([]metric.MetricPackage, error) {
+	metricsPackages := []metric.MetricPackage{}
+	timer := envelope.GetTimer()
+	if timer == nil || timer.GetName() != "http" {
+		return metricsPackages, errNotHTTPTimer
+	}
+	// The cell also emits a timer for each request, only count the ones from the gorouter
+	if envelope.GetTags()["peer_type"] == "Server" {
+		return metricsPackages, nil
+	}
+
+	guid := envelope.GetSourceId()
+	if appID, ok := envelope.GetTags()["app_id"]; ok && appID != "" {
+		guid = appID
+	}
+	// Only look into the cache to avoid querying the cloud controller for each request
+	if guid == "" || p.appParser.AppCache.Get(guid) == nil {
+		return metricsPackages, nil
+	}
+
+	latency := float64(timer.GetStop()-timer.GetStart()) / float64(time.Millisecond)
+	if latency < 0 {
+		return metricsPackages, errInvalidTimerDuration
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats, ok := p.stats[guid]
+	if !ok {
+		stats = newHTTPStats()
+		p.stats[guid] = stats
+	}
+	stats.add(latency, getStatusClass(envelope.GetTags()["status_code"]))
+
+	return metricsPackages, nil
+}
+
+// Flush returns the metrics aggregated since the last flush and resets them
+func (p *TimerParser) Flush() []metric.MetricPackage {
+	p.lock.Lock()
+	allStats := p.stats
+	p.stats = map[string]*httpStats{}
+	now := time.Now()
+	window := now.Sub(p.lastFlush).Seconds()
+	p.lastFlush = now
+	p.lock.Unlock()
+
+	metricsPackages := []metric.MetricPackage{}
+	for guid, stats := range allStats {
+		app := p.appParser.AppCache.Get(guid)
+		if app == nil {
+			continue
+		}
+
+		sort.Float64s(stats.samples)
+		names := []string{
+			"app.http.requests",
+			"app.http.request_rate",
+			"app.http.latency.avg",
+			"app.http.latency.max",
+		}
+		values := []float64{
+			float64(stats.requests),
+			float64(stats.requests) / window,
+			stats.latencySum / float64(stats.requests),
+			stats.latencyMax,
+		}
+		for _, percentile := range latencyPercentiles {
+			names = append(names, percentile.name)
+			values = append(values, stats.percentile(percentile.quantile))
+		}
+
+		app.lock.RLock()
+		appMetrics, _ := app.mkMetrics(names, values, p.appParser.customTags, p.appParser.tagRewriter, now.Unix())
+		// The requests and responses are counted over the flush interval
+		if len(appMetrics) > 0 {
+			appMetrics[0].MetricValue.Type = metric.CountType
+		}
+		metricsPackages = append(metricsPackages, appMetrics...)
+		for statusClass, count := range stats.statusClasses {
+			tags := []string{fmt.Sprintf("status_code_class:%s", statusClass)}
+			tags = append(tags, p.appParser.customTags...)
+			statusMetrics, _ := app.mkMetrics([]string{"app.http.responses"}, []float64{float64(count)}, tags, p.appParser.tagRewriter, now.Unix())
+			for _, m := range statusMetrics {
+				m.MetricValue.Type = metric.CountType
+			}
+			metricsPackages = append(metricsPackages, statusMetrics...)
+		}
+		app.lock.RUnlock()
+	}
+
+	return metricsPackages
+}
+
+func getStatusClass(statusCode string) string {
+	if len(statusCode) != 3 || statusCode[0] < '1' || statusCode[0] > '5' {
+		return ""
+	}
+	return statusCode[:1] + "xx"
+}
@@ -0,0 +1,137 @@
+package parser
+
+import (
+	. "github.com/DataDog/datadog-firehose-nozzle/test/helper"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/gosteno"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/client/cloudfoundry"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+var _ = Describe("TimerParser", func() {
+	var (
+		log                    *gosteno.Logger
+		fakeCloudControllerAPI *FakeCloudControllerAPI
+		appParser              *AppParser
+		timerParser            *TimerParser
+	)
+
+	makeTimer := func(guid, statusCode, peerType string, durationMs int64) *loggregator_v2.Envelope {
+		return &loggregator_v2.Envelope{
+			Timestamp: 1000000000,
+			SourceId:  guid,
+			Tags: map[string]string{
+				"origin":      "gorouter",
+				"status_code": statusCode,
+				"peer_type":   peerType,
+			},
+			Message: &loggregator_v2.Envelope_Timer{
+				Timer: &loggregator_v2.Timer{
+					Name:  "http",
+					Start: 1000000000,
+					Stop:  1000000000 + durationMs*1000000,
+				},
+			},
+		}
+	}
+
+	findMetrics := func(metrics []metric.MetricPackage, name string) []metric.MetricPackage {
+		found := []metric.MetricPackage{}
+		for _, m := range metrics {
+			if m.MetricKey.Name == name {
+				found = append(found, m)
+			}
+		}
+		return found
+	}
+
+	BeforeEach(func() {
+		log = gosteno.NewLogger("timerparser test")
+		fakeCloudControllerAPI = NewFakeCloudControllerAPI("bearer", "123456789")
+		fakeCloudControllerAPI.Start()
+
+		cfg := config.Config{
+			CloudControllerEndpoint: fakeCloudControllerAPI.URL(),
+			Client:                  "bearer",
+			ClientSecret:            "123456789",
+			InsecureSSLSkipVerify:   true,
+			NumWorkers:              5,
+		}
+		fakeCfClient, err := cloudfoundry.NewClient(&cfg, log)
+		Expect(err).To(BeNil())
+
+		appParser, err = NewAppParser(fakeCfClient, 5, 10, log, []string{"custom:tag"}, "", AppParserOptions{})
+		Expect(err).To(BeNil())
+		Eventually(appParser.AppCache.IsWarmedUp).Should(BeTrue())
+
+		timerParser, err = NewTimerParser(appParser)
+		Expect(err).To(BeNil())
+	}, 0)
+
+	It("requires app metrics", func() {
+		_, err := NewTimerParser(nil)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("ignores envelopes that aren't http timers", func() {
+		_, err := timerParser.Parse(&loggregator_v2.Envelope{
+			Message: &loggregator_v2.Envelope_Timer{
+				Timer: &loggregator_v2.Timer{Name: "other"},
+			},
+		})
+		Expect(err).NotTo(BeNil())
+		Expect(timerParser.Flush()).To(BeEmpty())
+	})
+
+	It("aggregates requests per app", func() {
+		guid := "6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a"
+		for i := int64(1); i <= 100; i++ {
+			statusCode := "200"
+			if i > 90 {
+				statusCode = "503"
+			}
+			metrics, err := timerParser.Parse(makeTimer(guid, statusCode, "Client", i))
+			Expect(err).To(BeNil())
+			Expect(metrics).To(BeEmpty())
+		}
+		// Timers emitted by the cell and timers of unknown apps are not counted
+		timerParser.Parse(makeTimer(guid, "200", "Server", 1000))
+		timerParser.Parse(makeTimer("unknown-app", "200", "Client", 1000))
+
+		metrics := timerParser.Flush()
+		requests := findMetrics(metrics, "app.http.requests")
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].MetricValue.Points[0].Value).To(Equal(float64(100)))
+		Expect(requests[0].MetricValue.Type).To(Equal(metric.CountType))
+		Expect(requests[0].MetricValue.Tags).To(ContainElement("app_name:hello-datadog-cf-ruby-dev"))
+		Expect(requests[0].MetricValue.Tags).To(ContainElement("custom:tag"))
+
+		Expect(findMetrics(metrics, "app.http.request_rate")).To(HaveLen(1))
+		Expect(findMetrics(metrics, "app.http.request_rate")[0].MetricValue.Type).To(BeEmpty())
+		Expect(findMetrics(metrics, "app.http.latency.max")[0].MetricValue.Points[0].Value).To(Equal(float64(100)))
+		Expect(findMetrics(metrics, "app.http.latency.avg")[0].MetricValue.Points[0].Value).To(Equal(50.5))
+		Expect(findMetrics(metrics, "app.http.latency.p50")[0].MetricValue.Points[0].Value).To(Equal(float64(50)))
+		Expect(findMetrics(metrics, "app.http.latency.p95")[0].MetricValue.Points[0].Value).To(Equal(float64(95)))
+		Expect(findMetrics(metrics, "app.http.latency.p99")[0].MetricValue.Points[0].Value).To(Equal(float64(99)))
+
+		responses := findMetrics(metrics, "app.http.responses")
+		Expect(responses).To(HaveLen(2))
+		for _, m := range responses {
+			Expect(m.MetricValue.Type).To(Equal(metric.CountType))
+			if m.MetricValue.Points[0].Value == float64(90) {
+				Expect(m.MetricValue.Tags).To(ContainElement("status_code_class:2xx"))
+			} else {
+				Expect(m.MetricValue.Tags).To(ContainElement("status_code_class:5xx"))
+				Expect(m.MetricValue.Points[0].Value).To(Equal(float64(10)))
+			}
+		}
+
+		// Stats are reset after each flush
+		Expect(timerParser.Flush()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,101 @@
+package parser
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+// Policies applied to the envelopes whose timestamp is further from now than the maximum skew
+const (
+	TimestampPolicyKeep  = "keep"
+	TimestampPolicyDrop  = "drop"
+	TimestampPolicyClamp = "clamp"
+)
+
+// TimestampPolicy handles the late and future envelopes of the metrics
+type TimestampPolicy struct {
+	// counters first, they must be 64-bit aligned for atomic operations
+	late    uint64
+	future  uint64
+	policy  string
+	maxSkew int64 // in nanoseconds, like the envelope timestamps
+	now     func() time.Time
+}
+
+// NewTimestampPolicy creates a policy, policy defaults to keep.
+// It returns nil when maxSkewSeconds is 0, the envelopes are then kept as they are.
+func NewTimestampPolicy(policy string, maxSkewSeconds uint32) (*TimestampPolicy, error) {
+	switch policy {
+	case "":
+		policy = TimestampPolicyKeep
+	case TimestampPolicyKeep, TimestampPolicyDrop, TimestampPolicyClamp:
+	default:
+		return nil, fmt.Errorf("unknown LateDataPolicy %q", policy)
+	}
+	if maxSkewSeconds == 0 {
+		return nil, nil
+	}
+
+	return &TimestampPolicy{
+		policy:  policy,
+		maxSkew: int64(maxSkewSeconds) * int64(time.Second),
+		now:     time.Now,
+	}, nil
+}
+
+// Apply counts the points of the envelope when it is late or in the future,
+// and clamps its timestamp to the maximum skew when needed.
+// It returns false when the envelope must be dropped.
+func (p *TimestampPolicy) Apply(envelope *loggregator_v2.Envelope) bool {
+	if p == nil || envelope.GetTimestamp() == 0 {
+		return true
+	}
+
+	now := p.now().UnixNano()
+	var bound int64
+	switch timestamp := envelope.GetTimestamp(); {
+	case timestamp < now-p.maxSkew:
+		atomic.AddUint64(&p.late, countPoints(envelope))
+		bound = now - p.maxSkew
+	case timestamp > now+p.maxSkew:
+		atomic.AddUint64(&p.future, countPoints(envelope))
+		bound = now + p.maxSkew
+	default:
+		return true
+	}
+
+	switch p.policy {
+	case TimestampPolicyDrop:
+		return false
+	case TimestampPolicyClamp:
+		envelope.Timestamp = bound
+	}
+	return true
+}
+
+// Late returns how many points were older than the maximum skew since the last call
+func (p *TimestampPolicy) Late() uint64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.SwapUint64(&p.late, 0)
+}
+
+// Future returns how many points were ahead of the maximum skew since the last call
+func (p *TimestampPolicy) Future() uint64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.SwapUint64(&p.future, 0)
+}
+
+// countPoints returns the number of values of a gauge, each counter or timer is one point
+func countPoints(envelope *loggregator_v2.Envelope) uint64 {
+	if gauge := envelope.GetGauge(); gauge != nil {
+		return uint64(len(gauge.GetMetrics()))
+	}
+	return 1
+}
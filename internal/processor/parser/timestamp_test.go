@@ -0,0 +1,93 @@
+package parser
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TimestampPolicy", func() {
+	now := time.Unix(1000, 0)
+
+	gauge := func(timestamp int64) *loggregator_v2.Envelope {
+		return &loggregator_v2.Envelope{
+			Timestamp: timestamp,
+			Message: &loggregator_v2.Envelope_Gauge{
+				Gauge: &loggregator_v2.Gauge{
+					Metrics: map[string]*loggregator_v2.GaugeValue{
+						"cpu":    {Unit: "percentage", Value: 1},
+						"memory": {Unit: "bytes", Value: 1},
+					},
+				},
+			},
+		}
+	}
+
+	newPolicy := func(policy string) *TimestampPolicy {
+		p, err := NewTimestampPolicy(policy, 60)
+		Expect(err).To(BeNil())
+		p.now = func() time.Time { return now }
+		return p
+	}
+
+	It("is disabled without a maximum skew", func() {
+		p, err := NewTimestampPolicy("drop", 0)
+		Expect(err).To(BeNil())
+		Expect(p).To(BeNil())
+		Expect(p.Apply(gauge(1))).To(BeTrue())
+		Expect(p.Late()).To(BeZero())
+	})
+
+	It("rejects unknown policies", func() {
+		_, err := NewTimestampPolicy("shift", 60)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("keeps and counts the late and future points by default", func() {
+		p := newPolicy("")
+		late := gauge(now.Add(-2 * time.Minute).UnixNano())
+		Expect(p.Apply(late)).To(BeTrue())
+		Expect(late.Timestamp).To(Equal(now.Add(-2 * time.Minute).UnixNano()))
+		Expect(p.Apply(&loggregator_v2.Envelope{
+			Timestamp: now.Add(2 * time.Minute).UnixNano(),
+			Message:   &loggregator_v2.Envelope_Counter{Counter: &loggregator_v2.Counter{Name: "requests", Total: 1}},
+		})).To(BeTrue())
+
+		Expect(p.Late()).To(BeEquivalentTo(2))
+		Expect(p.Future()).To(BeEquivalentTo(1))
+		// The counts are reset once read
+		Expect(p.Late()).To(BeZero())
+		Expect(p.Future()).To(BeZero())
+	})
+
+	It("leaves the envelopes within the skew alone", func() {
+		p := newPolicy(TimestampPolicyDrop)
+		Expect(p.Apply(gauge(now.Add(-30 * time.Second).UnixNano()))).To(BeTrue())
+		Expect(p.Apply(gauge(now.Add(30 * time.Second).UnixNano()))).To(BeTrue())
+		// Envelopes without timestamp are reported at the time they are received
+		Expect(p.Apply(gauge(0))).To(BeTrue())
+		Expect(p.Late()).To(BeZero())
+		Expect(p.Future()).To(BeZero())
+	})
+
+	It("drops the late and future envelopes", func() {
+		p := newPolicy(TimestampPolicyDrop)
+		Expect(p.Apply(gauge(now.Add(-2 * time.Minute).UnixNano()))).To(BeFalse())
+		Expect(p.Apply(gauge(now.Add(2 * time.Minute).UnixNano()))).To(BeFalse())
+		Expect(p.Late()).To(BeEquivalentTo(2))
+		Expect(p.Future()).To(BeEquivalentTo(2))
+	})
+
+	It("clamps the late and future envelopes to the skew", func() {
+		p := newPolicy(TimestampPolicyClamp)
+		late := gauge(now.Add(-2 * time.Minute).UnixNano())
+		Expect(p.Apply(late)).To(BeTrue())
+		Expect(late.Timestamp).To(Equal(now.Add(-time.Minute).UnixNano()))
+
+		future := gauge(now.Add(2 * time.Minute).UnixNano())
+		Expect(p.Apply(future)).To(BeTrue())
+		Expect(future.Timestamp).To(Equal(now.Add(time.Minute).UnixNano()))
+	})
+})
@@ -1,7 +1,6 @@
 package parser
 
 import (
-	"fmt"
 	"strconv"
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 )
@@ -19,7 +18,7 @@ func parseHost(envelope *loggregator_v2.Envelope) string {
 
 func appendTagIfNotEmpty(tags []string, key, value string) []string {
 	if value != "" {
-		tags = append(tags, fmt.Sprintf("%s:%s", key, value))
+		tags = append(tags, key+":"+value)
 	}
 	return tags
 }
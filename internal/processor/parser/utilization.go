@@ -0,0 +1,116 @@
+package parser
+
+import (
+	"math"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+// instanceSampleTTL is how long, in seconds, an instance that stopped reporting is kept in the aggregates of its app
+const instanceSampleTTL = 180
+
+// instanceSample holds the last container gauges of an app instance
+type instanceSample struct {
+	timestamp           int64 // of the last envelope of the instance
+	reported            bool  // whether the instance reported its container metric
+	cpu                 float64
+	memory              float64
+	disk                float64
+	absoluteUsage       float64
+	absoluteEntitlement float64
+}
+
+// deriveInstanceMetrics records the gauges of the instance and returns its utilization metrics
+func (a *App) deriveInstanceMetrics(instance string, gauges map[string]*loggregator_v2.GaugeValue, timestamp int64) ([]string, []float64) {
+	if a.instances == nil {
+		a.instances = map[string]*instanceSample{}
+	}
+	sample, ok := a.instances[instance]
+	if !ok {
+		sample = &instanceSample{}
+		a.instances[instance] = sample
+	}
+	sample.timestamp = timestamp
+
+	var names []string
+	var values []float64
+	if memory, ok := gaugeValue(gauges, "memory"); ok {
+		sample.memory = memory
+		sample.reported = true
+		if quota, ok := gaugeValue(gauges, "memory_quota"); ok && quota > 0 {
+			names = append(names, "app.memory.utilization")
+			values = append(values, 100*memory/quota)
+		}
+	}
+	if disk, ok := gaugeValue(gauges, "disk"); ok {
+		sample.disk = disk
+		if quota, ok := gaugeValue(gauges, "disk_quota"); ok && quota > 0 {
+			names = append(names, "app.disk.utilization")
+			values = append(values, 100*disk/quota)
+		}
+	}
+	if cpu, ok := gaugeValue(gauges, "cpu"); ok {
+		sample.cpu = cpu
+	}
+
+	// Older cells only emit the absolute cpu usage and entitlement, which grow over the life of the container.
+	// The entitlement percentage is their ratio since the previous envelope.
+	usage, hasUsage := gaugeValue(gauges, "absolute_usage")
+	entitlement, hasEntitlement := gaugeValue(gauges, "absolute_entitlement")
+	if hasUsage && hasEntitlement {
+		_, hasEntitlementPct := gaugeValue(gauges, "cpu_entitlement")
+		usageDelta := usage - sample.absoluteUsage
+		entitlementDelta := entitlement - sample.absoluteEntitlement
+		if !hasEntitlementPct && sample.absoluteEntitlement > 0 && usageDelta >= 0 && entitlementDelta > 0 {
+			names = append(names, "app.cpu.entitlement_pct")
+			values = append(values, 100*usageDelta/entitlementDelta)
+		}
+		sample.absoluteUsage = usage
+		sample.absoluteEntitlement = entitlement
+	}
+
+	return names, values
+}
+
+// aggregateInstances returns the metrics of the app across the instances that reported recently
+func (a *App) aggregateInstances(timestamp int64) ([]string, []float64) {
+	var memoryTotal, diskTotal, cpuTotal float64
+	memoryMax, cpuMax := math.Inf(-1), math.Inf(-1)
+	reported := 0
+	for instance, sample := range a.instances {
+		if timestamp-sample.timestamp > instanceSampleTTL {
+			delete(a.instances, instance)
+			continue
+		}
+		if !sample.reported {
+			continue
+		}
+		reported++
+		memoryTotal += sample.memory
+		memoryMax = math.Max(memoryMax, sample.memory)
+		diskTotal += sample.disk
+		cpuTotal += sample.cpu
+		cpuMax = math.Max(cpuMax, sample.cpu)
+	}
+	if reported == 0 {
+		return nil, nil
+	}
+
+	names := []string{
+		"app.memory.used.total",
+		"app.memory.used.max",
+		"app.disk.used.total",
+		"app.cpu.pct.total",
+		"app.cpu.pct.max",
+	}
+	values := []float64{memoryTotal, memoryMax, diskTotal, cpuTotal, cpuMax}
+	return names, values
+}
+
+func gaugeValue(gauges map[string]*loggregator_v2.GaugeValue, name string) (float64, bool) {
+	v, ok := gauges[name]
+	if !ok || v == nil {
+		return 0, false
+	}
+	return v.Value, true
+}
@@ -0,0 +1,111 @@
+package parser
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/client/cloudfoundry"
+)
+
+// appDeleteEvent is the audit event of a deleted app
+const appDeleteEvent = "audit.app.delete-request"
+
+// appEventTypes are the audit events that change the data of an app in the cache
+var appEventTypes = []string{
+	"audit.app.create",
+	"audit.app.update",
+	"audit.app.process.scale",
+	"audit.app.process.update",
+	appDeleteEvent,
+}
+
+// auditCursor is where the watcher resumes from: the creation time of the last events and their guids,
+// the next poll requests the events created at or after that time and skips the ones already applied
+type auditCursor struct {
+	since string
+	seen  map[string]bool
+}
+
+// watchAuditEvents polls the audit events of the apps and applies them to the cache until the parser stops
+func (am *AppParser) watchAuditEvents() {
+	cursor := auditCursor{since: time.Now().UTC().Format(time.RFC3339), seen: map[string]bool{}}
+	ticker := time.NewTicker(am.watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cursor = am.applyAuditEvents(cursor)
+		case <-am.watchStopper:
+			return
+		}
+	}
+}
+
+// applyAuditEvents updates the apps changed since the cursor and evicts the deleted ones, it returns the next cursor
+func (am *AppParser) applyAuditEvents(cursor auditCursor) auditCursor {
+	events, err := am.cfClient.GetAuditEvents(appEventTypes, cursor.since)
+	if err != nil {
+		am.log.Errorf("could not get the audit events of the apps: %v", err)
+		return cursor
+	}
+
+	// The events created at the time of the cursor are returned again, they are all seen again
+	next := auditCursor{since: cursor.since, seen: map[string]bool{}}
+	updated := map[string]bool{}
+	deleted := map[string]bool{}
+	for _, event := range events {
+		// The events are ordered by creation time
+		if event.CreatedAt != next.since {
+			next = auditCursor{since: event.CreatedAt, seen: map[string]bool{}}
+		}
+		next.seen[event.GUID] = true
+		if cursor.seen[event.GUID] || event.Target.Type != "app" {
+			continue
+		}
+		guid := event.Target.GUID
+		switch event.Type {
+		case appDeleteEvent:
+			deleted[guid] = true
+			delete(updated, guid)
+		case "audit.app.create", "audit.app.update", "audit.app.process.scale", "audit.app.process.update":
+			updated[guid] = true
+			delete(deleted, guid)
+		}
+	}
+
+	for guid := range deleted {
+		am.AppCache.Remove(guid)
+		// The envelopes of the app still in flight must not request it again
+		if am.negativeTTL > 0 {
+			am.AppCache.SetMissing(guid, am.negativeTTL)
+		}
+	}
+	if len(updated) > 0 {
+		guids := make([]string, 0, len(updated))
+		for guid := range updated {
+			guids = append(guids, guid)
+		}
+		cfapps, err := am.cfClient.GetApplicationsByGUID(guids)
+		if err != nil {
+			am.log.Errorf("could not get the apps changed by the audit events: %v", err)
+			// Retry them at the next poll
+			return cursor
+		}
+		am.addApps(cfapps, updated)
+	}
+	if len(updated)+len(deleted) > 0 {
+		am.log.Infof("applied the audit events of %d updated and %d deleted apps to the cache", len(updated), len(deleted))
+	}
+	return next
+}
+
+// addApps adds the apps of cfapps whose guid is in guids to the cache
+func (am *AppParser) addApps(cfapps []cloudfoundry.CFApplication, guids map[string]bool) {
+	for _, cfapp := range cfapps {
+		if !guids[cfapp.GUID] {
+			continue
+		}
+		if _, err := am.AppCache.Add(cfapp); err != nil {
+			am.log.Errorf("an error occurred when adding app to the cache: %v", err)
+		}
+	}
+}
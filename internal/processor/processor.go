@@ -1,10 +1,12 @@
 package processor
 
 import (
-	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/DataDog/datadog-firehose-nozzle/internal/client/cloudfoundry"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/events"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/processor/parser"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
@@ -18,14 +20,64 @@ const (
 	jobPartitionUUIDPattern = "-partition-([0-9a-f]{20})"
 )
 
+// envelopeKind is the key of the dispatch table of ProcessMetric
+type envelopeKind int
+
+const (
+	otherKind envelopeKind = iota
+	counterKind
+	gaugeKind
+	containerMetricKind
+	extendedContainerMetricKind // reported as infra gauges when app metrics are disabled
+	timerKind
+	numEnvelopeKinds
+)
+
+func kindOf(envelope *loggregator_v2.Envelope) envelopeKind {
+	switch envelope.GetMessage().(type) {
+	case *loggregator_v2.Envelope_Counter:
+		return counterKind
+	case *loggregator_v2.Envelope_Gauge:
+		if util.IsContainerMetric(envelope) {
+			return containerMetricKind
+		}
+		if util.IsExtendedContainerMetric(envelope) {
+			return extendedContainerMetricKind
+		}
+		return gaugeKind
+	case *loggregator_v2.Envelope_Timer:
+		return timerKind
+	}
+	return otherKind
+}
+
 // Processor extracts metrics from envelopes
 type Processor struct {
 	processedMetrics      chan<- []metric.MetricPackage
-	appMetrics            parser.Parser
-	customTags            []string
-	environment           string
+	processedLogs         chan<- logs.LogMessage
+	processedEvents       chan<- events.Event
+	infraParser           *parser.InfraParser
+	appMetrics            *parser.AppParser
+	timerMetrics          *parser.TimerParser
+	logParser             *parser.LogParser
+	eventParser           *parser.EventParser
 	deploymentUUIDRegex   *regexp.Regexp
 	jobPartitionUUIDRegex *regexp.Regexp
+	timestampPolicy       *parser.TimestampPolicy
+	// handlers of the kinds of envelopes, nil for the kinds that are ignored
+	handlers [numEnvelopeKinds]func(*loggregator_v2.Envelope)
+}
+
+// ProcessorOptions are the optional settings of a Processor, their zero values disable them
+type ProcessorOptions struct {
+	Logs            chan<- logs.LogMessage  // log envelopes are only processed when it is set
+	Events          chan<- events.Event     // event envelopes are only processed when it is set
+	TimerMetrics    bool                    // whether the http timers are reported
+	CounterTotals   bool                    // whether the counters that only report their total are reported as deltas
+	TagRewriter     *parser.TagRewriter     // rewrites the tags of the metrics, nil when they are not
+	Renamer         *parser.Renamer         // names the infra metrics
+	TimestampPolicy *parser.TimestampPolicy // handles the late and future metric envelopes, nil when they are kept
+	App             parser.AppParserOptions // the tag rewriter of the app metrics is TagRewriter
 }
 
 // NewProcessor creates a new processor
@@ -38,17 +90,34 @@ func NewProcessor(
 	numCacheWorkers int,
 	grabInterval int,
 	log *gosteno.Logger,
+	options ProcessorOptions,
 ) (*Processor, bool) {
 
 	processor := &Processor{
 		processedMetrics:      pm,
-		customTags:            customTags,
-		environment:           environment,
+		processedLogs:         options.Logs,
+		processedEvents:       options.Events,
 		deploymentUUIDRegex:   regexp.MustCompile(deploymentUUIDPattern),
 		jobPartitionUUIDRegex: regexp.MustCompile(jobPartitionUUIDPattern),
+		timestampPolicy:       options.TimestampPolicy,
 	}
 
+	processor.infraParser, _ = parser.NewInfraParser(
+		environment,
+		processor.deploymentUUIDRegex,
+		processor.jobPartitionUUIDRegex,
+		customTags,
+		options.CounterTotals,
+		options.TagRewriter,
+		options.Renamer,
+	)
+	processor.handlers[counterKind] = processor.processInfraMetric
+	processor.handlers[gaugeKind] = processor.processInfraMetric
+	processor.handlers[extendedContainerMetricKind] = processor.processInfraMetric
+
 	if parseAppMetricsEnable {
+		appOptions := options.App
+		appOptions.TagRewriter = options.TagRewriter
 		appMetrics, err := parser.NewAppParser(
 			cfClient,
 			numCacheWorkers,
@@ -56,6 +125,7 @@ func NewProcessor(
 			log,
 			customTags,
 			environment,
+			appOptions,
 		)
 		if err != nil {
 			parseAppMetricsEnable = false
@@ -63,66 +133,136 @@ func NewProcessor(
 		} else {
 			log.Debug("setting up app metrics")
 			processor.appMetrics = appMetrics
+			processor.handlers[containerMetricKind] = processor.processAppMetric
+			processor.handlers[extendedContainerMetricKind] = processor.processAppMetric
+		}
+	}
+
+	if options.TimerMetrics {
+		timerMetrics, err := parser.NewTimerParser(processor.appMetrics)
+		if err != nil {
+			log.Warnf("error setting up timer metrics, continuing without http timer metrics: %v", err)
+		} else {
+			log.Debug("setting up timer metrics")
+			processor.timerMetrics = timerMetrics
+			processor.handlers[timerKind] = processor.processTimerMetric
 		}
 	}
 
+	if options.Logs != nil {
+		// App tags are only available to logs when app metrics are enabled
+		processor.logParser = parser.NewLogParser(
+			environment,
+			processor.deploymentUUIDRegex,
+			processor.jobPartitionUUIDRegex,
+			customTags,
+			processor.appMetrics,
+		)
+	}
+
+	if options.Events != nil {
+		processor.eventParser = parser.NewEventParser(
+			environment,
+			processor.deploymentUUIDRegex,
+			processor.jobPartitionUUIDRegex,
+			customTags,
+		)
+	}
+
 	return processor, parseAppMetricsEnable
 }
 
 // ProcessMetric takes an envelope, parses it and sends the processed metrics to the nozzle
 func (p *Processor) ProcessMetric(envelope *loggregator_v2.Envelope) {
-	var err error
-	var metricsPackages []metric.MetricPackage
-
-	// Parse infrastructure type of envelopes
-	infraParser, err := parser.NewInfraParser(
-		p.environment,
-		p.deploymentUUIDRegex,
-		p.jobPartitionUUIDRegex,
-		p.customTags,
-	)
-	metricsPackages, err = infraParser.Parse(envelope)
+	kind := kindOf(envelope)
+	handler := p.handlers[kind]
+	if handler == nil {
+		return
+	}
+	// Timers are reported when they are flushed, their timestamp is not used
+	if kind != timerKind && !p.timestampPolicy.Apply(envelope) {
+		return
+	}
+	handler(envelope)
+}
+
+// processInfraMetric parses infrastructure type of envelopes
+func (p *Processor) processInfraMetric(envelope *loggregator_v2.Envelope) {
+	metricsPackages, err := p.infraParser.Parse(envelope)
 	if err == nil {
 		p.processedMetrics <- metricsPackages
-		// it can only be one or the other
-		return
 	}
+}
 
-	// Parse application type of envelopes
-	metricsPackages, err = p.parseAppMetric(envelope)
+// processAppMetric parses the container metrics of the apps once the cache is ready
+func (p *Processor) processAppMetric(envelope *loggregator_v2.Envelope) {
+	if !p.appMetrics.AppCache.IsWarmedUp() {
+		return
+	}
+	metricsPackages, err := p.appMetrics.Parse(envelope)
 	if err == nil {
 		p.processedMetrics <- metricsPackages
 	}
 }
 
-// StopAppMetrics stops the goroutine refreshing the apps cache
-func (p *Processor) StopAppMetrics() {
-	if p.appMetrics == nil {
+// processTimerMetric records the http timers, they are retrieved with FlushTimerMetrics
+func (p *Processor) processTimerMetric(envelope *loggregator_v2.Envelope) {
+	p.timerMetrics.Parse(envelope)
+}
+
+// ProcessLog takes a log envelope, parses it and sends the log message to the nozzle
+func (p *Processor) ProcessLog(envelope *loggregator_v2.Envelope) {
+	if p.logParser == nil {
 		return
 	}
 
-	appParser := p.appMetrics.(*parser.AppParser)
-	appParser.Stop()
+	logMessage, err := p.logParser.Parse(envelope)
+	if err == nil {
+		p.processedLogs <- logMessage
+	}
 }
 
-func (p *Processor) parseAppMetric(envelope *loggregator_v2.Envelope) ([]metric.MetricPackage, error) {
-	var metricsPackages []metric.MetricPackage
-	var err error
+// ProcessEvent takes an event envelope, parses it and sends the event to the nozzle
+func (p *Processor) ProcessEvent(envelope *loggregator_v2.Envelope) {
+	if p.eventParser == nil {
+		return
+	}
 
-	if p.appMetrics == nil {
-		return metricsPackages, fmt.Errorf("app metrics are not configured")
+	event, err := p.eventParser.Parse(envelope)
+	if err == nil {
+		p.processedEvents <- event
 	}
+}
 
-	if !util.IsContainerMetric(envelope) {
-		return metricsPackages, fmt.Errorf("not an app metric")
+// FlushTimerMetrics returns the http timer metrics aggregated since the last flush
+func (p *Processor) FlushTimerMetrics() []metric.MetricPackage {
+	if p.timerMetrics == nil {
+		return nil
 	}
+	return p.timerMetrics.Flush()
+}
 
-	appParser := p.appMetrics.(*parser.AppParser)
-	if !appParser.AppCache.IsWarmedUp() {
-		return metricsPackages, fmt.Errorf("app metrics cache is not yet ready, skipping envelope")
+// FlushAppMetrics returns the metrics of the apps across their instances, nil when app metrics are disabled
+func (p *Processor) FlushAppMetrics() []metric.MetricPackage {
+	if p.appMetrics == nil {
+		return nil
 	}
+	return p.appMetrics.FlushAggregates(time.Now().Unix())
+}
 
-	metricsPackages, err = p.appMetrics.Parse(envelope)
+// AppCacheStats returns the stats of the app cache, ok is false when app metrics are disabled
+func (p *Processor) AppCacheStats() (stats parser.AppCacheStats, ok bool) {
+	if p.appMetrics == nil {
+		return stats, false
+	}
+	return p.appMetrics.CacheStats(), true
+}
+
+// StopAppMetrics stops the goroutine refreshing the apps cache
+func (p *Processor) StopAppMetrics() {
+	if p.appMetrics == nil {
+		return
+	}
 
-	return metricsPackages, err
+	p.appMetrics.Stop()
 }
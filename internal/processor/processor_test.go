@@ -1,8 +1,17 @@
 package processor
 
 import (
+	"regexp"
+	"testing"
+	"time"
+
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/events"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/logs"
 	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/processor/parser"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/util"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -16,8 +25,7 @@ var (
 var _ = Describe("MetricProcessor", func() {
 	BeforeEach(func() {
 		mchan = make(chan []metric.MetricPackage, 1500)
-		p, _ = NewProcessor(mchan, []string{}, "", false,
-			nil, 4, 0, nil)
+		p, _ = NewProcessor(mchan, []string{}, "", false, nil, 4, 0, nil, ProcessorOptions{})
 	})
 
 	It("processes value & counter metrics", func() {
@@ -70,14 +78,84 @@ var _ = Describe("MetricProcessor", func() {
 			Expect(m.MetricValue.Tags).To(ContainElement("instance_id:123"))
 			if m.MetricKey.Name == "valueName" || m.MetricKey.Name == "origin.valueName" {
 				Expect(m.MetricValue.Points).To(Equal([]metric.Point{{Timestamp: 1, Value: 5.0}}))
+				Expect(m.MetricValue.Type).To(Equal(metric.GaugeType))
 			} else if m.MetricKey.Name == "counterName" || m.MetricKey.Name == "origin.counterName" {
-				Expect(m.MetricValue.Points).To(Equal([]metric.Point{{Timestamp: 2, Value: 11.0}}))
+				Expect(m.MetricValue.Points).To(Equal([]metric.Point{{Timestamp: 2, Value: 6.0}}))
+				Expect(m.MetricValue.Type).To(Equal(metric.CountType))
 			} else {
 				panic("unknown metric in package: " + m.MetricKey.Name)
 			}
 		}
 	})
 
+	It("reports counter totals as gauges when configured", func() {
+		p, _ = NewProcessor(mchan, []string{}, "", false, nil, 4, 0, nil, ProcessorOptions{CounterTotals: true})
+		p.ProcessMetric(&loggregator_v2.Envelope{
+			Timestamp: 2000000000,
+			Tags: map[string]string{
+				"origin":     "origin",
+				"deployment": "deployment-name",
+				"job":        "doppler",
+			},
+			Message: &loggregator_v2.Envelope_Counter{
+				Counter: &loggregator_v2.Counter{
+					Name:  "counterName",
+					Delta: uint64(6),
+					Total: uint64(11),
+				},
+			},
+		})
+
+		var metricPkg []metric.MetricPackage
+		Eventually(mchan).Should(Receive(&metricPkg))
+
+		Expect(metricPkg).To(HaveLen(2))
+		for _, m := range metricPkg {
+			Expect(m.MetricValue.Points).To(Equal([]metric.Point{{Timestamp: 2, Value: 11.0}}))
+			Expect(m.MetricValue.Type).To(Equal(metric.GaugeType))
+		}
+	})
+
+	It("computes the delta of the counters that only report their total", func() {
+		counterEnvelope := func(sourceID string, total uint64) *loggregator_v2.Envelope {
+			return &loggregator_v2.Envelope{
+				Timestamp: 2000000000,
+				SourceId:  sourceID,
+				Tags:      map[string]string{"origin": "origin"},
+				Message: &loggregator_v2.Envelope_Counter{
+					Counter: &loggregator_v2.Counter{Name: "counterName", Total: total},
+				},
+			}
+		}
+		values := func() []float64 {
+			var metricPkg []metric.MetricPackage
+			Eventually(mchan).Should(Receive(&metricPkg))
+			var values []float64
+			for _, m := range metricPkg {
+				if m.MetricKey.Name == "counterName" {
+					Expect(m.MetricValue.Type).To(Equal(metric.CountType))
+					values = append(values, m.MetricValue.Points[0].Value)
+				}
+			}
+			return values
+		}
+
+		// The first total of a series has no delta
+		p.ProcessMetric(counterEnvelope("a", 10))
+		Expect(values()).To(BeEmpty())
+		p.ProcessMetric(counterEnvelope("b", 100))
+		Expect(values()).To(BeEmpty())
+
+		p.ProcessMetric(counterEnvelope("a", 15))
+		Expect(values()).To(Equal([]float64{5}))
+		p.ProcessMetric(counterEnvelope("b", 130))
+		Expect(values()).To(Equal([]float64{30}))
+
+		// The counter was reset
+		p.ProcessMetric(counterEnvelope("a", 4))
+		Expect(values()).To(Equal([]float64{4}))
+	})
+
 	It("generates metrics twice: once with origin in name, once without", func() {
 		p.ProcessMetric(&loggregator_v2.Envelope{
 			Timestamp: 1000000000,
@@ -170,6 +248,41 @@ var _ = Describe("MetricProcessor", func() {
 		Expect(newBarFound).To(BeTrue())
 	})
 
+	It("reports the extended container gauges as infra metrics when app metrics are disabled", func() {
+		p.ProcessMetric(&loggregator_v2.Envelope{
+			Timestamp:  1000000000,
+			SourceId:   "app-id",
+			InstanceId: "0",
+			Tags: map[string]string{
+				"origin":     "rep",
+				"deployment": "deployment-name",
+				"job":        "diego-cell",
+			},
+			Message: &loggregator_v2.Envelope_Gauge{
+				Gauge: &loggregator_v2.Gauge{
+					Metrics: map[string]*loggregator_v2.GaugeValue{
+						"cpu_entitlement": &loggregator_v2.GaugeValue{
+							Unit:  "percentage",
+							Value: float64(42),
+						},
+					},
+				},
+			},
+		})
+
+		var metricPkg []metric.MetricPackage
+		Eventually(mchan).Should(Receive(&metricPkg))
+
+		found := false
+		for _, m := range metricPkg {
+			if m.MetricKey.Name == "cpu_entitlement" {
+				found = true
+				Expect(m.MetricValue.Points[0].Value).To(Equal(42.0))
+			}
+		}
+		Expect(found).To(BeTrue())
+	})
+
 	It("adds a new alias for `bosh-hm-forwarder` metrics", func() {
 		p.ProcessMetric(&loggregator_v2.Envelope{
 			Timestamp: 1000000000,
@@ -205,6 +318,8 @@ var _ = Describe("MetricProcessor", func() {
 				newFound = true
 			} else if m.MetricKey.Name == "bosh.healthmonitor.foo" {
 				boshAliasFound = true
+				// the alias is reported without the metric prefix
+				Expect(m.MetricKey.Prefixed).To(BeTrue())
 			}
 		}
 		Expect(legacyFound).To(BeTrue())
@@ -311,7 +426,7 @@ var _ = Describe("MetricProcessor", func() {
 		}
 
 		// Check it does the correct dogate tag replacements when env_name and index are set
-		p.environment = "env_name"
+		p.infraParser.Environment = "env_name"
 		p.ProcessMetric(&loggregator_v2.Envelope{
 			Timestamp: 1000000000,
 			Tags: map[string]string{
@@ -356,11 +471,77 @@ var _ = Describe("MetricProcessor", func() {
 		}
 	})
 
+	Context("logs", func() {
+		var lchan chan logs.LogMessage
+
+		BeforeEach(func() {
+			lchan = make(chan logs.LogMessage, 1500)
+			p, _ = NewProcessor(mchan, []string{"environment:foo"}, "", false, nil, 4, 0, nil, ProcessorOptions{Logs: lchan})
+		})
+
+		It("processes log envelopes", func() {
+			p.ProcessLog(&loggregator_v2.Envelope{
+				Timestamp: 1000000000,
+				Tags: map[string]string{
+					"origin":     "origin",
+					"deployment": "deployment-name",
+					"job":        "doppler",
+				},
+				Message: &loggregator_v2.Envelope_Log{
+					Log: &loggregator_v2.Log{
+						Payload: []byte("log message"),
+						Type:    loggregator_v2.Log_OUT,
+					},
+				},
+			})
+
+			var logMessage logs.LogMessage
+			Eventually(lchan).Should(Receive(&logMessage))
+			Expect(logMessage.Message).To(Equal("log message"))
+			Expect(logMessage.Tags).To(ContainElement("environment:foo"))
+			Expect(logMessage.Tags).To(ContainElement("deployment:deployment-name"))
+			Consistently(mchan).ShouldNot(Receive())
+		})
+	})
+
+	Context("events", func() {
+		var echan chan events.Event
+
+		BeforeEach(func() {
+			echan = make(chan events.Event, 1500)
+			p, _ = NewProcessor(mchan, []string{"environment:foo"}, "", false, nil, 4, 0, nil, ProcessorOptions{Events: echan})
+		})
+
+		It("processes event envelopes", func() {
+			p.ProcessEvent(&loggregator_v2.Envelope{
+				Timestamp: 1000000000,
+				Tags: map[string]string{
+					"origin":     "origin",
+					"deployment": "deployment-name",
+					"job":        "doppler",
+				},
+				Message: &loggregator_v2.Envelope_Event{
+					Event: &loggregator_v2.Event{
+						Title: "event title",
+						Body:  "event body",
+					},
+				},
+			})
+
+			var event events.Event
+			Eventually(echan).Should(Receive(&event))
+			Expect(event.Title).To(Equal("event title"))
+			Expect(event.Text).To(Equal("event body"))
+			Expect(event.Tags).To(ContainElement("environment:foo"))
+			Expect(event.Tags).To(ContainElement("deployment:deployment-name"))
+			Consistently(mchan).ShouldNot(Receive())
+		})
+	})
+
 	Context("custom tags", func() {
 		BeforeEach(func() {
 			mchan = make(chan []metric.MetricPackage, 1500)
-			p, _ = NewProcessor(mchan, []string{"environment:foo", "foundry:bar"}, "", false,
-				nil, 4, 0, nil)
+			p, _ = NewProcessor(mchan, []string{"environment:foo", "foundry:bar"}, "", false, nil, 4, 0, nil, ProcessorOptions{})
 		})
 
 		It("adds custom tags to infra metrics", func() {
@@ -409,4 +590,229 @@ var _ = Describe("MetricProcessor", func() {
 		// custom tags on app metrics tested in app_metrics_test
 		// custom tags on internal metrics tested in datadogclient_test
 	})
+
+	Context("metric name rules", func() {
+		BeforeEach(func() {
+			noPrefix := ""
+			renamer, err := parser.NewRenamer(false, []config.MetricNameRule{
+				{Pattern: "^gorouter\\.(.*)$", Replacement: "router.$1", Prefix: &noPrefix},
+			})
+			Expect(err).To(BeNil())
+			mchan = make(chan []metric.MetricPackage, 1500)
+			p, _ = NewProcessor(mchan, []string{}, "", false, nil, 4, 0, nil, ProcessorOptions{Renamer: renamer})
+		})
+
+		It("reports infra metrics once under their renamed name", func() {
+			p.ProcessMetric(&loggregator_v2.Envelope{
+				Timestamp: 1000000000,
+				Tags: map[string]string{
+					"origin":     "gorouter",
+					"deployment": "deployment-name",
+					"job":        "router",
+				},
+				Message: &loggregator_v2.Envelope_Gauge{
+					Gauge: &loggregator_v2.Gauge{
+						Metrics: map[string]*loggregator_v2.GaugeValue{
+							"gorouter.latency": &loggregator_v2.GaugeValue{Value: float64(5)},
+							"uptime":           &loggregator_v2.GaugeValue{Value: float64(6)},
+						},
+					},
+				},
+			})
+
+			var metricPkg []metric.MetricPackage
+			Eventually(mchan).Should(Receive(&metricPkg))
+
+			Expect(metricPkg).To(HaveLen(2))
+			names := map[string]bool{}
+			for _, m := range metricPkg {
+				names[m.MetricKey.Name] = m.MetricKey.Prefixed
+			}
+			Expect(names).To(Equal(map[string]bool{"router.latency": true, "uptime": false}))
+		})
+	})
+
+	Context("timestamp policy", func() {
+		BeforeEach(func() {
+			timestampPolicy, err := parser.NewTimestampPolicy(parser.TimestampPolicyDrop, 60)
+			Expect(err).To(BeNil())
+			mchan = make(chan []metric.MetricPackage, 1500)
+			p, _ = NewProcessor(mchan, []string{}, "", false, nil, 4, 0, nil, ProcessorOptions{TimestampPolicy: timestampPolicy})
+		})
+
+		It("drops the envelopes older than the maximum skew", func() {
+			p.ProcessMetric(&loggregator_v2.Envelope{
+				Timestamp: time.Now().Add(-2 * time.Minute).UnixNano(),
+				Tags:      map[string]string{"origin": "gorouter"},
+				Message: &loggregator_v2.Envelope_Counter{
+					Counter: &loggregator_v2.Counter{Name: "requests", Delta: 1, Total: 1},
+				},
+			})
+			Consistently(mchan).ShouldNot(Receive())
+
+			p.ProcessMetric(&loggregator_v2.Envelope{
+				Timestamp: time.Now().UnixNano(),
+				Tags:      map[string]string{"origin": "gorouter"},
+				Message: &loggregator_v2.Envelope_Counter{
+					Counter: &loggregator_v2.Counter{Name: "requests", Delta: 1, Total: 2},
+				},
+			})
+			Eventually(mchan).Should(Receive())
+		})
+	})
+
+	Context("tag rules", func() {
+		BeforeEach(func() {
+			tagRewriter, err := parser.NewTagRewriter([]config.TagRule{
+				{Action: parser.TagActionDrop, Tag: "ip"},
+				{Action: parser.TagActionRename, Tag: "index", Target: "bosh_index"},
+				{Action: parser.TagActionMap, Tag: "deployment", Mapping: map[string]string{"deployment-name": "team-a"}},
+			})
+			Expect(err).To(BeNil())
+			mchan = make(chan []metric.MetricPackage, 1500)
+			p, _ = NewProcessor(mchan, []string{"foundry:bar"}, "", false, nil, 4, 0, nil,
+				ProcessorOptions{TagRewriter: tagRewriter})
+		})
+
+		It("rewrites the tags of infra metrics before hashing them", func() {
+			p.ProcessMetric(&loggregator_v2.Envelope{
+				Timestamp: 1000000000,
+				Tags: map[string]string{
+					"origin":     "test-origin",
+					"deployment": "deployment-name",
+					"job":        "doppler",
+					"ip":         "10.0.1.2",
+					"index":      "1",
+				},
+				Message: &loggregator_v2.Envelope_Gauge{
+					Gauge: &loggregator_v2.Gauge{
+						Metrics: map[string]*loggregator_v2.GaugeValue{
+							"fooMetric": &loggregator_v2.GaugeValue{
+								Unit:  "counter",
+								Value: float64(5),
+							},
+						},
+					},
+				},
+			})
+
+			var metricPkg []metric.MetricPackage
+			Eventually(mchan).Should(Receive(&metricPkg))
+
+			Expect(metricPkg).To(HaveLen(2))
+			for _, m := range metricPkg {
+				Expect(m.MetricValue.Tags).To(Equal([]string{
+					"bosh_index:1",
+					"deployment:team-a",
+					"foundry:bar",
+					"job:doppler",
+					"name:test-origin",
+					"origin:test-origin",
+				}))
+				Expect(m.MetricKey.TagsHash).To(Equal(util.HashTags(m.MetricValue.Tags)))
+			}
+		})
+	})
 })
+
+func benchmarkProcessMetric(b *testing.B, envelope *loggregator_v2.Envelope) {
+	mchan := make(chan []metric.MetricPackage, 1000)
+	done := make(chan bool)
+	go func() {
+		for range mchan {
+		}
+		close(done)
+	}()
+	p, _ := NewProcessor(mchan, []string{"foundry:bar"}, "env", false, nil, 4, 0, nil, ProcessorOptions{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.ProcessMetric(envelope)
+	}
+	b.StopTimer()
+	close(mchan)
+	<-done
+}
+
+// benchmarkPerEnvelopeParser is the baseline of benchmarkProcessMetric,
+// it creates an InfraParser for each envelope
+func benchmarkPerEnvelopeParser(b *testing.B, envelope *loggregator_v2.Envelope) {
+	mchan := make(chan []metric.MetricPackage, 1000)
+	done := make(chan bool)
+	go func() {
+		for range mchan {
+		}
+		close(done)
+	}()
+	deploymentUUIDRegex := regexp.MustCompile(deploymentUUIDPattern)
+	jobPartitionUUIDRegex := regexp.MustCompile(jobPartitionUUIDPattern)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		infraParser := &parser.InfraParser{
+			Environment:           "env",
+			DeploymentUUIDRegex:   deploymentUUIDRegex,
+			JobPartitionUUIDRegex: jobPartitionUUIDRegex,
+			CustomTags:            []string{"foundry:bar"},
+		}
+		if metricsPackages, err := infraParser.Parse(envelope); err == nil {
+			mchan <- metricsPackages
+		}
+	}
+	b.StopTimer()
+	close(mchan)
+	<-done
+}
+
+var benchmarkGauge = &loggregator_v2.Envelope{
+	Timestamp:  1000000000,
+	SourceId:   "gorouter",
+	InstanceId: "4",
+	Tags: map[string]string{
+		"origin":     "gorouter",
+		"deployment": "cf-0123456789abcdef0123",
+		"job":        "router-partition-0123456789abcdef0123",
+		"index":      "0c3b6f2a-7e4d-4c8b-9b5f-2d8e1a6f3c7d",
+		"ip":         "10.0.1.2",
+	},
+	Message: &loggregator_v2.Envelope_Gauge{
+		Gauge: &loggregator_v2.Gauge{
+			Metrics: map[string]*loggregator_v2.GaugeValue{
+				"latency":        {Unit: "ms", Value: 5},
+				"total_requests": {Unit: "requests", Value: 1500},
+			},
+		},
+	},
+}
+
+var benchmarkCounter = &loggregator_v2.Envelope{
+	Timestamp: 1000000000,
+	SourceId:  "doppler",
+	Tags: map[string]string{
+		"origin":     "loggregator.doppler",
+		"deployment": "cf-0123456789abcdef0123",
+		"job":        "doppler",
+		"index":      "0c3b6f2a-7e4d-4c8b-9b5f-2d8e1a6f3c7d",
+	},
+	Message: &loggregator_v2.Envelope_Counter{
+		Counter: &loggregator_v2.Counter{Name: "ingress", Delta: 10, Total: 1000},
+	},
+}
+
+func BenchmarkProcessGauge(b *testing.B) {
+	benchmarkProcessMetric(b, benchmarkGauge)
+}
+
+func BenchmarkProcessGaugePerEnvelopeParser(b *testing.B) {
+	benchmarkPerEnvelopeParser(b, benchmarkGauge)
+}
+
+func BenchmarkProcessCounter(b *testing.B) {
+	benchmarkProcessMetric(b, benchmarkCounter)
+}
+
+func BenchmarkProcessCounterPerEnvelopeParser(b *testing.B) {
+	benchmarkPerEnvelopeParser(b, benchmarkCounter)
+}
@@ -0,0 +1,183 @@
+package rollup
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/filter"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+	"github.com/cloudfoundry/gosteno"
+)
+
+// Rollup functions
+const (
+	FunctionNone  = "none"
+	FunctionLast  = "last"
+	FunctionAvg   = "avg"
+	FunctionMin   = "min"
+	FunctionMax   = "max"
+	FunctionSum   = "sum"
+	FunctionCount = "count"
+)
+
+type rule struct {
+	name     *regexp.Regexp
+	function string
+}
+
+type bucket struct {
+	last  metric.Point
+	sum   float64
+	min   float64
+	max   float64
+	count int
+}
+
+// Rollup reduces the points of each series to one point per interval before they are posted.
+// It is not safe for concurrent use.
+type Rollup struct {
+	function  string
+	interval  int64
+	rules     []rule
+	functions map[string]string // function of each metric type and name, "" when it is not rolled up
+	log       *gosteno.Logger
+}
+
+// New creates a rollup, function applies to the metrics matching no rule, except counts which are always summed.
+// Each series is reduced to one point per flush when intervalSeconds is 0.
+// It returns nil when neither function nor rules are set.
+func New(function string, intervalSeconds uint32, rules []config.RollupRule, log *gosteno.Logger) (*Rollup, error) {
+	if function == "" && len(rules) == 0 {
+		return nil, nil
+	}
+	if !validFunction(function) {
+		return nil, fmt.Errorf("unknown RollupFunction %q", function)
+	}
+
+	r := &Rollup{
+		function:  function,
+		interval:  int64(intervalSeconds),
+		functions: map[string]string{},
+		log:       log,
+	}
+	for i, cfgRule := range rules {
+		name, err := filter.CompilePattern(cfgRule.Name)
+		if err != nil {
+			return nil, fmt.Errorf("rollup rule %d has an invalid Name: %v", i, err)
+		}
+		if name == nil {
+			return nil, fmt.Errorf("rollup rule %d has no Name", i)
+		}
+		if cfgRule.Function == "" || !validFunction(cfgRule.Function) {
+			return nil, fmt.Errorf("rollup rule %d has an unknown Function %q", i, cfgRule.Function)
+		}
+		r.rules = append(r.rules, rule{name: name, function: cfgRule.Function})
+	}
+	return r, nil
+}
+
+// Apply replaces the points of the series of metrics with their rollup
+func (r *Rollup) Apply(metrics metric.MetricsMap) {
+	if r == nil {
+		return
+	}
+
+	for k, v := range metrics {
+		function := r.functionOf(k.Name, v.Type)
+		if function == "" {
+			continue
+		}
+		// The points slice can be shared with the other names of the metric, a new one is allocated
+		v.Points = r.reduce(function, v.Points)
+		metrics[k] = v
+	}
+}
+
+func (r *Rollup) functionOf(name string, metricType string) string {
+	cacheKey := metricType + ":" + name
+	function, ok := r.functions[cacheKey]
+	if !ok {
+		function = r.function
+		if function != "" && metricType == metric.CountType {
+			function = FunctionSum
+		}
+		for _, rule := range r.rules {
+			if !rule.name.MatchString(name) {
+				continue
+			}
+			// Only the sum of the points of a count is a count, the rule can still keep all its points
+			if metricType == metric.CountType && rule.function != FunctionSum && rule.function != FunctionNone {
+				r.log.Warnf("Ignoring the %s rollup of the count %s, counts are summed", rule.function, name)
+				function = FunctionSum
+			} else {
+				function = rule.function
+			}
+			break
+		}
+		if function == FunctionNone {
+			function = ""
+		}
+		r.functions[cacheKey] = function
+	}
+	return function
+}
+
+// reduce returns one point per interval, at the timestamp of the last point of the interval
+func (r *Rollup) reduce(function string, points []metric.Point) []metric.Point {
+	buckets := map[int64]*bucket{}
+	for _, p := range points {
+		// NaN values are dropped by the formatter, they are left out of the rollup
+		if math.IsNaN(p.Value) {
+			continue
+		}
+		var start int64
+		if r.interval > 0 {
+			start = p.Timestamp - p.Timestamp%r.interval
+		}
+		b, ok := buckets[start]
+		if !ok {
+			buckets[start] = &bucket{last: p, sum: p.Value, min: p.Value, max: p.Value, count: 1}
+			continue
+		}
+		if p.Timestamp >= b.last.Timestamp {
+			b.last = p
+		}
+		b.sum += p.Value
+		b.min = math.Min(b.min, p.Value)
+		b.max = math.Max(b.max, p.Value)
+		b.count++
+	}
+
+	reduced := make([]metric.Point, 0, len(buckets))
+	for _, b := range buckets {
+		p := metric.Point{Timestamp: b.last.Timestamp}
+		switch function {
+		case FunctionLast:
+			p.Value = b.last.Value
+		case FunctionAvg:
+			p.Value = b.sum / float64(b.count)
+		case FunctionMin:
+			p.Value = b.min
+		case FunctionMax:
+			p.Value = b.max
+		case FunctionSum:
+			p.Value = b.sum
+		case FunctionCount:
+			p.Value = float64(b.count)
+		}
+		reduced = append(reduced, p)
+	}
+	sort.Slice(reduced, func(i, j int) bool { return reduced[i].Timestamp < reduced[j].Timestamp })
+	return reduced
+}
+
+func validFunction(function string) bool {
+	switch function {
+	case "", FunctionNone, FunctionLast, FunctionAvg, FunctionMin, FunctionMax, FunctionSum, FunctionCount:
+		return true
+	}
+	return false
+}
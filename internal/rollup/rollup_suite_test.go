@@ -0,0 +1,13 @@
+package rollup
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRollup(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Rollup Suite")
+}
@@ -0,0 +1,124 @@
+package rollup
+
+import (
+	"math"
+
+	"github.com/cloudfoundry/gosteno"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DataDog/datadog-firehose-nozzle/internal/config"
+	"github.com/DataDog/datadog-firehose-nozzle/internal/metric"
+)
+
+func points(values ...float64) []metric.Point {
+	var ps []metric.Point
+	for i, v := range values {
+		ps = append(ps, metric.Point{Timestamp: int64(100 + i), Value: v})
+	}
+	return ps
+}
+
+var _ = Describe("Rollup", func() {
+	var log *gosteno.Logger
+
+	BeforeEach(func() {
+		log = gosteno.NewLogger("rollup test")
+	})
+
+	It("is disabled without function nor rules", func() {
+		r, err := New("", 0, nil, log)
+		Expect(err).To(BeNil())
+		Expect(r).To(BeNil())
+
+		m := metric.MetricsMap{metric.MetricKey{Name: "foo"}: {Points: points(1, 2)}}
+		r.Apply(m)
+		Expect(m[metric.MetricKey{Name: "foo"}].Points).To(HaveLen(2))
+	})
+
+	It("reduces each series to one point per flush", func() {
+		r, err := New(FunctionAvg, 0, nil, log)
+		Expect(err).To(BeNil())
+
+		m := metric.MetricsMap{
+			metric.MetricKey{Name: "gauge"}: {Points: points(1, 2, math.NaN(), 6)},
+			metric.MetricKey{Name: "count"}: {Points: points(1, 2, 3), Type: metric.CountType},
+		}
+		r.Apply(m)
+		Expect(m[metric.MetricKey{Name: "gauge"}].Points).To(Equal([]metric.Point{{Timestamp: 103, Value: 3}}))
+		// Counts are summed
+		Expect(m[metric.MetricKey{Name: "count"}].Points).To(Equal([]metric.Point{{Timestamp: 102, Value: 6}}))
+	})
+
+	It("reduces the points of each interval", func() {
+		r, err := New(FunctionMax, 2, nil, log)
+		Expect(err).To(BeNil())
+
+		m := metric.MetricsMap{metric.MetricKey{Name: "foo"}: {Points: points(5, 1, 2, 7, 3)}}
+		r.Apply(m)
+		Expect(m[metric.MetricKey{Name: "foo"}].Points).To(Equal([]metric.Point{
+			{Timestamp: 101, Value: 5},
+			{Timestamp: 103, Value: 7},
+			{Timestamp: 104, Value: 3},
+		}))
+	})
+
+	It("applies the function of the first matching rule", func() {
+		r, err := New(FunctionLast, 0, []config.RollupRule{
+			{Name: "*.min", Function: FunctionMin},
+			{Name: "*.count", Function: FunctionCount},
+			{Name: "/^raw\\./", Function: FunctionNone},
+			{Name: "*.min", Function: FunctionMax},
+		}, log)
+		Expect(err).To(BeNil())
+
+		m := metric.MetricsMap{
+			metric.MetricKey{Name: "foo.min"}:   {Points: points(4, 2, 3)},
+			metric.MetricKey{Name: "foo.count"}: {Points: points(4, 2, 3)},
+			metric.MetricKey{Name: "raw.foo"}:   {Points: points(4, 2, 3)},
+			metric.MetricKey{Name: "foo"}:       {Points: points(4, 2, 3)},
+		}
+		r.Apply(m)
+		Expect(m[metric.MetricKey{Name: "foo.min"}].Points).To(Equal([]metric.Point{{Timestamp: 102, Value: 2}}))
+		Expect(m[metric.MetricKey{Name: "foo.count"}].Points).To(Equal([]metric.Point{{Timestamp: 102, Value: 3}}))
+		Expect(m[metric.MetricKey{Name: "raw.foo"}].Points).To(HaveLen(3))
+		Expect(m[metric.MetricKey{Name: "foo"}].Points).To(Equal([]metric.Point{{Timestamp: 102, Value: 3}}))
+	})
+
+	It("keeps summing the counts matched by a rule of another function", func() {
+		r, err := New("", 0, []config.RollupRule{
+			{Name: "raw.*", Function: FunctionNone},
+			{Name: "*.requests", Function: FunctionAvg},
+		}, log)
+		Expect(err).To(BeNil())
+
+		m := metric.MetricsMap{
+			metric.MetricKey{Name: "app.requests"}:   {Points: points(1, 2, 3), Type: metric.CountType},
+			metric.MetricKey{Name: "raw.requests"}:   {Points: points(1, 2, 3), Type: metric.CountType},
+			metric.MetricKey{Name: "gauge.requests"}: {Points: points(1, 2, 3)},
+		}
+		r.Apply(m)
+		Expect(m[metric.MetricKey{Name: "app.requests"}].Points).To(Equal([]metric.Point{{Timestamp: 102, Value: 6}}))
+		Expect(m[metric.MetricKey{Name: "raw.requests"}].Points).To(HaveLen(3))
+		Expect(m[metric.MetricKey{Name: "gauge.requests"}].Points).To(Equal([]metric.Point{{Timestamp: 102, Value: 2}}))
+	})
+
+	It("does not modify the points shared with other series", func() {
+		r, err := New(FunctionSum, 0, nil, log)
+		Expect(err).To(BeNil())
+
+		shared := points(1, 2)
+		m := metric.MetricsMap{metric.MetricKey{Name: "foo"}: {Points: shared}}
+		r.Apply(m)
+		Expect(shared).To(Equal(points(1, 2)))
+	})
+
+	It("rejects unknown functions", func() {
+		_, err := New("median", 0, nil, log)
+		Expect(err).To(HaveOccurred())
+		_, err = New("", 0, []config.RollupRule{{Name: "foo"}}, log)
+		Expect(err).To(HaveOccurred())
+		_, err = New("", 0, []config.RollupRule{{Function: FunctionSum}}, log)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -1,16 +1,67 @@
 package uaatokenfetcher
 
 import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/cloudfoundry-incubator/uaago"
 	"github.com/cloudfoundry/gosteno"
 )
 
+const (
+	// refreshRatio is the part of the token lifetime after which a new token is fetched
+	refreshRatio = 0.8
+
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// ClientError is returned when the UAA client can't be created, retrying won't help
+type ClientError struct {
+	Err error
+}
+
+func (e *ClientError) Error() string {
+	return fmt.Sprintf("error creating uaa client: %v", e.Err)
+}
+
+// FetchError is returned when the UAA didn't return a token after all the attempts
+type FetchError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("error getting oauth token after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// fetchCall is a fetch of a new token shared by the callers that need one at the same time
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
 type UAATokenFetcher struct {
 	uaaUrl                string
 	username              string
 	password              string
 	insecureSSLSkipVerify bool
 	log                   *gosteno.Logger
+	lock                  sync.Mutex
+	inflight              *fetchCall // the fetch in progress, if any
+	authToken             string
+	refreshAt             time.Time // zero when the token doesn't expire
+	expiresAt             time.Time // zero when the token doesn't expire
+	fetchedAt             time.Time // when the current token was fetched
+	failures              uint64    // failed attempts, read by the nozzle
+	maxAttempts           int
+	initialBackoff        time.Duration
+	maxBackoff            time.Duration
+	now                   func() time.Time
 }
 
 func New(uaaUrl string, username string, password string, sslSkipVerify bool, logger *gosteno.Logger) *UAATokenFetcher {
@@ -20,19 +71,128 @@ func New(uaaUrl string, username string, password string, sslSkipVerify bool, lo
 		password:              password,
 		insecureSSLSkipVerify: sslSkipVerify,
 		log:                   logger,
+		maxAttempts:           defaultMaxAttempts,
+		initialBackoff:        defaultInitialBackoff,
+		maxBackoff:            defaultMaxBackoff,
+		now:                   time.Now,
+	}
+}
+
+// FetchAuthToken returns the current token, a new one is fetched when it is about to expire.
+// The current token is returned until it expires while a new one is being fetched or when it can't be fetched.
+func (uaa *UAATokenFetcher) FetchAuthToken() (string, error) {
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+
+	if uaa.authToken == "" || (!uaa.refreshAt.IsZero() && uaa.now().After(uaa.refreshAt)) {
+		if uaa.inflight != nil && uaa.authToken != "" && uaa.now().Before(uaa.expiresAt) {
+			return uaa.authToken, nil
+		}
+		if err := uaa.fetch(); err != nil {
+			if uaa.authToken == "" || uaa.now().After(uaa.expiresAt) {
+				return "", err
+			}
+			uaa.log.Warnf("Could not refresh the oauth token, using the current one until it expires at %s: %v", uaa.expiresAt, err)
+		}
+	}
+	return uaa.authToken, nil
+}
+
+// RefreshAuthToken fetches a new token, it is used when the current token was rejected.
+// The callers whose token was rejected while a new one was being fetched get that new token.
+func (uaa *UAATokenFetcher) RefreshAuthToken() (string, error) {
+	requested := uaa.now()
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+
+	if uaa.authToken != "" && uaa.fetchedAt.After(requested) {
+		return uaa.authToken, nil
+	}
+	if err := uaa.fetch(); err != nil {
+		return "", err
+	}
+	return uaa.authToken, nil
+}
+
+// FailureCount returns the number of failed attempts to get a token from the UAA
+func (uaa *UAATokenFetcher) FailureCount() uint64 {
+	return atomic.LoadUint64(&uaa.failures)
+}
+
+// fetch gets a new token, or waits for the one being fetched by another caller.
+// uaa.lock must be held, it is released while the token is fetched.
+func (uaa *UAATokenFetcher) fetch() error {
+	if call := uaa.inflight; call != nil {
+		uaa.lock.Unlock()
+		<-call.done
+		uaa.lock.Lock()
+		return call.err
+	}
+
+	call := &fetchCall{done: make(chan struct{})}
+	uaa.inflight = call
+	uaa.lock.Unlock()
+	authToken, expiresIn, err := uaa.fetchAuthToken()
+	uaa.lock.Lock()
+
+	if err == nil {
+		uaa.setAuthToken(authToken, expiresIn)
 	}
+	call.err = err
+	uaa.inflight = nil
+	close(call.done)
+	return err
 }
 
-func (uaa *UAATokenFetcher) FetchAuthToken() string {
+// fetchAuthToken gets a new token, retrying with an exponential backoff and jitter when the UAA fails
+func (uaa *UAATokenFetcher) fetchAuthToken() (string, int, error) {
 	uaaClient, err := uaago.NewClient(uaa.uaaUrl)
 	if err != nil {
-		uaa.log.Fatalf("Error creating uaa client: %s", err.Error())
+		atomic.AddUint64(&uaa.failures, 1)
+		return "", 0, &ClientError{Err: err}
 	}
 
-	var authToken string
-	authToken, err = uaaClient.GetAuthToken(uaa.username, uaa.password, uaa.insecureSSLSkipVerify)
-	if err != nil {
-		uaa.log.Fatalf("Error getting oauth token: %s. Please check your username and password.", err.Error())
+	backoff := uaa.initialBackoff
+	for attempt := 1; ; attempt++ {
+		authToken, expiresIn, err := uaaClient.GetAuthTokenWithExpiresIn(uaa.username, uaa.password, uaa.insecureSSLSkipVerify)
+		if err == nil {
+			return authToken, expiresIn, nil
+		}
+
+		atomic.AddUint64(&uaa.failures, 1)
+		if attempt >= uaa.maxAttempts {
+			return "", 0, &FetchError{Attempts: attempt, Err: err}
+		}
+
+		delay := jitter(backoff)
+		uaa.log.Warnf("Error getting oauth token (attempt %d/%d): %s. Retrying in %s", attempt, uaa.maxAttempts, err.Error(), delay)
+		time.Sleep(delay)
+		backoff *= 2
+		if backoff > uaa.maxBackoff {
+			backoff = uaa.maxBackoff
+		}
+	}
+}
+
+func (uaa *UAATokenFetcher) setAuthToken(authToken string, expiresIn int) {
+	now := uaa.now()
+	uaa.authToken = authToken
+	uaa.fetchedAt = now
+	uaa.refreshAt = time.Time{}
+	uaa.expiresAt = time.Time{}
+	if expiresIn > 0 {
+		lifetime := time.Duration(float64(expiresIn) * refreshRatio * float64(time.Second))
+		uaa.refreshAt = now.Add(lifetime)
+		uaa.expiresAt = now.Add(time.Duration(expiresIn) * time.Second)
+		uaa.log.Debugf("Fetched a new oauth token, it will be refreshed in %s", lifetime)
+	}
+}
+
+// jitter returns a random duration between d/2 and d so that nozzle instances don't retry in lockstep
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
 	}
-	return authToken
+	return time.Duration(half + rand.Int63n(half+1))
 }
@@ -1,6 +1,9 @@
 package uaatokenfetcher
 
 import (
+	"sync"
+	"time"
+
 	"github.com/cloudfoundry/gosteno"
 
 	"github.com/DataDog/datadog-firehose-nozzle/test/helper"
@@ -8,12 +11,39 @@ import (
 	. "github.com/onsi/gomega"
 )
 
+// fakeClock is advanced by the tests instead of sleeping
+type fakeClock struct {
+	lock  sync.Mutex
+	now   time.Time
+	calls int
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls++
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) Calls() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.calls
+}
+
 var _ = Describe("UaaTokenFetcher", func() {
 	var (
 		tokenFetcher *UAATokenFetcher
 		fakeUAA      *helper.FakeUAA
 		fakeToken    string
 		fakeLogger   *gosteno.Logger
+		clock        *fakeClock
 	)
 
 	BeforeEach(func() {
@@ -23,11 +53,138 @@ var _ = Describe("UaaTokenFetcher", func() {
 		fakeUAA.Start()
 
 		tokenFetcher = New(fakeUAA.URL(), "username", "password", true, fakeLogger)
+		tokenFetcher.initialBackoff = time.Millisecond
+		tokenFetcher.maxBackoff = 4 * time.Millisecond
+		clock = &fakeClock{now: time.Now()}
+		tokenFetcher.now = clock.Now
+	})
+
+	AfterEach(func() {
+		fakeUAA.Close()
 	})
 
 	It("fetches a token from the UAA", func() {
-		receivedAuthToken := tokenFetcher.FetchAuthToken()
+		receivedAuthToken, err := tokenFetcher.FetchAuthToken()
+		Expect(err).To(BeNil())
 		Expect(fakeUAA.Requested()).To(BeTrue())
 		Expect(receivedAuthToken).To(Equal(fakeToken))
 	})
+
+	It("reuses the token until it is about to expire", func() {
+		fakeUAA.SetExpiresIn(1)
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+		Expect(fakeUAA.NumRequests()).To(Equal(1))
+
+		// The token is refreshed once 80% of its lifetime has elapsed
+		clock.Add(900 * time.Millisecond)
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+		Expect(fakeUAA.NumRequests()).To(Equal(2))
+	})
+
+	It("keeps using the token until it expires when it can't be refreshed", func() {
+		fakeUAA.SetExpiresIn(1)
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+
+		clock.Add(850 * time.Millisecond)
+		fakeUAA.FailNextRequests(defaultMaxAttempts)
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+
+		clock.Add(200 * time.Millisecond)
+		fakeUAA.FailNextRequests(defaultMaxAttempts)
+		authToken, err := tokenFetcher.FetchAuthToken()
+		Expect(authToken).To(BeEmpty())
+		Expect(err).To(BeAssignableToTypeOf(&FetchError{}))
+	})
+
+	It("returns the current token while a new one is being fetched", func() {
+		fakeUAA.SetExpiresIn(2)
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+
+		// The UAA doesn't answer the refresh until it is released
+		clock.Add(1700 * time.Millisecond)
+		fakeUAA.BlockRequests()
+		refreshed := make(chan string, 1)
+		go func() {
+			authToken, _ := tokenFetcher.FetchAuthToken()
+			refreshed <- authToken
+		}()
+		Eventually(fakeUAA.NumBlocked).Should(Equal(1))
+
+		current := make(chan string, 1)
+		go func() {
+			authToken, _ := tokenFetcher.FetchAuthToken()
+			current <- authToken
+		}()
+		Eventually(current).Should(Receive(Equal(fakeToken)))
+		Expect(refreshed).NotTo(Receive())
+
+		fakeUAA.ReleaseRequests()
+		Eventually(refreshed).Should(Receive(Equal(fakeToken)))
+		Expect(fakeUAA.NumRequests()).To(Equal(2))
+	})
+
+	It("keeps tokens without expiry", func() {
+		tokenFetcher.FetchAuthToken()
+		tokenFetcher.FetchAuthToken()
+		Expect(fakeUAA.NumRequests()).To(Equal(1))
+	})
+
+	It("fetches a new token when asked to refresh it", func() {
+		fakeUAA.SetExpiresIn(3600)
+		tokenFetcher.FetchAuthToken()
+		Expect(tokenFetcher.RefreshAuthToken()).To(Equal(fakeToken))
+		Expect(fakeUAA.NumRequests()).To(Equal(2))
+	})
+
+	It("fetches a single token for the tokens rejected at the same time", func() {
+		tokenFetcher.FetchAuthToken()
+		clock.Add(time.Second)
+		calls := clock.Calls()
+
+		// The callers wait for the first one to fetch the new token
+		fakeUAA.BlockRequests()
+		tokens := make(chan string, 5)
+		for i := 0; i < 5; i++ {
+			go func() {
+				authToken, _ := tokenFetcher.RefreshAuthToken()
+				tokens <- authToken
+			}()
+		}
+		Eventually(clock.Calls).Should(Equal(calls + 5))
+		Eventually(fakeUAA.NumBlocked).Should(Equal(1))
+		clock.Add(time.Second)
+		fakeUAA.ReleaseRequests()
+
+		for i := 0; i < 5; i++ {
+			Eventually(tokens).Should(Receive(Equal(fakeToken)))
+		}
+		Expect(fakeUAA.NumRequests()).To(Equal(2))
+	})
+
+	It("retries when the UAA fails", func() {
+		fakeUAA.FailNextRequests(2)
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+		Expect(fakeUAA.NumRequests()).To(Equal(1))
+		Expect(tokenFetcher.FailureCount()).To(BeEquivalentTo(2))
+	})
+
+	It("returns an error when the UAA keeps failing", func() {
+		fakeUAA.FailNextRequests(defaultMaxAttempts)
+		authToken, err := tokenFetcher.FetchAuthToken()
+		Expect(authToken).To(BeEmpty())
+		Expect(err).To(BeAssignableToTypeOf(&FetchError{}))
+		Expect(err.(*FetchError).Attempts).To(Equal(defaultMaxAttempts))
+		Expect(tokenFetcher.FailureCount()).To(BeEquivalentTo(defaultMaxAttempts))
+
+		// The next call tries again
+		Expect(tokenFetcher.FetchAuthToken()).To(Equal(fakeToken))
+	})
+
+	It("returns an error without retrying when the UAA URL is invalid", func() {
+		tokenFetcher = New("", "username", "password", true, fakeLogger)
+		_, err := tokenFetcher.FetchAuthToken()
+		Expect(err).To(BeAssignableToTypeOf(&ClientError{}))
+		Expect(tokenFetcher.FailureCount()).To(BeEquivalentTo(1))
+	})
 })
@@ -1,7 +1,7 @@
 package util
 
 import (
-	"crypto/sha1"
+	"math/bits"
 	"math/rand"
 	"sort"
 	"time"
@@ -9,16 +9,64 @@ import (
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 )
 
-func HashTags(tags []string) string {
-	// This is the origial implementation of this function from the original nozzle
-	// It might make sense to concat all tags together in the future
-	sort.Strings(tags)
-	hash := ""
-	for _, tag := range tags {
-		tagHash := sha1.Sum([]byte(tag))
-		hash += string(tagHash[:])
+// TagsHash identifies a set of tags, it is the same whatever the order and duplicates of the tags
+type TagsHash struct {
+	Hi uint64
+	Lo uint64
+}
+
+// 128-bit FNV-1a parameters, the prime is 2^88 + 0x13b
+const (
+	fnv128OffsetHi = 0x6c62272e07bb0142
+	fnv128OffsetLo = 0x62b821756295c58d
+	fnv128PrimeLo  = 0x13b
+	fnv128PrimeHi  = 24 // shift of the high part of the prime
+)
+
+// maxStackTags is the number of tags sorted without allocating
+const maxStackTags = 32
+
+// HashTags returns the 128-bit FNV-1a hash of the sorted and deduplicated tags, tags is left untouched
+func HashTags(tags []string) TagsHash {
+	if len(tags) > maxStackTags {
+		sorted := make([]string, len(tags))
+		copy(sorted, tags)
+		sort.Strings(sorted)
+		return hashSortedTags(sorted)
+	}
+
+	var buffer [maxStackTags]string
+	sorted := buffer[:len(tags)]
+	copy(sorted, tags)
+	// Insertion sort doesn't make the buffer escape to the heap, and is fast for the few tags of a metric
+	for i := 1; i < len(sorted); i++ {
+		for j := i; j > 0 && sorted[j] < sorted[j-1]; j-- {
+			sorted[j], sorted[j-1] = sorted[j-1], sorted[j]
+		}
+	}
+	return hashSortedTags(sorted)
+}
+
+func hashSortedTags(sorted []string) TagsHash {
+	hi, lo := uint64(fnv128OffsetHi), uint64(fnv128OffsetLo)
+	for i, tag := range sorted {
+		if i > 0 && tag == sorted[i-1] {
+			continue
+		}
+		for j := 0; j < len(tag); j++ {
+			hi, lo = fnv128Byte(hi, lo, tag[j])
+		}
+		// Separate the tags so that ["ab"] and ["a", "b"] differ
+		hi, lo = fnv128Byte(hi, lo, 0)
 	}
-	return hash
+	return TagsHash{Hi: hi, Lo: lo}
+}
+
+func fnv128Byte(hi, lo uint64, b byte) (uint64, uint64) {
+	lo ^= uint64(b)
+	productHi, productLo := bits.Mul64(lo, fnv128PrimeLo)
+	productHi += hi*fnv128PrimeLo + lo<<fnv128PrimeHi
+	return productHi, productLo
 }
 
 func GetTickerWithJitter(wholeIntervalSeconds uint32, jitterPct float64) (*time.Ticker, func()) {
@@ -33,6 +81,19 @@ func GetTickerWithJitter(wholeIntervalSeconds uint32, jitterPct float64) (*time.
 	return ticker, jitterWait
 }
 
+// extendedContainerMetrics are the gauges newer Diego cells emit for each container,
+// along with the container metric or in envelopes of their own
+var extendedContainerMetrics = map[string]bool{
+	"cpu_entitlement":      true,
+	"log_rate":             true,
+	"log_rate_limit":       true,
+	"absolute_usage":       true,
+	"absolute_entitlement": true,
+	"container_age":        true,
+	"spike_start":          true,
+	"spike_end":            true,
+}
+
 func IsContainerMetric(envelope *loggregator_v2.Envelope) bool {
 	// We can tell whether or not a Gauge envelope is container metric by checking
 	// a predefined set of metrics: https://github.com/cloudfoundry/loggregator-api#containermetric
@@ -48,4 +109,24 @@ func IsContainerMetric(envelope *loggregator_v2.Envelope) bool {
 	}
 
 	return result
-}
\ No newline at end of file
+}
+
+// IsExtendedContainerMetric tells whether a gauge envelope of an app only holds extended container gauges,
+// like the cpu entitlement and log rate envelopes of Diego, they are not container metrics for IsContainerMetric
+func IsExtendedContainerMetric(envelope *loggregator_v2.Envelope) bool {
+	if envelope.GetSourceId() == "" {
+		return false
+	}
+	found := false
+	for key, v := range envelope.GetGauge().GetMetrics() {
+		// The instance index tags the other gauges of the container
+		if key == "instance_index" {
+			continue
+		}
+		if !extendedContainerMetrics[key] || v == nil {
+			return false
+		}
+		found = true
+	}
+	return found
+}
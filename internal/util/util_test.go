@@ -1,6 +1,13 @@
 package util
 
 import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"testing"
+
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 
 	. "github.com/onsi/ginkgo"
@@ -174,5 +181,110 @@ var _ = Describe("Util", func() {
 			Expect(IsContainerMetric(badGauge3)).To(BeFalse())
 			Expect(IsContainerMetric(goodGauge)).To(BeTrue())
 		})
+
+		It("identifies the envelopes of the extended container gauges", func() {
+			extended := &loggregator_v2.Envelope{
+				SourceId: "app-id",
+				Message: &loggregator_v2.Envelope_Gauge{
+					Gauge: &loggregator_v2.Gauge{
+						Metrics: map[string]*loggregator_v2.GaugeValue{
+							"absolute_usage":       {Unit: "nanoseconds", Value: 10},
+							"absolute_entitlement": {Unit: "nanoseconds", Value: 20},
+							"instance_index":       {Value: 1},
+						},
+					},
+				},
+			}
+			Expect(IsContainerMetric(extended)).To(BeFalse())
+			Expect(IsExtendedContainerMetric(extended)).To(BeTrue())
+
+			// Other gauges are not extended container gauges
+			extended.GetGauge().GetMetrics()["uptime"] = &loggregator_v2.GaugeValue{Value: 1}
+			Expect(IsExtendedContainerMetric(extended)).To(BeFalse())
+
+			onlyIndex := &loggregator_v2.Envelope{
+				SourceId: "app-id",
+				Message: &loggregator_v2.Envelope_Gauge{
+					Gauge: &loggregator_v2.Gauge{
+						Metrics: map[string]*loggregator_v2.GaugeValue{"instance_index": {Value: 1}},
+					},
+				},
+			}
+			Expect(IsExtendedContainerMetric(onlyIndex)).To(BeFalse())
+		})
 	})
-})
\ No newline at end of file
+
+	Context("HashTags", func() {
+		It("is the FNV-1a hash of the sorted and deduplicated tags", func() {
+			h := fnv.New128a()
+			h.Write([]byte("a:1\x00b:2\x00"))
+			sum := h.Sum(nil)
+			expected := TagsHash{Hi: binary.BigEndian.Uint64(sum[:8]), Lo: binary.BigEndian.Uint64(sum[8:])}
+
+			Expect(HashTags([]string{"a:1", "b:2"})).To(Equal(expected))
+			Expect(HashTags([]string{"b:2", "a:1", "b:2"})).To(Equal(expected))
+		})
+
+		It("does not modify the tags", func() {
+			tags := []string{"b:2", "a:1"}
+			HashTags(tags)
+			Expect(tags).To(Equal([]string{"b:2", "a:1"}))
+		})
+
+		It("distinguishes the tags", func() {
+			Expect(HashTags([]string{"ab"})).NotTo(Equal(HashTags([]string{"a", "b"})))
+			Expect(HashTags([]string{})).NotTo(Equal(HashTags([]string{""})))
+		})
+
+		It("handles many tags", func() {
+			var tags, reversed []string
+			for i := 0; i < 2*maxStackTags; i++ {
+				tags = append(tags, fmt.Sprintf("tag:%d", i))
+				reversed = append([]string{fmt.Sprintf("tag:%d", i)}, reversed...)
+			}
+			Expect(HashTags(tags)).To(Equal(HashTags(reversed)))
+			Expect(HashTags(tags)).NotTo(Equal(HashTags(tags[1:])))
+		})
+	})
+})
+
+// legacyHashTags is the previous implementation of HashTags, kept to compare their performance
+func legacyHashTags(tags []string) string {
+	sort.Strings(tags)
+	hash := ""
+	for _, tag := range tags {
+		tagHash := sha1.Sum([]byte(tag))
+		hash += string(tagHash[:])
+	}
+	return hash
+}
+
+var benchmarkTags = []string{
+	"deployment:cf",
+	"deployment:cf_prod",
+	"env:prod",
+	"index:0c3b6f2a-7e4d-4c8b-9b5f-2d8e1a6f3c7d",
+	"ip:10.0.1.2",
+	"job:router",
+	"name:gorouter",
+	"origin:gorouter",
+	"source_id:gorouter",
+	"foundry:bar",
+}
+
+func BenchmarkLegacyHashTags(b *testing.B) {
+	tags := make([]string, len(benchmarkTags))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// it sorts its input, the tags are copied to hash them unsorted each time
+		copy(tags, benchmarkTags)
+		legacyHashTags(tags)
+	}
+}
+
+func BenchmarkHashTags(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		HashTags(benchmarkTags)
+	}
+}
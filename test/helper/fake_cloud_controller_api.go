@@ -1,10 +1,13 @@
 package helper
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,6 +17,7 @@ type FakeCloudControllerAPI struct {
 	ReceivedContents chan []byte
 	ReceivedRequests chan *http.Request
 	usedEndpoints    []string
+	usedQueries      []string
 
 	server *httptest.Server
 	lock   sync.Mutex
@@ -33,6 +37,14 @@ type FakeCloudControllerAPI struct {
 
 	// Number of apps
 	AppNumber int
+
+	// Number of requests to answer with a 401, to simulate an expired token
+	unauthorizedRequests int
+	tokenRequests        int
+
+	// Whether the v3 endpoints answer with an ETag and a 304 when it matches
+	ETags            bool
+	notModifiedPages int
 }
 
 // NewFakeCloudControllerAPI create a new cloud controller
@@ -73,23 +85,95 @@ func (f *FakeCloudControllerAPI) ServeHTTP(rw http.ResponseWriter, r *http.Reque
 	f.ReceivedRequests <- r
 	f.lock.Lock()
 	f.usedEndpoints = append(f.usedEndpoints, r.URL.Path)
+	f.usedQueries = append(f.usedQueries, r.URL.Path+"?"+r.URL.RawQuery)
 	f.lock.Unlock()
 
 	time.Sleep(f.RequestTime * time.Millisecond)
 	rw.Header().Set("Content-Type", "application/json")
-	f.writeResponse(rw, r)
+	if f.rejectRequest(r) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		if strings.HasPrefix(r.URL.Path, "/v2/") {
+			rw.Write([]byte(`{"code":10002,"description":"Authentication error","error_code":"CF-NotAuthenticated"}`))
+		} else {
+			rw.Write([]byte(`{"errors":[{"code":10002,"title":"CF-NotAuthenticated","detail":"Authentication error"}]}`))
+		}
+	} else if !f.notModified(rw, r) {
+		f.writeResponse(rw, r)
+	}
 
 	f.lock.Lock()
 	f.requested = true
 	f.lock.Unlock()
 }
 
+// RejectNextRequests makes the cloud controller answer the next n API requests with a 401
+func (f *FakeCloudControllerAPI) RejectNextRequests(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.unauthorizedRequests = n
+}
+
+// TokenRequests returns the number of tokens requested
+func (f *FakeCloudControllerAPI) TokenRequests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.tokenRequests
+}
+
+func (f *FakeCloudControllerAPI) rejectRequest(r *http.Request) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch r.URL.Path {
+	case "/oauth/token":
+		f.tokenRequests++
+		return false
+	case "/", "/v2/info":
+		return false
+	}
+	if f.unauthorizedRequests > 0 {
+		f.unauthorizedRequests--
+		return true
+	}
+	return false
+}
+
 func (f *FakeCloudControllerAPI) GetUsedEndpoints() []string {
 	f.lock.Lock()
 	defer f.lock.Unlock()
 	return f.usedEndpoints
 }
 
+// GetUsedQueries returns the path and query of the requests received
+func (f *FakeCloudControllerAPI) GetUsedQueries() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.usedQueries
+}
+
+// NotModifiedPages returns the number of v3 pages answered with a 304
+func (f *FakeCloudControllerAPI) NotModifiedPages() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.notModifiedPages
+}
+
+// notModified sets the ETag of the v3 pages, it answers with a 304 and returns true when the request has it already
+func (f *FakeCloudControllerAPI) notModified(rw http.ResponseWriter, r *http.Request) bool {
+	if !f.ETags || !strings.HasPrefix(r.URL.Path, "/v3/") {
+		return false
+	}
+	etag := fmt.Sprintf(`"%s-%s"`, r.URL.Path, r.URL.Query().Get("page"))
+	rw.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") != etag {
+		return false
+	}
+	rw.WriteHeader(http.StatusNotModified)
+	f.lock.Lock()
+	f.notModifiedPages++
+	f.lock.Unlock()
+	return true
+}
+
 // AuthToken returns auth token
 func (f *FakeCloudControllerAPI) AuthToken() string {
 	if f.tokenType == "" && f.accessToken == "" {
@@ -3008,6 +3092,160 @@ func (f *FakeCloudControllerAPI) writeResponse(rw http.ResponseWriter, r *http.R
 		  	]
 			}`)))
 		}
+	case "/v3/audit_events":
+		rw.Write(filterAuditEvents(r, `
+		{
+			"pagination": {
+				"total_results": 5,
+				"total_pages": 1,
+				"first": {
+					"href": "https://cloudfoundry.env/v3/audit_events?page=1&per_page=50"
+				},
+				"last": {
+					"href": "https://cloudfoundry.env/v3/audit_events?page=1&per_page=50"
+				},
+				"next": null,
+				"previous": null
+			},
+			"resources": [
+				{
+					"guid": "a595fe2f-01ff-4965-a50c-290258ab8582",
+					"created_at": "2019-10-04T11:12:00Z",
+					"updated_at": "2019-10-04T11:12:00Z",
+					"type": "audit.app.update",
+					"actor": {
+						"guid": "d144abe3-3d7b-40d4-b63f-2584798d3ee5",
+						"type": "user",
+						"name": "admin"
+					},
+					"target": {
+						"guid": "6d254438-cc3b-44a6-b2e6-343ca92deb5f",
+						"type": "app",
+						"name": "p-invitations-green"
+					},
+					"data": {
+						"request": {
+							"name": "p-invitations-green"
+						}
+					},
+					"space": {
+						"guid": "417b893e-291e-48ec-94c7-7b2348604365"
+					},
+					"organization": {
+						"guid": "671557cf-edcd-49df-9863-ee14513d13c7"
+					}
+				},
+				{
+					"guid": "0c8a6ae4-b0a6-4c8d-a5a5-3d4b5e43e2ea",
+					"created_at": "2019-10-04T11:12:30Z",
+					"updated_at": "2019-10-04T11:12:30Z",
+					"type": "audit.app.process.scale",
+					"actor": {
+						"guid": "d144abe3-3d7b-40d4-b63f-2584798d3ee5",
+						"type": "user",
+						"name": "admin"
+					},
+					"target": {
+						"guid": "6d254438-cc3b-44a6-b2e6-343ca92deb5f",
+						"type": "app",
+						"name": "p-invitations-green"
+					},
+					"data": {
+						"process_type": "web",
+						"request": {
+							"instances": 2
+						}
+					},
+					"space": {
+						"guid": "417b893e-291e-48ec-94c7-7b2348604365"
+					},
+					"organization": {
+						"guid": "671557cf-edcd-49df-9863-ee14513d13c7"
+					}
+				},
+				{
+					"guid": "57d7b8b9-4cbb-47e1-a2a7-8c5b8b5e1b30",
+					"created_at": "2019-10-04T11:13:00Z",
+					"updated_at": "2019-10-04T11:13:00Z",
+					"type": "audit.app.delete-request",
+					"actor": {
+						"guid": "d144abe3-3d7b-40d4-b63f-2584798d3ee5",
+						"type": "user",
+						"name": "admin"
+					},
+					"target": {
+						"guid": "6116f9ec-2bd6-4dd6-b7fe-a1b6acf6662a",
+						"type": "app",
+						"name": "hello-datadog-cf-ruby-dev"
+					},
+					"data": {
+						"request": {
+							"recursive": true
+						}
+					},
+					"space": {
+						"guid": "827da8e5-1676-42ec-9028-46fbfe04fb86"
+					},
+					"organization": {
+						"guid": "8c19a50e-7974-4c67-adea-9640fae21526"
+					}
+				},
+				{
+					"guid": "b4e2ad87-46e1-4f3a-9e1b-8d2f7d0c3c6e",
+					"created_at": "2019-10-04T11:13:30Z",
+					"updated_at": "2019-10-04T11:13:30Z",
+					"type": "audit.app.process.crash",
+					"actor": {
+						"guid": "6d254438-cc3b-44a6-b2e6-343ca92deb5f",
+						"type": "process",
+						"name": "web"
+					},
+					"target": {
+						"guid": "6d254438-cc3b-44a6-b2e6-343ca92deb5f",
+						"type": "app",
+						"name": "p-invitations-green"
+					},
+					"data": {
+						"index": 0,
+						"reason": "CRASHED",
+						"exit_description": "APP/PROC/WEB: Exited with status 137 (out of memory)"
+					},
+					"space": {
+						"guid": "417b893e-291e-48ec-94c7-7b2348604365"
+					},
+					"organization": {
+						"guid": "671557cf-edcd-49df-9863-ee14513d13c7"
+					}
+				},
+				{
+					"guid": "e0b3c5a1-8f3f-4c8e-9d56-5f1e0a1a7d11",
+					"created_at": "2019-10-04T11:14:00Z",
+					"updated_at": "2019-10-04T11:14:00Z",
+					"type": "audit.space.create",
+					"actor": {
+						"guid": "d144abe3-3d7b-40d4-b63f-2584798d3ee5",
+						"type": "user",
+						"name": "admin"
+					},
+					"target": {
+						"guid": "bc3fd1d6-6cc8-4e46-a6d9-8a8d7c6e2c13",
+						"type": "space",
+						"name": "staging"
+					},
+					"data": {
+						"request": {
+							"name": "staging"
+						}
+					},
+					"space": {
+						"guid": "bc3fd1d6-6cc8-4e46-a6d9-8a8d7c6e2c13"
+					},
+					"organization": {
+						"guid": "671557cf-edcd-49df-9863-ee14513d13c7"
+					}
+				}
+			]
+		}`))
 	case "/oauth/token":
 		rw.Write([]byte(fmt.Sprintf(`
 		{
@@ -3017,5 +3255,54 @@ func (f *FakeCloudControllerAPI) writeResponse(rw http.ResponseWriter, r *http.R
 		`, f.tokenType, f.accessToken)))
 	case "/v2/read":
 		http.Redirect(rw, r, "http://asdasdasd.com", http.StatusPermanentRedirect)
+	default:
+		if strings.HasPrefix(r.URL.Path, "/v2/apps/") {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"code":100004,"description":"The app could not be found","error_code":"CF-AppNotFound"}`))
+		}
+	}
+}
+
+// filterAuditEvents keeps the audit events created at or after the created_ats[gte] filter of the request,
+// and returns the page of the request when it has a per_page parameter
+func filterAuditEvents(r *http.Request, body string) []byte {
+	since := r.URL.Query().Get("created_ats[gte]")
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if since == "" && perPage <= 0 {
+		return []byte(body)
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		panic(err)
+	}
+	resources := []interface{}{}
+	for _, resource := range response["resources"].([]interface{}) {
+		// The timestamps all have the same format, they sort like the times
+		if resource.(map[string]interface{})["created_at"].(string) >= since {
+			resources = append(resources, resource)
+		}
+	}
+	pagination := response["pagination"].(map[string]interface{})
+	pagination["total_results"] = len(resources)
+	if perPage > 0 {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		pagination["total_pages"] = (len(resources) + perPage - 1) / perPage
+		start, end := (page-1)*perPage, page*perPage
+		if start > len(resources) {
+			start = len(resources)
+		}
+		if end > len(resources) {
+			end = len(resources)
+		}
+		resources = resources[start:end]
+	}
+	response["resources"] = resources
+	filtered, err := json.Marshal(response)
+	if err != nil {
+		panic(err)
 	}
+	return filtered
 }
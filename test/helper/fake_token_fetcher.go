@@ -1,10 +1,27 @@
 package helper
 
 type FakeTokenFetcher struct {
-	NumCalls int
+	NumCalls   int
+	NumRefresh int
+	Err        error
 }
 
-func (tokenFetcher *FakeTokenFetcher) FetchAuthToken() string {
+func (tokenFetcher *FakeTokenFetcher) FetchAuthToken() (string, error) {
 	tokenFetcher.NumCalls++
-	return "auth token"
+	if tokenFetcher.Err != nil {
+		return "", tokenFetcher.Err
+	}
+	return "auth token", nil
+}
+
+func (tokenFetcher *FakeTokenFetcher) RefreshAuthToken() (string, error) {
+	tokenFetcher.NumRefresh++
+	if tokenFetcher.Err != nil {
+		return "", tokenFetcher.Err
+	}
+	return "auth token", nil
+}
+
+func (tokenFetcher *FakeTokenFetcher) FailureCount() uint64 {
+	return 0
 }
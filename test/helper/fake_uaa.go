@@ -13,8 +13,13 @@ type FakeUAA struct {
 
 	tokenType   string
 	accessToken string
+	expiresIn   int
 
-	requested bool
+	requested   bool
+	numRequests int
+	failures    int
+	release     chan struct{} // closed to answer the blocked requests
+	numBlocked  int
 }
 
 func NewFakeUAA(tokenType string, accessToken string) *FakeUAA {
@@ -30,6 +35,7 @@ func (f *FakeUAA) Start() {
 }
 
 func (f *FakeUAA) Close() {
+	f.ReleaseRequests()
 	f.server.Close()
 }
 
@@ -43,16 +49,81 @@ func (f *FakeUAA) Requested() bool {
 	return f.requested
 }
 
+// SetExpiresIn sets the lifetime in seconds of the tokens returned by the UAA
+func (f *FakeUAA) SetExpiresIn(expiresIn int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expiresIn = expiresIn
+}
+
+// NumRequests returns the number of tokens requested
+func (f *FakeUAA) NumRequests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.numRequests
+}
+
+// FailNextRequests makes the UAA answer the next n token requests with an internal server error
+func (f *FakeUAA) FailNextRequests(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = n
+}
+
+// BlockRequests makes the UAA wait for ReleaseRequests before answering the next token requests
+func (f *FakeUAA) BlockRequests() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.release == nil {
+		f.release = make(chan struct{})
+	}
+}
+
+// ReleaseRequests answers the blocked token requests
+func (f *FakeUAA) ReleaseRequests() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.release != nil {
+		close(f.release)
+		f.release = nil
+	}
+}
+
+// NumBlocked returns the number of token requests waiting for ReleaseRequests
+func (f *FakeUAA) NumBlocked() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.numBlocked
+}
+
 func (f *FakeUAA) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	f.lock.Lock()
+	expiresIn := f.expiresIn
+	if f.failures > 0 {
+		f.failures--
+		f.lock.Unlock()
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if release := f.release; release != nil {
+		f.numBlocked++
+		f.lock.Unlock()
+		<-release
+		f.lock.Lock()
+		f.numBlocked--
+	}
+	f.lock.Unlock()
 	rw.Write([]byte(fmt.Sprintf(`
 		{
 			"token_type": "%s",
-			"access_token": "%s"
+			"access_token": "%s",
+			"expires_in": %d
 		}
-	`, f.tokenType, f.accessToken)))
+	`, f.tokenType, f.accessToken, expiresIn)))
 	f.lock.Lock()
 	f.requested = true
+	f.numRequests++
 	f.lock.Unlock()
 }
 
@@ -133,7 +133,11 @@ var _ = Describe("DatadogFirehoseNozzle", func() {
 		Expect(err).NotTo(HaveOccurred())
 
 		for _, m := range payload.Series {
-			Expect(m.Type).To(Equal("gauge"))
+			if m.Metric == "cloudfoundry.nozzle.origin.counterName" || m.Metric == "cloudfoundry.nozzle.counterName" {
+				Expect(m.Type).To(Equal("count"))
+			} else {
+				Expect(m.Type).To(Equal("gauge"))
+			}
 
 			if m.Metric == "cloudfoundry.nozzle.origin.metricName" || m.Metric == "cloudfoundry.nozzle.metricName" {
 				Expect(m.Tags).To(HaveLen(9))
@@ -161,7 +165,7 @@ var _ = Describe("DatadogFirehoseNozzle", func() {
 				Expect(m.Tags[7]).To(Equal("origin:origin"))
 
 				Expect(m.Points).To(Equal([]metric.Point{
-					{Timestamp: 3, Value: 15.0},
+					{Timestamp: 3, Value: 3.0},
 				}))
 			} else if m.Metric == "cloudfoundry.nozzle.totalMessagesReceived" {
 				Expect(m.Tags).To(HaveLen(2))
@@ -179,6 +183,11 @@ var _ = Describe("DatadogFirehoseNozzle", func() {
 				Expect(m.Points[0].Value).To(Equal(0.0))
 			} else if m.Metric == "cloudfoundry.nozzle.slowConsumerAlert" {
 
+			} else if m.Metric == "cloudfoundry.nozzle.uaaTokenFetchFailures" {
+				Expect(m.Points[0].Value).To(Equal(0.0))
+			} else if strings.HasPrefix(m.Metric, "cloudfoundry.nozzle.postMetrics") {
+				Expect(m.Tags).To(HaveLen(2))
+				Expect(m.Points).To(HaveLen(1))
 			} else {
 				panic("Unknown metric " + m.Metric)
 			}